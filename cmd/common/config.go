@@ -4,8 +4,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/imdario/mergo"
+	"github.com/jstaf/onedriver/fs"
 	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/jstaf/onedriver/ui"
 	"github.com/rs/zerolog/log"
@@ -13,28 +15,99 @@ import (
 )
 
 type Config struct {
-	CacheDir         string `yaml:"cacheDir"`
-	LogLevel         string `yaml:"log"`
-	graph.AuthConfig `yaml:"auth"`
+	CacheDir          string                 `yaml:"cacheDir"`
+	LogLevel          string                 `yaml:"log"`
+	WebAddr           string                 `yaml:"webAddr"`
+	RestartOnFailure  bool                   `yaml:"restartOnFailure"`
+	ConnectTimeout    time.Duration          `yaml:"connectTimeout"`
+	HeaderTimeout     time.Duration          `yaml:"headerTimeout"`
+	MaxRequests       int                    `yaml:"maxRequests"`
+	MaxUploadRequests int                    `yaml:"maxUploadRequests"`
+	FallbackAuth      []string               `yaml:"fallbackAuth"`
+	Proxy             string                 `yaml:"proxy"`
+	OnlineCheck       string                 `yaml:"onlineCheck"`
+	PreferredHash     string                 `yaml:"preferredHash"`
+	Mounts            map[string]MountConfig `yaml:"mounts,omitempty"`
+	graph.AuthConfig  `yaml:"auth"`
+	fs.Options        `yaml:",inline"`
 }
 
-// DefaultConfigPath returns the default config location for onedriver
+// MountConfig holds settings that only apply to one mountpoint, for when
+// accounts need to be set up differently from each other. They are stored in
+// Config.Mounts by the mountpoint's absolute path.
+type MountConfig struct {
+	// Proxy overrides Config.Proxy for this mountpoint.
+	Proxy string `yaml:"proxy,omitempty"`
+	// Name is shown for the mount in file managers instead of the account's
+	// email address.
+	Name string `yaml:"name,omitempty"`
+}
+
+// ProxyFor returns the proxy to use for a mountpoint.
+func (c Config) ProxyFor(mountpoint string) string {
+	if mount, exists := c.Mounts[mountpoint]; exists && mount.Proxy != "" {
+		return mount.Proxy
+	}
+	return c.Proxy
+}
+
+// NameFor returns the name a mountpoint was given, if any.
+func (c Config) NameFor(mountpoint string) string {
+	return c.Mounts[mountpoint].Name
+}
+
+// SetMountProxy changes the proxy used by one mountpoint. An empty proxy makes
+// it use Config.Proxy again.
+func (c *Config) SetMountProxy(mountpoint string, proxy string) {
+	mount := c.Mounts[mountpoint]
+	mount.Proxy = proxy
+	c.setMount(mountpoint, mount)
+}
+
+// SetMountName changes the name shown for a mountpoint in file managers. An
+// empty name goes back to the account's email address.
+func (c *Config) SetMountName(mountpoint string, name string) {
+	mount := c.Mounts[mountpoint]
+	mount.Name = name
+	c.setMount(mountpoint, mount)
+}
+
+func (c *Config) setMount(mountpoint string, mount MountConfig) {
+	if mount == (MountConfig{}) {
+		delete(c.Mounts, mountpoint)
+		return
+	}
+	if c.Mounts == nil {
+		c.Mounts = make(map[string]MountConfig)
+	}
+	c.Mounts[mountpoint] = mount
+}
+
+// DefaultConfigPath returns the default config location for onedriver. It is
+// empty if neither $XDG_CONFIG_HOME nor $HOME are set (like in a container).
 func DefaultConfigPath() string {
 	confDir, err := os.UserConfigDir()
 	if err != nil {
-		log.Error().Err(err).Msg("Could not determine configuration directory.")
+		return ""
 	}
 	return filepath.Join(confDir, "onedriver/config.yml")
 }
 
-// LoadConfig is the primary way of loading onedriver's config
+// LoadConfig is the primary way of loading onedriver's config. An empty path
+// means there is no config file. CacheDir is left empty if there is no sensible
+// default for it, so it must be set some other way.
 func LoadConfig(path string) *Config {
-	xdgCacheDir, _ := os.UserCacheDir()
 	defaults := Config{
-		CacheDir: filepath.Join(xdgCacheDir, "onedriver"),
 		LogLevel: "debug",
 	}
+	if xdgCacheDir, err := os.UserCacheDir(); err == nil {
+		defaults.CacheDir = filepath.Join(xdgCacheDir, "onedriver")
+	}
 
+	if path == "" {
+		log.Info().Msg("No configuration file, using defaults.")
+		return &defaults
+	}
 	conf, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Warn().
@@ -58,6 +131,7 @@ func LoadConfig(path string) *Config {
 	}
 
 	config.CacheDir = ui.UnescapeHome(config.CacheDir)
+	config.TempDir = ui.UnescapeHome(config.TempDir)
 	return config
 }
 
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -19,6 +20,40 @@ func TestLoadConfig(t *testing.T) {
 	home, _ := os.UserHomeDir()
 	assert.Equal(t, filepath.Join(home, "somewhere/else"), conf.CacheDir)
 	assert.Equal(t, "warn", conf.LogLevel)
+	assert.True(t, conf.NoVerifyCache)
+	assert.Equal(t, 5*time.Second, conf.ConnectTimeout)
+	assert.Zero(t, conf.HeaderTimeout)
+	assert.Equal(t, "http://work-proxy.example.com:8080", conf.ProxyFor("/home/user/Work"))
+	assert.Equal(t, "http://proxy.example.com:3128", conf.ProxyFor("/home/user/OneDrive"))
+}
+
+// Mountpoints should be able to use their own proxy, and go back to the global
+// one once it is cleared.
+func TestSetMountProxy(t *testing.T) {
+	t.Parallel()
+	conf := Config{Proxy: "http://proxy:3128"}
+	conf.SetMountProxy("/mnt/work", "http://work-proxy:8080")
+	assert.Equal(t, "http://work-proxy:8080", conf.ProxyFor("/mnt/work"))
+	assert.Equal(t, "http://proxy:3128", conf.ProxyFor("/mnt/home"))
+
+	conf.SetMountProxy("/mnt/work", "")
+	assert.Equal(t, "http://proxy:3128", conf.ProxyFor("/mnt/work"))
+	assert.Empty(t, conf.Mounts, "Mounts without settings should not be kept around.")
+}
+
+// Renaming a mount should not lose its other settings.
+func TestSetMountName(t *testing.T) {
+	t.Parallel()
+	conf := Config{}
+	conf.SetMountProxy("/mnt/work", "http://work-proxy:8080")
+	conf.SetMountName("/mnt/work", "Work")
+	assert.Equal(t, "Work", conf.NameFor("/mnt/work"))
+	assert.Equal(t, "http://work-proxy:8080", conf.ProxyFor("/mnt/work"))
+	assert.Equal(t, "", conf.NameFor("/mnt/home"))
+
+	conf.SetMountProxy("/mnt/work", "")
+	conf.SetMountName("/mnt/work", "")
+	assert.Empty(t, conf.Mounts)
 }
 
 func TestConfigMerge(t *testing.T) {
@@ -41,6 +76,13 @@ func TestLoadNonexistentConfig(t *testing.T) {
 	assert.Equal(t, "debug", conf.LogLevel)
 }
 
+// An empty config path (no config directory) should also give the defaults.
+func TestLoadConfigNoPath(t *testing.T) {
+	t.Parallel()
+	conf := LoadConfig("")
+	assert.Equal(t, "debug", conf.LogLevel)
+}
+
 func TestWriteConfig(t *testing.T) {
 	t.Parallel()
 	conf := LoadConfig(filepath.Join(configTestDir, "config-test.yml"))
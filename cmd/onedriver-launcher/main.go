@@ -9,7 +9,6 @@ import "C"
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"unsafe"
@@ -18,6 +17,7 @@ import (
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 	"github.com/jstaf/onedriver/cmd/common"
+	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/jstaf/onedriver/ui"
 	"github.com/jstaf/onedriver/ui/systemd"
 	"github.com/rs/zerolog"
@@ -117,6 +117,13 @@ func activateCallback(app *gtk.Application, config *common.Config, configPath st
 
 		escapedMount := unit.UnitNamePathEscape(mount)
 		systemdUnit := systemd.TemplateUnit(systemd.OnedriverServiceTemplate, escapedMount)
+		if restored, err := ui.RestoreMount(config.CacheDir, escapedMount); err != nil {
+			log.Error().Err(err).Str("mountpoint", mount).
+				Msg("Could not restore the cache of a previously removed drive.")
+		} else if restored {
+			log.Info().Str("mountpoint", mount).
+				Msg("Restored the cache of a previously removed drive.")
+		}
 		log.Info().
 			Str("mountpoint", mount).
 			Str("systemdUnit", systemdUnit).
@@ -127,7 +134,7 @@ func activateCallback(app *gtk.Application, config *common.Config, configPath st
 			return
 		}
 
-		row, sw := newMountRow(*config, mount)
+		row, sw := newMountRow(config, configPath, mount)
 		switches[mount] = sw
 		listbox.Insert(row, -1)
 
@@ -177,13 +184,14 @@ func activateCallback(app *gtk.Application, config *common.Config, configPath st
 	popover.SetPosition(gtk.POS_BOTTOM)
 	header.PackEnd(menuBtn)
 
+	ui.EmptyTrash(config.CacheDir, ui.TrashRetention)
 	mounts := ui.GetKnownMounts(config.CacheDir)
 	for _, mount := range mounts {
 		mount = unit.UnitNamePathUnescape(mount)
 
 		log.Info().Str("mount", mount).Msg("Found existing mount.")
 
-		row, sw := newMountRow(*config, mount)
+		row, sw := newMountRow(config, configPath, mount)
 		switches[mount] = sw
 		listbox.Insert(row, -1)
 	}
@@ -236,7 +244,7 @@ func xdgOpenDir(mount string) {
 
 // newMountRow constructs a new ListBoxRow with the controls for an individual mountpoint.
 // mount is the path to the new mountpoint.
-func newMountRow(config common.Config, mount string) (*gtk.ListBoxRow, *gtk.Switch) {
+func newMountRow(config *common.Config, configPath string, mount string) (*gtk.ListBoxRow, *gtk.Switch) {
 	row, _ := gtk.ListBoxRowNew()
 	row.SetSelectable(true)
 	box, _ := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 5)
@@ -245,7 +253,11 @@ func newMountRow(config common.Config, mount string) (*gtk.ListBoxRow, *gtk.Swit
 	escapedMount := unit.UnitNamePathEscape(mount)
 	unitName := systemd.TemplateUnit(systemd.OnedriverServiceTemplate, escapedMount)
 
-	driveName, err := common.GetXDGVolumeInfoName(filepath.Join(mount, ".xdg-volume-info"))
+	var err error
+	driveName := config.NameFor(mount)
+	if driveName == "" {
+		driveName, err = common.GetXDGVolumeInfoName(filepath.Join(mount, ".xdg-volume-info"))
+	}
 	if err != nil {
 		log.Error().
 			Err(err).
@@ -315,7 +327,8 @@ func newMountRow(config common.Config, mount string) (*gtk.ListBoxRow, *gtk.Swit
 		accountLabel, _ := gtk.LabelNew(accountName)
 		popoverBox.Add(accountLabel)
 	}
-	// rename the mount by rewriting the .xdg-volume-info file
+	// rename the mount, onedriver reads the name from the config file when it
+	// starts
 	renameMountpointEntry, _ := gtk.EntryNew()
 	renameMountpointEntry.SetTooltipText("Change the label that your file browser uses for this drive")
 	renameMountpointEntry.SetText(driveName)
@@ -341,25 +354,14 @@ func newMountRow(config common.Config, mount string) (*gtk.ListBoxRow, *gtk.Swit
 			Msg("Renaming mount.")
 		popover.GrabFocus()
 
-		err = systemd.UnitSetActive(unitName, true)
-		if err != nil {
-			ctx.Error().Err(err).Msg("Failed to start mount for rename.")
+		// .xdg-volume-info is read-only, onedriver makes it up from the config
+		config.SetMountName(mount, newName)
+		if err := config.WriteConfig(configPath); err != nil {
+			ctx.Error().Err(err).Msg("Failed to write new mount name.")
+			ui.Dialog("Could not save drive name: "+err.Error(), gtk.MESSAGE_ERROR, nil)
 			return
 		}
-		mountToggle.SetActive(true)
-
-		if ui.PollUntilAvail(mount, -1) {
-			xdgVolumeInfo := common.TemplateXDGVolumeInfo(newName)
-			driveName = newName
-			//FIXME why does this not work???
-			err = ioutil.WriteFile(filepath.Join(mount, ".xdg-volume-info"), []byte(xdgVolumeInfo), 0644)
-			if err != nil {
-				ctx.Error().Err(err).Msg("Failed to write new mount name.")
-				return
-			}
-		} else {
-			ctx.Error().Err(err).Msg("Mount never became ready.")
-		}
+		driveName = newName
 		// update label in UI now
 		label.SetMarkup(fmt.Sprintf("%s <span style=\"italic\" weight=\"light\">(%s)</span>    ",
 			newName, tildePath,
@@ -370,6 +372,42 @@ func newMountRow(config common.Config, mount string) (*gtk.ListBoxRow, *gtk.Swit
 	})
 	popoverBox.Add(renameMountpointEntry)
 
+	// a proxy for just this drive, for accounts that can only be reached
+	// through one. onedriver reads it from the config file when it starts.
+	proxyEntry, _ := gtk.EntryNew()
+	proxyEntry.SetPlaceholderText("Proxy (like http://proxy:3128)")
+	proxyEntry.SetTooltipText("Connect to OneDrive through this proxy when using this drive")
+	proxyEntry.SetText(config.Mounts[mount].Proxy)
+	// runs on enter
+	proxyEntry.Connect("activate", func(entry *gtk.Entry) {
+		proxy, err := entry.GetText()
+		ctx := log.With().
+			Str("signal", "activate").
+			Str("mount", mount).
+			Str("proxy", proxy).
+			Logger()
+		if err != nil {
+			ctx.Error().Err(err).Msg("Failed to get new proxy.")
+			return
+		}
+		if proxy != "" {
+			if _, err := graph.ParseProxy(proxy); err != nil {
+				ui.Dialog("Proxy should look like http://proxy.example.com:3128",
+					gtk.MESSAGE_ERROR, nil)
+				return
+			}
+		}
+		ctx.Info().Msg("Changing proxy for mount.")
+		popover.GrabFocus()
+		config.SetMountProxy(mount, proxy)
+		if err := config.WriteConfig(configPath); err != nil {
+			ui.Dialog("Could not save proxy: "+err.Error(), gtk.MESSAGE_ERROR, nil)
+			return
+		}
+		ui.Dialog("Proxy change will take effect on next filesystem start.", gtk.MESSAGE_INFO, nil)
+	})
+	popoverBox.Add(proxyEntry)
+
 	separator, _ := gtk.SeparatorMenuItemNew()
 	popoverBox.Add(separator)
 
@@ -411,8 +449,9 @@ func newMountRow(config common.Config, mount string) (*gtk.ListBoxRow, *gtk.Swit
 			Msg("Request to delete drive.")
 
 		if ui.CancelDialog(nil, "<span weight=\"bold\">Remove drive?</span>",
-			"This will remove all data for this drive from your local computer. "+
-				"It can also be used to \"reset\" the drive to its original state.") {
+			"This will remove this drive from your local computer. Its cached "+
+				"files are kept for 7 days, and are restored if the drive is added "+
+				"again at the same location.") {
 			log.Info().
 				Str("signal", "clicked").
 				Str("mount", mount).
@@ -421,8 +460,11 @@ func newMountRow(config common.Config, mount string) (*gtk.ListBoxRow, *gtk.Swit
 			systemd.UnitSetEnabled(unitName, false)
 			systemd.UnitSetActive(unitName, false)
 
-			cachedir, _ := os.UserCacheDir()
-			os.RemoveAll(fmt.Sprintf("%s/onedriver/%s/", cachedir, escapedMount))
+			if err := ui.TrashMount(config.CacheDir, escapedMount); err != nil {
+				log.Error().Err(err).Str("mount", mount).
+					Msg("Could not move cache to the trash, deleting it instead.")
+				os.RemoveAll(filepath.Join(config.CacheDir, escapedMount))
+			}
 
 			row.Destroy()
 		}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// files being exported are downloaded next to where they go with this suffix,
+// and only renamed into place once they have been verified
+const exportPartialSuffix = ".onedriver-partial"
+
+// exportProgress is what an export has done so far.
+type exportProgress struct {
+	dest       string
+	downloaded int
+	skipped    int
+	failed     int
+	bytes      uint64
+}
+
+// runExport copies the whole drive into dest without mounting it. Files that
+// are already in dest with the same content (like from an export that was
+// interrupted) are skipped, so running it again picks up where it left off.
+func runExport(auth *graph.Auth, dest string) error {
+	root, err := graph.GetItemPath("/", auth)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	progress := &exportProgress{dest: dest}
+	start := time.Now()
+	exportDir(root, dest, auth, progress)
+
+	fmt.Printf("Downloaded %d files (%d bytes) in %s, skipped %d that were already exported.\n",
+		progress.downloaded, progress.bytes, time.Since(start).Round(time.Second),
+		progress.skipped)
+	if progress.failed > 0 {
+		return fmt.Errorf("%d items could not be exported, run the export again to retry them",
+			progress.failed)
+	}
+	return nil
+}
+
+// exportDir exports everything in a directory, and gives the directory the
+// same mtime as on the server once its contents are done.
+func exportDir(dir *graph.DriveItem, path string, auth *graph.Auth, progress *exportProgress) {
+	children, err := graph.GetItemChildren(dir.ID, auth)
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Could not list directory to export.")
+		progress.failed++
+		return
+	}
+	for _, child := range children {
+		childPath := filepath.Join(path, child.Name)
+		if !child.IsDir() {
+			exportFile(child, childPath, auth, progress)
+			continue
+		}
+		if err := os.Mkdir(childPath, 0755); err != nil && !os.IsExist(err) {
+			log.Error().Err(err).Str("path", childPath).Msg("Could not create directory.")
+			progress.failed++
+			continue
+		}
+		exportDir(child, childPath, auth, progress)
+	}
+	setExportMtime(dir, path)
+}
+
+// exportFile downloads a single file, unless it has been exported already.
+func exportFile(item *graph.DriveItem, path string, auth *graph.Auth, progress *exportProgress) {
+	if exported(item, path) {
+		progress.skipped++
+		return
+	}
+	ctx := log.With().Str("id", item.ID).Str("path", path).Logger()
+
+	partial := path + exportPartialSuffix
+	err := graph.DownloadToFile(item.ID, partial, auth)
+	if err != nil {
+		// the partial copy could have been from an older version of the file
+		ctx.Warn().Err(err).Msg("Download failed, retrying from the start.")
+		os.Remove(partial)
+		err = graph.DownloadToFile(item.ID, partial, auth)
+	}
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		ctx.Error().Err(err).Msg("Could not export file.")
+		progress.failed++
+		return
+	}
+	setExportMtime(item, path)
+
+	progress.downloaded++
+	progress.bytes += item.Size
+	rel, _ := filepath.Rel(progress.dest, path)
+	fmt.Printf("[%d] %s\n", progress.downloaded+progress.skipped, rel)
+}
+
+// exported is true if path already has the item's content. Items without hashes
+// can only be compared by size and mtime.
+func exported(item *graph.DriveItem, path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil || uint64(st.Size()) != item.Size {
+		return false
+	}
+	if item.HasHashes() {
+		return item.VerifyStream(file)
+	}
+	return item.ModTime != nil && st.ModTime().Equal(*item.ModTime)
+}
+
+func setExportMtime(item *graph.DriveItem, path string) {
+	if item.ModTime == nil {
+		return
+	}
+	if err := os.Chtimes(path, time.Now(), *item.ModTime); err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("Could not set mtime.")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTripFunc is a fake transport for graph.HTTPClient.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// fakeExportServer serves a single item with content instead of OneDrive, and
+// records the Range header of every download request. Calling restore puts the
+// real graph.HTTPClient back. Not safe for parallel tests, since
+// graph.HTTPClient is shared.
+func fakeExportServer(item *graph.DriveItem, content []byte) (ranges *[]string, restore func()) {
+	original := graph.HTTPClient
+	downloads := make([]string, 0)
+	graph.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var body []byte
+		if strings.HasSuffix(r.URL.Path, "/content") {
+			downloads = append(downloads, r.Header.Get("Range"))
+			var start, end int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			body = content[start : end+1]
+		} else {
+			body, _ = json.Marshal(item)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(string(body))),
+		}, nil
+	})}
+	return &downloads, func() { graph.HTTPClient = original }
+}
+
+// exportTestDir is an empty directory to export to.
+func exportTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "onedriver_export_test")
+	require.NoError(t, err)
+	return dir
+}
+
+func exportTestItem(content []byte) *graph.DriveItem {
+	modTime := time.Date(2021, 11, 5, 13, 4, 5, 0, time.UTC)
+	return &graph.DriveItem{
+		ID:      "export-test",
+		Name:    "export.txt",
+		Size:    uint64(len(content)),
+		ModTime: &modTime,
+		File:    &graph.File{Hashes: graph.Hashes{SHA1Hash: graph.SHA1Hash(&content)}},
+	}
+}
+
+var exportTestAuth = &graph.Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+
+// Files that were already exported should not be downloaded again.
+func TestExportFileSkipsMatching(t *testing.T) {
+	content := []byte("already exported")
+	item := exportTestItem(content)
+	ranges, restore := fakeExportServer(item, content)
+	defer restore()
+	dir := exportTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, item.Name)
+	require.NoError(t, ioutil.WriteFile(path, content, 0644))
+
+	progress := &exportProgress{dest: filepath.Dir(path)}
+	exportFile(item, path, exportTestAuth, progress)
+	assert.Equal(t, 1, progress.skipped)
+	assert.Equal(t, 0, progress.downloaded)
+	assert.Empty(t, *ranges, "Nothing should have been downloaded.")
+}
+
+// Files that differ from the server, in size or content, should be downloaded
+// again.
+func TestExportFileRedownloadsMismatch(t *testing.T) {
+	content := []byte("the version on the server")
+	item := exportTestItem(content)
+	_, restore := fakeExportServer(item, content)
+	defer restore()
+	dir := exportTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for name, local := range map[string][]byte{
+		"size": []byte("short"),
+		"hash": []byte("the version on the laptop"),
+	} {
+		path := filepath.Join(dir, name+".txt")
+		require.NoError(t, ioutil.WriteFile(path, local, 0644))
+
+		progress := &exportProgress{dest: filepath.Dir(path)}
+		exportFile(item, path, exportTestAuth, progress)
+		assert.Equal(t, 1, progress.downloaded, name)
+		exported, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, content, exported, name)
+		st, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.True(t, st.ModTime().Equal(*item.ModTime), name)
+	}
+}
+
+// An interrupted export should pick up where its partial download left off, and
+// only move it into place once it is done.
+func TestExportFileResumesPartial(t *testing.T) {
+	content := []byte("resumed from the middle")
+	item := exportTestItem(content)
+	ranges, restore := fakeExportServer(item, content)
+	defer restore()
+	dir := exportTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, item.Name)
+	require.NoError(t, ioutil.WriteFile(path+exportPartialSuffix, content[:8], 0644))
+
+	progress := &exportProgress{dest: filepath.Dir(path)}
+	exportFile(item, path, exportTestAuth, progress)
+	assert.Equal(t, 1, progress.downloaded)
+	assert.Equal(t, []string{fmt.Sprintf("bytes=8-%d", len(content)-1)}, *ranges)
+
+	exported, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, exported)
+	_, err = os.Stat(path + exportPartialSuffix)
+	assert.True(t, os.IsNotExist(err), "Partial download should have been renamed.")
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
 
@@ -51,12 +49,76 @@ func main() {
 	logLevel := flag.StringP("log", "l", "",
 		"Set logging level/verbosity for the filesystem. "+
 			"Can be one of: fatal, error, warn, info, debug, trace")
+	quiet := flag.BoolP("quiet", "q", false,
+		"Only print warnings and errors, regardless of the configured log level.")
 	cacheDir := flag.StringP("cache-dir", "c", "",
 		"Change the default cache directory used by onedriver. "+
 			"Will be created if the path does not already exist.")
+	tempDir := flag.String("temp-dir", "",
+		"Change where onedriver writes transient files like in-progress downloads. "+
+			"Defaults to a subdirectory of the cache directory. "+
+			"Useful when the cache directory is on a slow or network disk.")
 	wipeCache := flag.BoolP("wipe-cache", "w", false,
 		"Delete the existing onedriver cache directory and then exit. "+
 			"This is equivalent to resetting the program.")
+	noVerifyCache := flag.Bool("no-verify-cache", false,
+		"Skip verifying the hash of cached file content each time a file is opened. "+
+			"This makes opening large files much faster on slow CPUs, at the cost of "+
+			"not detecting cached content that has been corrupted on disk.")
+	uploadWorkers := flag.Int("upload-workers", 0,
+		"Maximum number of files to upload at the same time (default 5). "+
+			"Use 1 on slow or metered connections.")
+	syncWrites := flag.Bool("sync-writes", false,
+		"Wait for a file's changes to finish uploading when it is closed, instead of "+
+			"uploading them in the background. Closing fails if the upload does.")
+	uid := flag.Int("uid", -1,
+		"Make every file appear to be owned by this user ID, instead of the user "+
+			"running onedriver. Useful when sharing the mount over Samba or NFS.")
+	gid := flag.Int("gid", -1,
+		"Make every file appear to belong to this group ID, instead of the group "+
+			"of the user running onedriver.")
+	mtimePrecision := flag.Duration("mtime-precision", 0,
+		"Truncate modification times to a multiple of this (default 1s), so tools "+
+			"like rsync see the same time locally as on OneDrive.")
+	force := flag.Bool("force", false,
+		"Mount even if the mountpoint is not empty. "+
+			"Existing files in the mountpoint will be hidden until it is unmounted.")
+	authScopes := flag.String("auth-scopes", "",
+		"Space-separated list of OAuth2 scopes to request when authenticating. "+
+			"Defaults to \"user.read files.readwrite.all offline_access\".")
+	idleTimeout := flag.Duration("idle-timeout", 0,
+		"Unmount and exit after the filesystem has not been used for this long "+
+			"(like \"30m\"). Disabled by default.")
+	webAddr := flag.String("web-addr", "",
+		"Serve a status page at this address (like \"8080\" or \"127.0.0.1:8080\"). "+
+			"Only this machine can connect unless a host is given. Disabled by default.")
+	restartOnFailure := flag.Bool("restart-on-failure", false,
+		"Mount again if the connection to the kernel is lost, instead of exiting. "+
+			"Gives up after 5 quick failures in a row.")
+	connectTimeout := flag.Duration("connect-timeout", 0,
+		"How long connecting to OneDrive may take before giving up (default 15s).")
+	headerTimeout := flag.Duration("header-timeout", 0,
+		"How long OneDrive may take to start responding to a request (default 1m). "+
+			"Responses that have started are never cut off, however slow they are.")
+	maxRequests := flag.Int("max-requests", 0,
+		"Make at most this many requests to OneDrive at the same time, queueing the "+
+			"rest. Helps avoid being throttled. Unlimited by default.")
+	maxUploadRequests := flag.Int("max-upload-requests", 0,
+		"Give uploads their own limit of this many requests at the same time, instead "+
+			"of counting them against --max-requests.")
+	setup := flag.Bool("setup", false,
+		"Log in, pick a mountpoint, and set up a systemd user service that mounts "+
+			"OneDrive there on every login. Meant for machines without a desktop.")
+	history := flag.Duration("history", 0,
+		"Print what onedriver has done to files in the mountpoint over this long "+
+			"(1h if no duration is given), then exit. Works while it is mounted.")
+	flag.Lookup("history").NoOptDefVal = "1h"
+	printTokenFor := flag.String("print-token", "",
+		"Print an access token for a mountpoint (or auth_tokens.json file) that other "+
+			"Microsoft Graph tools can use, then exit. Anyone with it can access your files.")
+	exportTo := flag.String("export", "",
+		"Download everything on OneDrive to this directory without mounting it, then "+
+			"exit. The mountpoint only picks the account. Running it again resumes it.")
 	versionFlag := flag.BoolP("version", "v", false, "Display program version.")
 	debugOn := flag.BoolP("debug", "d", false, "Enable FUSE debug logging. "+
 		"This logs communication between onedriver and the kernel.")
@@ -81,8 +143,94 @@ func main() {
 	if *logLevel != "" {
 		config.LogLevel = *logLevel
 	}
+	if *tempDir != "" {
+		config.TempDir = *tempDir
+	}
+	if *noVerifyCache {
+		config.NoVerifyCache = true
+	}
+	if *authScopes != "" {
+		config.Scopes = *authScopes
+	}
+	if *idleTimeout > 0 {
+		config.IdleTimeout = *idleTimeout
+	}
+	if *webAddr != "" {
+		config.WebAddr = *webAddr
+	}
+	if *uploadWorkers > 0 {
+		config.UploadWorkers = *uploadWorkers
+	}
+	if *syncWrites {
+		config.SyncWrites = true
+	}
+	if *uid >= 0 {
+		owner := uint32(*uid)
+		config.UID = &owner
+	}
+	if *gid >= 0 {
+		group := uint32(*gid)
+		config.GID = &group
+	}
+	if *mtimePrecision > 0 {
+		config.MtimePrecision = *mtimePrecision
+	}
+	if *restartOnFailure {
+		config.RestartOnFailure = true
+	}
+	if *connectTimeout > 0 {
+		config.ConnectTimeout = *connectTimeout
+	}
+	if *headerTimeout > 0 {
+		config.HeaderTimeout = *headerTimeout
+	}
+	if *maxRequests > 0 {
+		config.MaxRequests = *maxRequests
+	}
+	if *maxUploadRequests > 0 {
+		config.MaxUploadRequests = *maxUploadRequests
+	}
 
 	zerolog.SetGlobalLevel(common.StringToLevel(config.LogLevel))
+	if *quiet && zerolog.GlobalLevel() < zerolog.WarnLevel {
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	}
+	if err := graph.SetTimeouts(config.ConnectTimeout, config.HeaderTimeout); err != nil {
+		log.Fatal().Err(err).Msg("Could not set up timeouts.")
+	}
+	graph.SetMaxRequests(config.MaxRequests, config.MaxUploadRequests)
+	graph.SetFallbackAuth(config.FallbackAuth)
+	if err := graph.SetPreferredHash(config.PreferredHash); err != nil {
+		log.Fatal().Err(err).Msg("Invalid preferredHash in config file.")
+	}
+	if err := graph.SetOnlineCheck(config.OnlineCheck); err != nil {
+		log.Fatal().Err(err).Msg("Invalid onlineCheck in config file.")
+	}
+	// replaced by the mountpoint's own proxy, if it has one, once we know
+	// which mountpoint that is
+	if err := graph.SetProxy(config.Proxy); err != nil {
+		log.Fatal().Err(err).Msg("Could not set up proxy.")
+	}
+
+	if config.CacheDir == "" {
+		log.Fatal().Msg("Could not determine a cache directory because neither " +
+			"$XDG_CACHE_HOME nor $HOME are set. Use --cache-dir to pick one.")
+	}
+	// the rest of the cache paths are derived from this one, so it must not
+	// depend on which directory we were started from
+	config.CacheDir, _ = filepath.Abs(config.CacheDir)
+
+	if *setup {
+		runSetup(config)
+		os.Exit(0)
+	}
+
+	if *printTokenFor != "" {
+		if err := printToken(config, *printTokenFor); err != nil {
+			log.Fatal().Err(err).Msg("Could not get an access token.")
+		}
+		os.Exit(0)
+	}
 
 	// wipe cache if desired
 	if *wipeCache {
@@ -99,6 +247,40 @@ func main() {
 	}
 
 	mountpoint := flag.Arg(0)
+	// compute cache name as systemd would
+	absMountPath, _ := filepath.Abs(mountpoint)
+	cachePath := filepath.Join(config.CacheDir, unit.UnitNamePathEscape(absMountPath))
+	if err := graph.SetProxy(config.ProxyFor(absMountPath)); err != nil {
+		log.Fatal().Err(err).Msg("Could not set up proxy.")
+	}
+
+	if *history > 0 {
+		if err := printHistory(fs.HistoryPath(cachePath), *history); err != nil {
+			log.Fatal().Err(err).Msg("Could not read history.")
+		}
+		os.Exit(0)
+	}
+
+	if *exportTo != "" {
+		os.MkdirAll(cachePath, 0700)
+		auth := graph.Authenticate(config.AuthConfig,
+			filepath.Join(cachePath, "auth_tokens.json"), *headless)
+		if err := runExport(auth, *exportTo); err != nil {
+			log.Fatal().Err(err).Msg("Export did not finish.")
+		}
+		os.Exit(0)
+	}
+
+	if staleMount(absMountPath) {
+		log.Warn().
+			Str("mountpoint", mountpoint).
+			Msg("Found a dead onedriver mount at the mountpoint, probably from a " +
+				"previous crash. Unmounting it.")
+		if err := detach(absMountPath); err != nil {
+			log.Fatal().Err(err).Msgf("Could not unmount the dead mount. "+
+				"(Try running \"fusermount3 -uz %s\")", mountpoint)
+		}
+	}
 	st, err := os.Stat(mountpoint)
 	if err != nil || !st.IsDir() {
 		log.Fatal().
@@ -106,12 +288,23 @@ func main() {
 			Msg("Mountpoint did not exist or was not a directory.")
 	}
 	if res, _ := ioutil.ReadDir(mountpoint); len(res) > 0 {
-		log.Fatal().Str("mountpoint", mountpoint).Msg("Mountpoint must be empty.")
+		if !*force {
+			log.Fatal().
+				Str("mountpoint", mountpoint).
+				Int("entries", len(res)).
+				Msg("Mountpoint must be empty, the files in it would be hidden while " +
+					"OneDrive is mounted. Use --force to mount anyway.")
+		}
+		log.Warn().
+			Str("mountpoint", mountpoint).
+			Int("entries", len(res)).
+			Msg("Mountpoint is not empty, existing files will be hidden until unmounted.")
 	}
 
-	// compute cache name as systemd would
-	absMountPath, _ := filepath.Abs(mountpoint)
-	cachePath := filepath.Join(config.CacheDir, unit.UnitNamePathEscape(absMountPath))
+	if config.TempDir != "" {
+		// the temp directory gets wiped, so each mount needs its own
+		config.TempDir = filepath.Join(config.TempDir, unit.UnitNamePathEscape(absMountPath))
+	}
 
 	// authenticate/re-authenticate if necessary
 	os.MkdirAll(cachePath, 0700)
@@ -125,62 +318,178 @@ func main() {
 	// create the filesystem
 	log.Info().Msgf("onedriver %s", common.Version())
 	auth := graph.Authenticate(config.AuthConfig, authPath, *headless)
-	filesystem := fs.NewFilesystem(auth, cachePath)
+	filesystem := fs.NewFilesystemWithOptions(auth, cachePath, config.Options)
 	go filesystem.DeltaLoop(30 * time.Second)
-	xdgVolumeInfo(filesystem, auth)
-
-	server, err := fuse.NewServer(filesystem, mountpoint, &fuse.MountOptions{
-		Name:          "onedriver",
-		FsName:        "onedriver",
-		DisableXAttrs: true,
-		MaxBackground: 1024,
-		Debug:         *debugOn,
-	})
+	go filesystem.WatchSuspend(10 * time.Second)
+	go filesystem.WatchDiskSpace(time.Minute)
+	go filesystem.ScheduleBandwidth()
+	xdgVolumeInfo(filesystem, auth, config.NameFor(absMountPath))
+
+	mountOptions := &fuse.MountOptions{
+		Name:                 "onedriver",
+		FsName:               "onedriver",
+		IgnoreSecurityLabels: true,
+		MaxBackground:        1024,
+		Debug:                *debugOn,
+		// fusermount is usually missing from containers, but we can mount
+		// directly if we are root there
+		DirectMount: os.Geteuid() == 0,
+	}
+	server, err := fuse.NewServer(filesystem, mountpoint, mountOptions)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("Mount failed. Is the mountpoint already in use? "+
 			"(Try running \"fusermount3 -uz %s\")\n", mountpoint)
 	}
+	current := &mount{server: server}
 
 	// setup signal handler for graceful unmount on signals like sigint
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go fs.UnmountHandler(sigChan, server)
+	go fs.UnmountHandler(sigChan, current, filesystem)
+
+	// status and control requests from the user
+	statusChan := make(chan os.Signal, 1)
+	signal.Notify(statusChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	go fs.StatusHandler(statusChan, filesystem)
+
+	if config.IdleTimeout > 0 {
+		go fs.IdleHandler(config.IdleTimeout, current, filesystem)
+	}
+
+	if config.WebAddr != "" {
+		go func() {
+			if err := filesystem.ServeWeb(config.WebAddr); err != nil {
+				log.Error().Err(err).Msg("Web UI stopped.")
+			}
+		}()
+	}
+
+	go func() {
+		if err := server.WaitMount(); err == nil {
+			filesystem.Prefetch(config.PrefetchPaths)
+		}
+	}()
 
 	// serve filesystem
 	log.Info().
 		Str("cachePath", cachePath).
 		Str("mountpoint", absMountPath).
 		Msg("Serving filesystem.")
-	server.Serve()
+	restarts := 0
+	for {
+		started := time.Now()
+		server.Serve()
+		if !config.RestartOnFailure || !mountSevered(mountpoint) {
+			// unmounted on purpose
+			break
+		}
+		if time.Since(started) > restartResetAfter {
+			restarts = 0
+		}
+		if server = remount(filesystem, mountpoint, mountOptions, &restarts); server == nil {
+			break
+		}
+		current.set(server)
+	}
+	filesystem.Cleanup()
+}
+
+// remount re-establishes a mount whose FUSE connection was severed, retrying
+// with a backoff. The filesystem and its cache are reused as-is, so nothing is
+// lost but the kernel's view of it. Returns nil once it has run out of retries.
+func remount(filesystem *fs.Filesystem, mountpoint string, opts *fuse.MountOptions, restarts *int) *fuse.Server {
+	for *restarts < maxRestarts {
+		*restarts++
+		backoff := restartBackoff(*restarts)
+		log.Warn().
+			Str("mountpoint", mountpoint).
+			Int("attempt", *restarts).
+			Str("backoff", backoff.String()).
+			Msg("Lost the connection to the kernel, mounting again.")
+		time.Sleep(backoff)
+		if err := detach(mountpoint); err != nil {
+			log.Error().Err(err).Msg("Could not detach the dead mount.")
+			continue
+		}
+		server, err := fuse.NewServer(filesystem, mountpoint, opts)
+		if err != nil {
+			log.Error().Err(err).Msg("Mount failed.")
+			continue
+		}
+		log.Info().Str("mountpoint", mountpoint).Msg("Mounted again.")
+		return server
+	}
+	log.Error().Int("attempts", *restarts).Msg("Could not mount again, giving up.")
+	return nil
 }
 
-// xdgVolumeInfo createx .xdg-volume-info for a nice little onedrive logo in the
-// corner of the mountpoint and shows the account name in the nautilus sidebar
-func xdgVolumeInfo(filesystem *fs.Filesystem, auth *graph.Auth) {
-	if child, _ := filesystem.GetPath("/.xdg-volume-info", auth); child != nil {
-		return
+// xdgVolumeInfo adds .xdg-volume-info for a nice little onedrive logo in the
+// corner of the mountpoint and shows the account name (or the name given to the
+// mount in the launcher) in the nautilus sidebar
+func xdgVolumeInfo(filesystem *fs.Filesystem, auth *graph.Auth, name string) {
+	if name == "" {
+		user, err := graph.GetUser(auth)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not create .xdg-volume-info")
+			return
+		}
+		name = user.UserPrincipalName
 	}
-	log.Info().Msg("Creating .xdg-volume-info")
-	user, err := graph.GetUser(auth)
+	err := filesystem.AddVolumeInfo(common.TemplateXDGVolumeInfo(name))
 	if err != nil {
 		log.Error().Err(err).Msg("Could not create .xdg-volume-info")
-		return
 	}
-	xdgVolumeInfo := common.TemplateXDGVolumeInfo(user.UserPrincipalName)
+}
 
-	// just upload directly and shove it in the cache
-	// (since the fs isn't mounted yet)
-	resp, err := graph.Put(
-		graph.ResourcePath("/.xdg-volume-info")+":/content",
-		auth,
-		strings.NewReader(xdgVolumeInfo),
-	)
+// printToken prints the access token for a mountpoint or auth tokens file,
+// renewing it first if it is about to expire. Only the token goes to stdout, so
+// that it can be captured by scripts.
+func printToken(config *common.Config, target string) error {
+	authPath := target
+	if st, err := os.Stat(target); err == nil && st.IsDir() {
+		absTarget, _ := filepath.Abs(target)
+		authPath = filepath.Join(config.CacheDir, unit.UnitNamePathEscape(absTarget),
+			"auth_tokens.json")
+		if err := graph.SetProxy(config.ProxyFor(absTarget)); err != nil {
+			return err
+		}
+	}
+	// leave scripts at least this long to use the token
+	auth, err := graph.CurrentAuth(authPath, 5*time.Minute)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to write .xdg-volume-info")
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Account: %s\nExpires: %s\n"+
+		"Warning: anyone with this token can access your OneDrive until it expires. "+
+		"Do not share it or write it to logs.\n",
+		auth.Account, time.Unix(auth.ExpiresAt, 0).Format(time.RFC3339))
+	fmt.Println(auth.AccessToken)
+	return nil
+}
+
+// printHistory prints what happened to files in a mount over the last while,
+// oldest first.
+func printHistory(path string, over time.Duration) error {
+	events, err := fs.ReadHistory(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	since := time.Now().Add(-over)
+	n := 0
+	for _, event := range events {
+		if !event.Time.After(since) {
+			continue
+		}
+		n++
+		where := ""
+		if event.Remote {
+			where = " (on server)"
+		}
+		fmt.Printf("%s  %-10s  %s%s\n",
+			event.Time.Local().Format("2006-01-02 15:04:05"), event.Action, event.Path, where)
 	}
-	root, _ := filesystem.GetPath("/", auth) // cannot fail
-	inode := fs.NewInode(".xdg-volume-info", 0644, root)
-	if json.Unmarshal(resp, &inode) == nil {
-		filesystem.InsertID(inode.ID(), inode)
+	if n == 0 {
+		fmt.Printf("Nothing happened in the last %s.\n", over)
 	}
+	return nil
 }
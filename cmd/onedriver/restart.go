@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// give up after the mount fails this many times in a row
+	maxRestarts = 5
+
+	// a mount that stayed up this long is considered healthy, and the restart
+	// count starts over after it fails
+	restartResetAfter = 10 * time.Minute
+)
+
+// mount is whatever FUSE server is currently serving the mountpoint. The
+// signal and idle handlers hang on to this rather than a *fuse.Server, so they
+// still unmount the right one after the mount has been re-established.
+type mount struct {
+	sync.Mutex
+	server *fuse.Server
+}
+
+func (m *mount) set(server *fuse.Server) {
+	m.Lock()
+	defer m.Unlock()
+	m.server = server
+}
+
+// Unmount unmounts the current server.
+func (m *mount) Unmount() error {
+	m.Lock()
+	server := m.server
+	m.Unlock()
+	if server == nil {
+		return errors.New("not mounted")
+	}
+	return server.Unmount()
+}
+
+// mountSevered checks whether the FUSE connection for a mountpoint went away
+// without it being unmounted, like when the connection was aborted through
+// /sys/fs/fuse/connections. A normal "fusermount3 -u" leaves an ordinary
+// directory behind instead.
+func mountSevered(mountpoint string) bool {
+	_, err := os.Stat(mountpoint)
+	return errors.Is(err, syscall.ENOTCONN)
+}
+
+// staleMount checks whether a mountpoint is a dead onedriver mount, like one
+// left behind by an instance that crashed. Dead mounts of other filesystems are
+// left alone.
+func staleMount(mountpoint string) bool {
+	if !mountSevered(mountpoint) {
+		return false
+	}
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		// mountpoint is the 5th field, filesystem type is right after the "-"
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "-" && i > 4 && i+1 < len(fields) {
+				if unescapeMountinfo(fields[4]) == mountpoint && fields[i+1] == "fuse.onedriver" {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
+}
+
+// unescapeMountinfo undoes the octal escapes (like "\040" for a space) that
+// the kernel uses for paths in /proc/self/mountinfo.
+func unescapeMountinfo(path string) string {
+	var out strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(path[i])
+	}
+	return out.String()
+}
+
+// detach lazily unmounts a dead mount so that the mountpoint can be used again.
+func detach(mountpoint string) error {
+	if os.Geteuid() == 0 {
+		return syscall.Unmount(mountpoint, syscall.MNT_DETACH)
+	}
+	return exec.Command("fusermount3", "-uz", mountpoint).Run()
+}
+
+// restartBackoff is how long to wait before the nth restart.
+func restartBackoff(n int) time.Duration {
+	return time.Second << uint(n-1)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/cmd/common"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/jstaf/onedriver/ui"
+	"github.com/jstaf/onedriver/ui/systemd"
+	"github.com/rs/zerolog/log"
+)
+
+// where systemd looks for user units installed by a package, see systemd.unit(5)
+var systemUnitDirs = []string{
+	"/etc/systemd/user",
+	"/usr/local/lib/systemd/user",
+	"/usr/lib/systemd/user",
+	"/lib/systemd/user",
+}
+
+// same as pkg/resources/onedriver@.service, for when onedriver was installed
+// without a package
+const serviceTemplate = `[Unit]
+Description=onedriver
+
+[Service]
+ExecStart=%s %%f
+ExecStopPost=%s -uz /%%I
+Restart=on-abnormal
+RestartSec=3
+RestartForceExitStatus=2
+
+[Install]
+WantedBy=default.target
+`
+
+// runSetup does what the launcher does when adding a mountpoint, but from the
+// terminal: it logs in, asks for a mountpoint, and then enables and starts a
+// systemd user service that mounts OneDrive there on every login.
+func runSetup(config *common.Config) {
+	home, _ := os.UserHomeDir()
+	defaultMount := filepath.Join(home, "OneDrive")
+	fmt.Printf("Where should OneDrive be mounted? [%s]: ", defaultMount)
+	response, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	mountpoint := strings.TrimSpace(response)
+	if mountpoint == "" {
+		mountpoint = defaultMount
+	}
+	mountpoint, _ = filepath.Abs(ui.UnescapeHome(mountpoint))
+
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		log.Fatal().Err(err).Str("mountpoint", mountpoint).Msg("Could not create mountpoint.")
+	}
+	if !ui.MountpointIsValid(mountpoint) {
+		log.Fatal().Str("mountpoint", mountpoint).
+			Msg("Mountpoint must be an empty directory (there might be hidden files).")
+	}
+
+	escapedMount := unit.UnitNamePathEscape(mountpoint)
+	cachePath := filepath.Join(config.CacheDir, escapedMount)
+	os.MkdirAll(cachePath, 0700)
+	auth := graph.Authenticate(config.AuthConfig, filepath.Join(cachePath, "auth_tokens.json"), true)
+	fmt.Printf("Logged in as %s.\n", auth.Account)
+
+	if err := installServiceTemplate(); err != nil {
+		log.Fatal().Err(err).Msg("Could not install the onedriver systemd service.")
+	}
+	unitName := systemd.TemplateUnit(systemd.OnedriverServiceTemplate, escapedMount)
+	if err := systemd.UnitSetEnabled(unitName, true); err != nil {
+		log.Fatal().Err(err).Str("unit", unitName).Msg("Could not enable systemd unit.")
+	}
+	if err := systemd.UnitSetActive(unitName, true); err != nil {
+		log.Fatal().Err(err).Str("unit", unitName).Msg("Could not start systemd unit.")
+	}
+	fmt.Printf("OneDrive is now mounted at %s, and will be mounted again on every "+
+		"login.\nLogs can be viewed with: journalctl --user -u '%s'\n",
+		mountpoint, unitName)
+}
+
+// installServiceTemplate writes the onedriver@.service template to the user's
+// systemd directory, unless a package already installed it somewhere.
+func installServiceTemplate() error {
+	confDir, err := os.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	userUnitDir := filepath.Join(confDir, "systemd/user")
+	for _, dir := range append(systemUnitDirs, userUnitDir) {
+		if _, err := os.Stat(filepath.Join(dir, systemd.OnedriverServiceTemplate)); err == nil {
+			return nil
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	fusermount, err := exec.LookPath("fusermount3")
+	if err != nil {
+		fusermount = "/usr/bin/fusermount3"
+	}
+	if err = os.MkdirAll(userUnitDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(userUnitDir, systemd.OnedriverServiceTemplate)
+	contents := fmt.Sprintf(serviceTemplate, executable, fusermount)
+	if err = ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		return err
+	}
+	log.Info().Str("path", path).Msg("Installed systemd service template.")
+	return systemd.DaemonReload()
+}
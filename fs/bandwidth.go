@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// BandwidthRule limits bandwidth from one time of day to another. Times are
+// local and written as "HH:MM". A rule whose end is before its start runs past
+// midnight, like from 22:00 to 06:00. Limits are in bytes per second, and zero
+// means unlimited.
+type BandwidthRule struct {
+	From     string `yaml:"from"`
+	To       string `yaml:"to"`
+	Upload   uint64 `yaml:"upload"`
+	Download uint64 `yaml:"download"`
+}
+
+// bandwidthRule is a BandwidthRule with its times parsed into minutes since
+// midnight.
+type bandwidthRule struct {
+	from, to         int
+	upload, download uint64
+}
+
+// parseTimeOfDay parses a "HH:MM" time into minutes since midnight.
+func parseTimeOfDay(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseBandwidthSchedule checks a schedule, dropping any rules that are
+// invalid.
+func parseBandwidthSchedule(schedule []BandwidthRule) []bandwidthRule {
+	rules := make([]bandwidthRule, 0, len(schedule))
+	for i, rule := range schedule {
+		from, err := parseTimeOfDay(rule.From)
+		if err == nil {
+			var to int
+			if to, err = parseTimeOfDay(rule.To); err == nil {
+				rules = append(rules, bandwidthRule{
+					from:     from,
+					to:       to,
+					upload:   rule.Upload,
+					download: rule.Download,
+				})
+				continue
+			}
+		}
+		log.Error().Err(err).Int("rule", i).Msg("Ignoring invalid bandwidth schedule rule.")
+	}
+	return rules
+}
+
+// bandwidthAt returns the limits that apply at a given time. The first rule
+// that covers the time wins.
+func bandwidthAt(rules []bandwidthRule, now time.Time) (upload, download uint64) {
+	minute := now.Hour()*60 + now.Minute()
+	for _, rule := range rules {
+		var active bool
+		if rule.from <= rule.to {
+			active = minute >= rule.from && minute < rule.to
+		} else {
+			active = minute >= rule.from || minute < rule.to
+		}
+		if active {
+			return rule.upload, rule.download
+		}
+	}
+	return 0, 0
+}
+
+// ScheduleBandwidth applies the limits from Options.BandwidthSchedule as the
+// time of day changes, and should be called as a goroutine. The schedule is
+// checked at the start of every minute, so limits also follow changes to the
+// clock like daylight saving time.
+func (f *Filesystem) ScheduleBandwidth() {
+	rules := parseBandwidthSchedule(f.opts.BandwidthSchedule)
+	if len(rules) == 0 {
+		return
+	}
+	for {
+		upload, download := bandwidthAt(rules, time.Now())
+		if oldUpload, oldDownload := graph.GetBandwidthLimits(); upload != oldUpload || download != oldDownload {
+			log.Info().
+				Uint64("upload", upload).
+				Uint64("download", download).
+				Msg("Changing bandwidth limits (bytes per second, 0 is unlimited).")
+			graph.SetBandwidthLimits(upload, download)
+		}
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+	}
+}
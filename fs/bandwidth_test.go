@@ -0,0 +1,41 @@
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthSchedule(t *testing.T) {
+	t.Parallel()
+	rules := parseBandwidthSchedule([]BandwidthRule{
+		{From: "08:00", To: "23:00", Upload: 100, Download: 200},
+		{From: "23:30", To: "06:00", Upload: 300},
+		{From: "25:00", To: "26:00", Upload: 1},
+		{From: "noon", To: "13:00", Upload: 1},
+	})
+	assert.Len(t, rules, 2, "Invalid rules should be dropped.")
+
+	at := func(clock string) time.Time {
+		parsed, _ := time.Parse("15:04", clock)
+		return time.Date(2021, 3, 4, parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+	}
+	for _, test := range []struct {
+		clock            string
+		upload, download uint64
+	}{
+		{"07:59", 0, 0},
+		{"08:00", 100, 200},
+		{"22:59", 100, 200},
+		{"23:00", 0, 0},
+		{"23:30", 300, 0},
+		{"00:00", 300, 0},
+		{"05:59", 300, 0},
+		{"06:00", 0, 0},
+	} {
+		upload, download := bandwidthAt(rules, at(test.clock))
+		assert.Equal(t, test.upload, upload, "Wrong upload limit at %s.", test.clock)
+		assert.Equal(t, test.download, download, "Wrong download limit at %s.", test.clock)
+	}
+}
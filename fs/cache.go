@@ -1,8 +1,11 @@
 package fs
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,20 +22,39 @@ import (
 // "low-level" FUSE API here:
 // https://github.com/libfuse/libfuse/blob/master/include/fuse_lowlevel.h
 type Filesystem struct {
+	// unix time in nanoseconds of the last op from the kernel, accessed
+	// atomically (must stay the first field for alignment on 32-bit platforms)
+	lastOp int64
+
 	fuse.RawFileSystem
 
 	metadata  sync.Map
 	db        *bolt.DB
 	content   *LoopbackCache
 	auth      *graph.Auth
-	root      string // the id of the filesystem's root item
+	root      string // the id of the filesystem's root item, resolved at startup
 	deltaLink string
 	uploads   *UploadManager
+	opts      Options
+	cacheDir  string
+	tempDir   string
+	ops       *opTracker    // summarizes bulk operations for the status file
+	history   *history      // what happened to files recently, for the user
+	activity  chan struct{} // signals the delta loop that the user is making changes
+	syncNow   chan struct{} // asks the delta loop to poll right away
+	prefetch  prefetchTracker
+	// recently fetched download URLs by ID, see downloadURL()
+	downloadURLs sync.Map
 
 	sync.RWMutex
 	offline    bool
+	quotaFull  bool           // the drive is over quota, so nothing new can be written
+	diskFull   bool           // the cache's disk is too full to download anything else
+	quotaCheck time.Time      // the last time the quota state was checked
+	conflicts  []ConflictItem // see updateConflicts()
 	lastNodeID uint64
 	inodes     []string
+	server     *fuse.Server // used to notify the kernel of remote changes
 
 	// tracks currently open directories
 	opendirsM sync.RWMutex
@@ -44,14 +66,21 @@ var (
 	bucketContent  = []byte("content")
 	bucketMetadata = []byte("metadata")
 	bucketDelta    = []byte("delta")
+	bucketDrive    = []byte("drive")
 	bucketVersion  = []byte("version")
 )
 
 // so we can tell what format the db has
 const fsVersion = "1"
 
-// NewFilesystem creates a new filesystem
+// NewFilesystem creates a new filesystem with the default options
 func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
+	return NewFilesystemWithOptions(auth, cacheDir, Options{})
+}
+
+// NewFilesystemWithOptions creates a new filesystem using a user-specified set
+// of options.
+func NewFilesystemWithOptions(auth *graph.Auth, cacheDir string, opts Options) *Filesystem {
 	// prepare cache directory
 	if _, err := os.Stat(cacheDir); err != nil {
 		if err = os.Mkdir(cacheDir, 0700); err != nil {
@@ -71,6 +100,7 @@ func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
 	db.Update(func(tx *bolt.Tx) error {
 		tx.CreateBucketIfNotExists(bucketMetadata)
 		tx.CreateBucketIfNotExists(bucketDelta)
+		tx.CreateBucketIfNotExists(bucketDrive)
 		versionBucket, _ := tx.CreateBucketIfNotExists(bucketVersion)
 
 		// migrate old content bucket to the local filesystem
@@ -106,8 +136,25 @@ func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
 		content:       content,
 		db:            db,
 		auth:          auth,
+		opts:          opts,
+		cacheDir:      cacheDir,
+		tempDir:       opts.TempDir,
+		activity:      make(chan struct{}, 1),
+		syncNow:       make(chan struct{}, 1),
+		lastOp:        time.Now().UnixNano(),
 		opendirs:      make(map[uint64][]*Inode),
 	}
+	if fs.tempDir == "" {
+		fs.tempDir = filepath.Join(cacheDir, "tmp")
+	}
+	// anything still in the temp directory is an orphan from a previous session
+	// that did not shut down cleanly
+	os.RemoveAll(fs.tempDir)
+	if err := os.MkdirAll(fs.tempDir, 0700); err != nil {
+		log.Fatal().Err(err).Str("path", fs.tempDir).Msg("Could not create temp directory.")
+	}
+	fs.ops = newOpTracker(func() { fs.WriteStatus() })
+	fs.history = newHistory(HistoryPath(cacheDir))
 
 	rootItem, err := graph.GetItem("root", auth)
 	root := NewInodeDriveItem(rootItem)
@@ -140,13 +187,31 @@ func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
 			log.Fatal().Err(err).Msg("Could not fetch root item of filesystem!")
 		}
 	}
-	// root inode is inode 1
+	// the root's mtime is what the mountpoint itself shows, and should always
+	// come with the root item. Without one, GetAttr would have nothing to show.
+	if root.DriveItem.ModTime == nil || root.DriveItem.ModTime.IsZero() {
+		log.Warn().Msg("Root item has no modification time, using the current time.")
+		now := time.Now()
+		root.DriveItem.ModTime = &now
+	}
+	// root inode is inode 1, we keep its real ID around so that we never need to
+	// resolve the "root" alias against the server again
 	fs.root = root.ID()
 	fs.InsertID(fs.root, root)
 
 	fs.uploads = NewUploadManager(2*time.Second, db, fs, auth)
 
 	if !fs.IsOffline() {
+		fs.checkQuota()
+	}
+	// the type of drive never changes, so neither do the fields it has
+	if drive, err := fs.lastDrive(); err == nil {
+		graph.SelectSharepointIDs(drive.DriveType != graph.DriveTypePersonal)
+	}
+
+	if !fs.IsOffline() {
+		go fs.retryRestoredUploads()
+
 		// .Trash-UID is used by "gio trash" for user trash, create it if it
 		// does not exist
 		trash := fmt.Sprintf(".Trash-%d", os.Getuid())
@@ -170,11 +235,197 @@ func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
 	return fs
 }
 
-// IsOffline returns whether or not the cache thinks its offline.
+// tempFile creates a new transient file in the temp directory. The caller is
+// responsible for removing it when done.
+func (f *Filesystem) tempFile(prefix string) (*os.File, error) {
+	return ioutil.TempFile(f.tempDir, prefix+"-*")
+}
+
+// tempDownload is an item's content, downloaded to a temp file that is deleted
+// again once it is closed.
+type tempDownload struct {
+	*os.File
+	Size uint64
+}
+
+func (t *tempDownload) Close() error {
+	t.File.Close()
+	return os.Remove(t.Name())
+}
+
+// downloadTemp downloads an item's content to disk instead of memory, so that
+// large files never have to fit in RAM. The returned file is rewound to the
+// start. Errors from the server are returned unchanged, so they can be checked
+// with IsUnknownID() and friends.
+func (f *Filesystem) downloadTemp(id string, prefix string) (*tempDownload, error) {
+	file, err := f.tempFile(prefix + "-" + id)
+	if err != nil {
+		return nil, err
+	}
+	temp := &tempDownload{File: file}
+	if temp.Size, err = graph.GetItemContentStream(id, f.auth, file); err != nil {
+		temp.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		temp.Close()
+		return nil, err
+	}
+	return temp, nil
+}
+
+// Cleanup removes any transient state left over by the filesystem. It should
+// be called once the filesystem has been unmounted.
+func (f *Filesystem) Cleanup() {
+	if err := os.RemoveAll(f.tempDir); err != nil {
+		log.Error().Err(err).Str("path", f.tempDir).Msg("Could not remove temp directory.")
+	}
+}
+
+// owner is the owner reported for every file, see Options.UID and Options.GID.
+func (f *Filesystem) owner() fuse.Owner {
+	// whatever user is running the filesystem is the owner by default
+	owner := fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if f.opts.UID != nil {
+		owner.Uid = *f.opts.UID
+	}
+	if f.opts.GID != nil {
+		owner.Gid = *f.opts.GID
+	}
+	return owner
+}
+
+// mtimePrecision is what modification times are truncated to before they are
+// reported or uploaded, see Options.MtimePrecision.
+func (f *Filesystem) mtimePrecision() time.Duration {
+	if f.opts.MtimePrecision <= 0 {
+		return time.Second
+	}
+	return f.opts.MtimePrecision
+}
+
+// IsOffline returns whether or not the cache thinks its offline. A paused
+// filesystem is always offline.
 func (f *Filesystem) IsOffline() bool {
 	f.RLock()
 	defer f.RUnlock()
-	return f.offline
+	return f.offline || graph.IsPaused()
+}
+
+// maxFileSize returns the size past which files can no longer be uploaded.
+func (f *Filesystem) maxFileSize() uint64 {
+	if f.opts.MaxFileSize > 0 {
+		return f.opts.MaxFileSize
+	}
+	return graph.MaxFileSize
+}
+
+// getDrive fetches the drive's details from the server and saves them to disk,
+// so that lastDrive() has something to work with while offline. StatFs() calls
+// this all the time, so they are only saved when they have changed.
+func (f *Filesystem) getDrive() (graph.Drive, error) {
+	drive, err := graph.GetDrive(f.auth)
+	if err != nil {
+		return drive, err
+	}
+	if last, err := f.lastDrive(); err == nil && last == drive {
+		return drive, nil
+	}
+	contents, _ := json.Marshal(drive)
+	f.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDrive).Put([]byte("drive"), contents)
+	})
+	return drive, nil
+}
+
+// lastDrive returns the drive details from the last time they were fetched.
+func (f *Filesystem) lastDrive() (graph.Drive, error) {
+	drive := graph.Drive{}
+	err := f.db.View(func(tx *bolt.Tx) error {
+		contents := tx.Bucket(bucketDrive).Get([]byte("drive"))
+		if contents == nil {
+			return errors.New("drive details have never been fetched")
+		}
+		return json.Unmarshal(contents, &drive)
+	})
+	return drive, err
+}
+
+// IsQuotaExceeded returns whether the drive is currently over its storage
+// quota. While it is, the filesystem refuses to create or write files (deleting
+// them is still allowed, since that is how the user gets out of this state).
+func (f *Filesystem) IsQuotaExceeded() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.quotaFull
+}
+
+// checkQuota fetches the drive's quota state from the server and updates
+// whether or not the filesystem is over quota.
+func (f *Filesystem) checkQuota() {
+	drive, err := f.getDrive()
+	if err != nil {
+		log.Debug().Err(err).Msg("Could not fetch drive quota state.")
+		return
+	}
+	exceeded := drive.Quota.State == "exceeded"
+	f.Lock()
+	changed := exceeded != f.quotaFull
+	f.quotaFull = exceeded
+	f.quotaCheck = time.Now()
+	f.Unlock()
+
+	if changed && exceeded {
+		log.Warn().
+			Uint64("used", drive.Quota.Used).
+			Uint64("total", drive.Quota.Total).
+			Msg("OneDrive storage quota exceeded, refusing new writes until space is freed.")
+	} else if changed {
+		log.Info().Msg("OneDrive is no longer over quota, allowing writes again.")
+		go f.retryQuotaFailures()
+	}
+}
+
+// markQuotaExceeded puts the filesystem in the over quota state after the
+// server refused an upload for lack of space. checkQuota() takes it back out
+// once the drive has space again.
+func (f *Filesystem) markQuotaExceeded() {
+	f.Lock()
+	changed := !f.quotaFull
+	f.quotaFull = true
+	f.quotaCheck = time.Now()
+	f.Unlock()
+	if changed {
+		log.Warn().Msg("OneDrive is out of space, refusing new writes until space is freed.")
+	}
+}
+
+// retryQuotaFailures uploads the changes that could not be uploaded while the
+// drive was out of space.
+func (f *Filesystem) retryQuotaFailures() {
+	for _, id := range f.uploads.quotaFailures() {
+		if err := f.ForceFlush(id); err != nil {
+			log.Error().Err(err).Str("id", id).
+				Msg("Could not retry upload that failed for lack of space.")
+		}
+	}
+}
+
+// retryRestoredUploads uploads the changes that could not be uploaded before
+// onedriver was last restarted. Items that have been deleted since are
+// forgotten about.
+func (f *Filesystem) retryRestoredUploads() {
+	for _, id := range f.uploads.takeRestored() {
+		if f.GetID(id) == nil {
+			f.uploads.CancelUpload(id)
+			continue
+		}
+		log.Info().Str("id", id).Msg("Retrying upload that failed before the last restart.")
+		if err := f.ForceFlush(id); err != nil {
+			log.Error().Err(err).Str("id", id).
+				Msg("Could not retry upload that failed before the last restart.")
+		}
+	}
 }
 
 // TranslateID returns the DriveItemID for a given NodeID
@@ -196,6 +447,106 @@ func (f *Filesystem) GetNodeID(nodeID uint64) *Inode {
 	return f.GetID(id)
 }
 
+// evictStale removes an item whose ID the server no longer recognizes from the
+// cache, then looks its path up again in case it still exists under a new ID.
+// Returns the replacement inode, if there is one.
+func (f *Filesystem) evictStale(id string, path string) *Inode {
+	inode := f.GetID(id)
+	if inode == nil {
+		return nil
+	}
+	parentID := inode.ParentID()
+	log.Warn().Str("id", id).Str("path", path).
+		Msg("Server does not recognize cached item ID, evicting it from cache.")
+	if inode.HasChanges() {
+		// local changes would be lost, leave it for the user to sort out
+		return nil
+	}
+	f.DeleteID(id)
+	f.content.Delete(id)
+
+	item, err := graph.GetItemPath(path, f.auth)
+	if err != nil || item.ID == id {
+		return nil
+	}
+	replacement := NewInodeDriveItem(item)
+	f.InsertChild(parentID, replacement)
+	return replacement
+}
+
+// OneDrive paths are at most 400 characters long, so no real directory tree is
+// deeper than this. A deeper one means the cache has a cycle in it.
+const maxTreeDepth = 400
+
+// evictTree removes an item and everything below it from the cache, along with
+// their content. Nothing is removed if anything in the tree has local changes
+// that have not been uploaded yet, or if the tree loops back on itself.
+func (f *Filesystem) evictTree(id string) error {
+	type entry struct {
+		id    string
+		depth int
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	stack := []entry{{id, 0}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		inode := f.GetID(top.id)
+		if inode == nil {
+			continue
+		}
+		if seen[top.id] || top.depth > maxTreeDepth {
+			log.Error().Str("id", id).Str("childID", top.id).Int("depth", top.depth).
+				Msg("Directory tree loops back on itself, the cache is corrupted.")
+			return errors.New("directory tree loops back on itself: " + inode.Path())
+		}
+		seen[top.id] = true
+		ids = append(ids, top.id)
+
+		inode.RLock()
+		for _, child := range inode.children {
+			stack = append(stack, entry{child, top.depth + 1})
+		}
+		inode.RUnlock()
+	}
+	// children need to come before their parents, so parents are still around
+	// to be unlinked from
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+
+	for _, each := range ids {
+		if inode := f.GetID(each); inode != nil && inode.HasChanges() {
+			return errors.New("item has local changes: " + inode.Path())
+		}
+	}
+	for _, each := range ids {
+		f.DeleteID(each)
+		f.content.Delete(each)
+	}
+	return nil
+}
+
+// fetchNodeID fetches an item the kernel knows about from the server, for the
+// rare case where it is not in our cache.
+func (f *Filesystem) fetchNodeID(nodeID uint64) *Inode {
+	id := f.TranslateID(nodeID)
+	if id == "" || isLocalID(id) || f.IsOffline() {
+		return nil
+	}
+	item, err := graph.GetItem(id, f.auth)
+	if err != nil {
+		log.Error().Err(err).Str("id", id).Uint64("nodeID", nodeID).
+			Msg("Could not fetch item missing from cache.")
+		return nil
+	}
+	inode := NewInodeDriveItem(item)
+	inode.nodeID = nodeID
+	f.InsertID(id, inode)
+	return inode
+}
+
 // InsertNodeID assigns a numeric inode ID used by the kernel if one is not
 // already assigned.
 func (f *Filesystem) InsertNodeID(inode *Inode) uint64 {
@@ -217,8 +568,12 @@ func (f *Filesystem) InsertNodeID(inode *Inode) uint64 {
 }
 
 // GetID gets an inode from the cache by ID. No API fetching is performed.
-// Result is nil if no inode is found.
+// Result is nil if no inode is found. The "root" alias used by the API is
+// resolved to the real ID of the root item once it is known.
 func (f *Filesystem) GetID(id string) *Inode {
+	if id == "root" && f.root != "" {
+		id = f.root
+	}
 	entry, exists := f.metadata.Load(id)
 	if !exists {
 		// we allow fetching from disk as a fallback while offline (and it's also
@@ -317,18 +672,19 @@ func (f *Filesystem) InsertChild(parentID string, child *Inode) uint64 {
 // be called before InsertID if being used to rename/move an item.
 func (f *Filesystem) DeleteID(id string) {
 	if inode := f.GetID(id); inode != nil {
-		parent := f.GetID(inode.ParentID())
-		parent.Lock()
-		for i, childID := range parent.children {
-			if childID == id {
-				parent.children = append(parent.children[:i], parent.children[i+1:]...)
-				if inode.IsDir() {
-					parent.subdir--
+		if parent := f.GetID(inode.ParentID()); parent != nil {
+			parent.Lock()
+			for i, childID := range parent.children {
+				if childID == id {
+					parent.children = append(parent.children[:i], parent.children[i+1:]...)
+					if inode.IsDir() {
+						parent.subdir--
+					}
+					break
 				}
-				break
 			}
+			parent.Unlock()
 		}
-		parent.Unlock()
 	}
 	f.metadata.Delete(id)
 	f.uploads.CancelUpload(id)
@@ -417,11 +773,83 @@ func (f *Filesystem) GetChildrenID(id string, auth *graph.Auth) (map[string]*Ino
 			inode.subdir++
 		}
 	}
+	inode.childrenFetched = time.Now()
 	inode.Unlock()
 
 	return children, nil
 }
 
+// RefreshChildren re-fetches the children of a directory from the server if
+// they were last fetched longer ago than maxAge. Children that no longer exist
+// on the server are removed, new children are added, and renamed children
+// (including ones where only the case of the name changed) get their new name.
+// Local-only children (not yet uploaded) are always kept.
+func (f *Filesystem) RefreshChildren(id string, maxAge time.Duration, auth *graph.Auth) error {
+	inode := f.GetID(id)
+	if inode == nil {
+		return errors.New(id + " not found in cache")
+	}
+	inode.RLock()
+	fresh := time.Since(inode.childrenFetched) < maxAge
+	inode.RUnlock()
+	if fresh || !inode.IsDir() || f.IsOffline() {
+		return nil
+	}
+
+	fetched, err := graph.GetItemChildren(id, auth)
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]*graph.DriveItem)
+	for _, item := range fetched {
+		remote[item.ID] = item
+	}
+
+	children, err := f.GetChildrenID(id, auth)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		childID := child.ID()
+		if item, exists := remote[childID]; exists {
+			delete(remote, childID)
+			if child.recentlyMoved() {
+				// the server may not have caught up with a rename yet
+				continue
+			}
+			if name := child.Name(); item.Name != "" && item.Name != name {
+				log.Info().
+					Str("id", childID).
+					Str("name", name).
+					Str("newName", item.Name).
+					Msg("Child was renamed on server, updating its name.")
+				child.SetName(item.Name)
+				// this can run inside a FUSE op on the directory, which the
+				// kernel holds a lock on until the op returns
+				go f.invalidateEntry(id, name)
+			}
+		} else if !isLocalID(childID) && !child.recentlyMoved() {
+			log.Info().
+				Str("id", childID).
+				Str("path", child.Path()).
+				Msg("Child no longer exists on server, removing from cache.")
+			f.DeleteID(childID)
+		}
+	}
+	for _, item := range remote {
+		if moved := f.GetID(item.ID); moved != nil && moved.recentlyMoved() {
+			// still listed where it was moved from
+			continue
+		}
+		f.InsertChild(id, NewInodeDriveItem(item))
+	}
+
+	inode.Lock()
+	inode.childrenFetched = time.Now()
+	inode.Unlock()
+	return nil
+}
+
 // GetChildrenPath grabs all DriveItems that are the children of the resource at
 // the path. If items are not found, they are fetched.
 func (f *Filesystem) GetChildrenPath(path string, auth *graph.Auth) (map[string]*Inode, error) {
@@ -545,14 +973,27 @@ func (f *Filesystem) MovePath(oldParent, newParent, oldName, newName string, aut
 	if err != nil {
 		return err
 	}
+	if inode == nil {
+		return errors.New(oldName + " not found in cache")
+	}
+	return f.moveInode(inode, newParent, newName)
+}
 
+// moveInode moves an item to a new position without asking the server where it
+// is.
+func (f *Filesystem) moveInode(inode *Inode, newParent, newName string) error {
+	parent := f.GetID(newParent)
+	if parent == nil {
+		return errors.New(newParent + " not found in cache")
+	}
 	id := inode.ID()
 	f.DeleteID(id)
 
 	// this is the actual move op
 	inode.SetName(newName)
-	parent := f.GetID(newParent)
-	inode.Parent.ID = parent.DriveItem.ID
+	inode.Lock()
+	inode.Parent.ID = parent.ID()
+	inode.Unlock()
 	f.InsertID(id, inode)
 	return nil
 }
@@ -3,9 +3,14 @@ package fs
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -63,3 +68,299 @@ func TestSamePointer(t *testing.T) {
 	}
 	assert.NotNil(t, item)
 }
+
+// A directory that contains itself (which should never happen) should make
+// evictTree give up instead of looping forever.
+func TestEvictTreeCycle(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_evict_tree_cycle"))
+	outer := NewInodeDriveItem(&graph.DriveItem{ID: "local-cycle-outer", Name: "outer"})
+	inner := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "local-cycle-inner",
+		Name:   "inner",
+		Parent: &graph.DriveItemParent{ID: outer.ID()},
+	})
+	outer.children = []string{inner.ID()}
+	inner.children = []string{outer.ID()}
+	cache.metadata.Store(outer.ID(), outer)
+	cache.metadata.Store(inner.ID(), inner)
+
+	assert.Error(t, cache.evictTree(outer.ID()))
+	assert.NotNil(t, cache.GetID(outer.ID()), "Nothing should be evicted.")
+	assert.NotNil(t, cache.GetID(inner.ID()), "Nothing should be evicted.")
+}
+
+// Prefetching a directory should leave every file in it cached, and report its
+// progress in the status file.
+func TestPrefetch(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_prefetch"))
+	cache.Prefetch([]string{"/Documents"})
+
+	status := cache.Status().Prefetch
+	require.NotNil(t, status)
+	assert.True(t, status.Finished)
+	assert.Empty(t, status.Failed)
+
+	children, err := cache.GetChildrenPath("/Documents", auth)
+	require.NoError(t, err)
+	for _, child := range children {
+		if !child.IsDir() {
+			assert.True(t, cache.content.HasContent(child.ID()),
+				"%s was not prefetched.", child.Path())
+		}
+	}
+}
+
+// Only large remote files that are not cached yet should be streamed.
+func TestStreamed(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystemWithOptions(auth, filepath.Join(testDBLoc, "test_streamed"),
+		Options{StreamThreshold: 1024})
+	large := NewInodeDriveItem(&graph.DriveItem{ID: "streamed-large", Name: "large", Size: 4096})
+	small := NewInodeDriveItem(&graph.DriveItem{ID: "streamed-small", Name: "small", Size: 512})
+	local := NewInode("local", 0644|fuse.S_IFREG, nil)
+	local.DriveItem.Size = 4096
+
+	assert.True(t, cache.streamed(large))
+	assert.False(t, cache.streamed(small))
+	assert.False(t, cache.streamed(local), "Local-only files have nothing to stream.")
+
+	require.NoError(t, cache.content.Insert(large.ID(), []byte("cached")))
+	assert.False(t, cache.streamed(large), "Cached content should be used when present.")
+
+	eager := NewFilesystem(auth, filepath.Join(testDBLoc, "test_streamed_eager"))
+	assert.False(t, eager.streamed(large))
+}
+
+// Prefetched paths should be pinned, along with everything below them.
+func TestPinned(t *testing.T) {
+	t.Parallel()
+	cache := &Filesystem{opts: Options{PrefetchPaths: []string{"Documents/", "/Pictures/2020"}}}
+	assert.True(t, cache.pinned("/Documents"))
+	assert.True(t, cache.pinned("/Documents/notes.txt"))
+	assert.True(t, cache.pinned("/Pictures/2020/beach.jpg"))
+	assert.False(t, cache.pinned("/Documents Old/notes.txt"))
+	assert.False(t, cache.pinned("/Pictures/beach.jpg"))
+}
+
+// Only content that can be downloaded again should be removed to free up
+// space.
+func TestEvictContent(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_evict_content"))
+	content := []byte("evict me")
+	for _, id := range []string{"evict-unused", "evict-open", "evict-changed"} {
+		require.NoError(t, cache.content.Insert(id, content))
+	}
+	_, err := cache.content.Open("evict-open")
+	require.NoError(t, err)
+	defer cache.content.Close("evict-open")
+	changed := NewInodeDriveItem(&graph.DriveItem{ID: "evict-changed", Name: "changed"})
+	changed.hasChanges = true
+	cache.InsertID(changed.ID(), changed)
+	local := NewInode("evict-local", 0644|fuse.S_IFREG, nil)
+	require.NoError(t, cache.content.Insert(local.ID(), content))
+
+	freed := cache.evictContent(1 << 30)
+	assert.Equal(t, uint64(len(content)), freed)
+	assert.False(t, cache.content.HasContent("evict-unused"))
+	assert.True(t, cache.content.HasContent("evict-open"), "Open files should be kept.")
+	assert.True(t, cache.content.HasContent("evict-changed"), "Changes should be kept.")
+	assert.True(t, cache.content.HasContent(local.ID()), "Local-only files should be kept.")
+}
+
+// Evicting a single item should only ever remove content that can be
+// downloaded again.
+func TestForceEvict(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_force_evict"))
+	content := []byte("evict me")
+	unused := NewInodeDriveItem(&graph.DriveItem{ID: "force-evict-unused", Name: "unused"})
+	unused.contentCTag = "ctag"
+	changed := NewInodeDriveItem(&graph.DriveItem{ID: "force-evict-changed", Name: "changed"})
+	changed.hasChanges = true
+	for _, inode := range []*Inode{unused, changed} {
+		cache.InsertID(inode.ID(), inode)
+		require.NoError(t, cache.content.Insert(inode.ID(), content))
+	}
+
+	require.NoError(t, cache.ForceEvict(unused.ID()))
+	assert.False(t, cache.content.HasContent(unused.ID()))
+	assert.Equal(t, "", unused.contentCTag)
+
+	assert.Error(t, cache.ForceEvict(changed.ID()), "Changes should not be evicted.")
+	assert.True(t, cache.content.HasContent(changed.ID()))
+	assert.Error(t, cache.ForceEvict("force-evict-missing"))
+}
+
+// .xdg-volume-info should only ever exist locally, and be read-only.
+func TestAddVolumeInfo(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_add_volume_info"))
+	if child, _ := cache.GetPath("/.xdg-volume-info", auth); child != nil {
+		t.Skip("Test account already has a real .xdg-volume-info.")
+	}
+	const contents = "[Volume Info]\nName=onedriver test\n"
+	require.NoError(t, cache.AddVolumeInfo(contents))
+
+	inode, err := cache.GetPath("/.xdg-volume-info", auth)
+	require.NoError(t, err)
+	require.NotNil(t, inode)
+	assert.Equal(t, volumeInfoID, inode.ID())
+	assert.Equal(t, uint64(len(contents)), inode.Size())
+	assert.Equal(t, uint32(0444), inode.Mode()&0777)
+	assert.Equal(t, contents, string(cache.content.Get(inode.ID())))
+
+	status := cache.Open(nil, &fuse.OpenIn{
+		InHeader: fuse.InHeader{NodeId: inode.NodeID()},
+		Flags:    uint32(os.O_WRONLY),
+	}, &fuse.OpenOut{})
+	assert.Equal(t, fuse.EACCES, status, "Should not be writable.")
+	status = cache.Unlink(nil, &fuse.InHeader{NodeId: cache.GetID(cache.root).NodeID()},
+		".xdg-volume-info")
+	assert.Equal(t, fuse.EPERM, status, "Should not be removable.")
+
+	// adding it again (like on the next start) should just update it
+	require.NoError(t, cache.AddVolumeInfo("[Volume Info]\nName=renamed\n"))
+	children, err := cache.GetChildrenID(cache.root, auth)
+	require.NoError(t, err)
+	assert.Equal(t, volumeInfoID, children[".xdg-volume-info"].ID())
+	assert.Equal(t, "[Volume Info]\nName=renamed\n", string(cache.content.Get(volumeInfoID)))
+}
+
+// Files OneDrive says are empty should still get the content we have for them,
+// and their size fixed.
+func TestOpenZeroSizeReported(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_open_zero_size"))
+	content := []byte("not actually empty")
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:   "zero-size-reported",
+		Name: "empty.docx",
+		CTag: "ctag",
+		File: &graph.File{},
+	})
+	inode.contentCTag = "ctag"
+	cache.InsertID(inode.ID(), inode)
+	require.NoError(t, cache.content.Insert(inode.ID(), content))
+
+	out := &fuse.OpenOut{}
+	status := cache.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: inode.NodeID()}}, out)
+	require.Equal(t, fuse.OK, status)
+	assert.Equal(t, uint64(len(content)), inode.Size())
+	assert.NotZero(t, out.OpenFlags&fuse.FOPEN_DIRECT_IO,
+		"The kernel would stop reading at the old size.")
+}
+
+// Create() on a file that already exists should only truncate it if asked to,
+// and fail if it was supposed to be a new file.
+func TestCreateExisting(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_create_existing"))
+	root := cache.GetID(cache.root)
+	content := []byte("keep me around")
+
+	tests := []struct {
+		name   string
+		flags  int
+		status fuse.Status
+		size   uint64
+	}{
+		{"create", os.O_CREATE | os.O_WRONLY, fuse.OK, uint64(len(content))},
+		{"create_trunc", os.O_CREATE | os.O_WRONLY | os.O_TRUNC, fuse.OK, 0},
+		{"create_excl", os.O_CREATE | os.O_WRONLY | os.O_EXCL, fuse.Status(syscall.EEXIST), uint64(len(content))},
+	}
+	for _, test := range tests {
+		name := "create_existing_" + test.name + ".txt"
+		inode := NewInode(name, 0644|fuse.S_IFREG, nil)
+		inode.DriveItem.Size = uint64(len(content))
+		cache.InsertChild(cache.root, inode)
+		require.NoError(t, cache.content.Insert(inode.ID(), content))
+
+		out := &fuse.CreateOut{}
+		status := cache.Create(nil, &fuse.CreateIn{
+			InHeader: fuse.InHeader{NodeId: root.NodeID()},
+			Flags:    uint32(test.flags),
+			Mode:     0644,
+		}, name, out)
+		assert.Equal(t, test.status, status, test.name)
+		assert.Equal(t, test.size, inode.Size(), test.name)
+		assert.Equal(t, test.size, uint64(len(cache.content.Get(inode.ID()))), test.name)
+		if status == fuse.OK {
+			assert.Equal(t, inode.NodeID(), out.NodeId, test.name)
+		}
+	}
+}
+
+// Children and parents that disagree should be found and fixed by checkTree.
+func TestCheckTree(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_check_tree"))
+	_, err := cache.GetChildrenID(cache.root, auth)
+	require.NoError(t, err)
+
+	dir := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "local-check-tree-dir",
+		Name:   "check_tree",
+		Folder: &graph.Folder{},
+		Parent: &graph.DriveItemParent{ID: cache.root},
+	})
+	cache.InsertChild(cache.root, dir)
+	for _, name := range []string{"listed", "unlisted"} {
+		cache.InsertChild(dir.ID(), NewInodeDriveItem(&graph.DriveItem{
+			ID:     "local-check-tree-" + name,
+			Name:   name,
+			Parent: &graph.DriveItemParent{ID: dir.ID()},
+		}))
+	}
+	orphan := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "local-check-tree-orphan",
+		Name:   "orphan",
+		Parent: &graph.DriveItemParent{ID: "local-check-tree-gone"},
+	})
+	cache.metadata.Store(orphan.ID(), orphan)
+
+	dir.Lock()
+	dir.children = []string{"local-check-tree-listed", "local-check-tree-missing"}
+	dir.Unlock()
+
+	assert.Equal(t, 3, cache.checkTree())
+	children, err := cache.GetChildrenID(dir.ID(), auth)
+	require.NoError(t, err)
+	assert.Len(t, children, 2)
+	assert.Contains(t, children, "listed")
+	assert.Contains(t, children, "unlisted")
+	assert.Nil(t, cache.GetID(orphan.ID()), "Orphan without changes should be evicted.")
+
+	assert.Equal(t, 0, cache.checkTree(), "Nothing should be left to fix.")
+}
+
+// Download URLs should only be kept around for as long as they are reused, and
+// only be listed for items that can have one.
+func TestDownloadURLExpiry(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_download_url_expiry"))
+	cache.downloadURLs.Store("expired", downloadURL{
+		url:     "https://example.com/expired",
+		fetched: time.Now().Add(-2 * downloadURLReuse),
+	})
+	cache.downloadURLs.Store("fresh", downloadURL{url: "https://example.com/fresh", fetched: time.Now()})
+	cache.expireDownloadURLs()
+	_, exists := cache.downloadURLs.Load("expired")
+	assert.False(t, exists, "Expired URL should have been forgotten.")
+	_, exists = cache.downloadURLs.Load("fresh")
+	assert.True(t, exists, "Fresh URL should have been kept.")
+
+	for _, item := range []*graph.DriveItem{
+		{ID: "download-url-dir", Name: "dir", Folder: &graph.Folder{}},
+		{ID: "local-download-url-file", Name: "file.txt"},
+	} {
+		inode := NewInodeDriveItem(item)
+		cache.InsertID(inode.ID(), inode)
+		dest := make([]byte, 4096)
+		n, status := cache.ListXAttr(nil, &fuse.InHeader{NodeId: inode.NodeID()}, dest)
+		require.Equal(t, fuse.OK, status)
+		assert.NotContains(t, string(dest[:n]), xattrDownloadURL, item.Name)
+	}
+}
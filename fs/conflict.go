@@ -0,0 +1,218 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// default naming format for conflict copies, see conflictName()
+const defaultConflictName = "{name} (conflict on {hostname} {time}){ext}"
+
+// conflictName builds the name of the conflict copy of a file from a template.
+// Supported tokens are {name} (the original name without its extension),
+// {ext}, {hostname}, and {time}.
+func conflictName(template string, name string, hostname string, when time.Time) string {
+	if template == "" {
+		template = defaultConflictName
+	}
+	ext := filepath.Ext(name)
+	return strings.NewReplacer(
+		"{name}", strings.TrimSuffix(name, ext),
+		"{ext}", ext,
+		"{hostname}", hostname,
+		// OneDrive does not allow colons in filenames
+		"{time}", when.Format("2006-01-02 15.04.05"),
+	).Replace(template)
+}
+
+// conflictCopy saves the local content of a file that has been changed both
+// locally and on the server as a new file next to the original, so that the
+// local changes survive the server's version being pulled down.
+func (f *Filesystem) conflictCopy(local *Inode) error {
+	parentID := local.ParentID()
+	parent := f.GetID(parentID)
+	if parent == nil {
+		return errors.New("parent of conflicting item not in cache")
+	}
+	hostname, _ := os.Hostname()
+	name := conflictName(f.opts.ConflictName, local.Name(), hostname, time.Now())
+	if isNameRestricted(name) {
+		return errors.New("conflict copy name is not allowed by OneDrive: " + name)
+	}
+	if child, _ := f.GetChild(parentID, name, nil); child != nil {
+		return errors.New("conflict copy already exists: " + name)
+	}
+
+	id := local.ID()
+	wasOpen := f.content.IsOpen(id)
+	src, err := f.content.Open(id)
+	if err != nil {
+		return err
+	}
+	if !wasOpen {
+		defer f.content.Close(id)
+	}
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	conflict := NewInode(name, local.Mode(), parent)
+	// a section reader leaves the seek position of an open file alone
+	n, err := f.content.InsertStream(conflict.ID(), io.NewSectionReader(src, 0, st.Size()))
+	f.content.Close(conflict.ID())
+	if err != nil {
+		f.content.Delete(conflict.ID())
+		return err
+	}
+	conflict.DriveItem.Size = uint64(n)
+	conflict.hasChanges = true
+	f.InsertChild(parentID, conflict)
+
+	log.Warn().
+		Str("id", id).
+		Str("path", local.Path()).
+		Str("conflictPath", conflict.Path()).
+		Msg("File was changed both locally and on the server, " +
+			"local changes have been saved as a conflict copy.")
+	f.history.record(historyConflict, conflict.ID(), conflict.Path(), false)
+	return f.uploads.QueueUpload(conflict)
+}
+
+// OneDrive's own sync clients name conflict copies after the computer that made
+// them, like "report-DESKTOP-1A2B3C4.docx". Windows computer names are at most
+// 15 characters and are shown in uppercase, and can be followed by a counter
+// like "-2". They have to start with a letter here, so that siblings like
+// "scan-1.pdf" or "invoice-2023.pdf" aren't taken for conflict copies.
+var clientConflictSuffix = regexp.MustCompile(`^[A-Z][A-Z0-9-]{0,14}(-[0-9]+)?$`)
+
+// conflictPattern matches the names of conflict copies made with a conflictName
+// template. The first submatch is the original name without its extension,
+// and the second is the extension.
+func conflictPattern(template string) *regexp.Regexp {
+	if template == "" {
+		template = defaultConflictName
+	}
+	pattern := strings.NewReplacer(
+		regexp.QuoteMeta("{name}"), "(.+?)",
+		regexp.QuoteMeta("{ext}"), `(\.[^.]*)?`,
+		regexp.QuoteMeta("{hostname}"), ".*",
+		regexp.QuoteMeta("{time}"), `\d{4}-\d{2}-\d{2} \d{2}\.\d{2}\.\d{2}`,
+	).Replace(regexp.QuoteMeta(template))
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// conflictOriginal works out whether name is a conflict copy of one of its
+// siblings, either one made by onedriver or by OneDrive itself, and returns the
+// name of that sibling. It is empty if name is not a conflict copy. hasSibling
+// checks whether a name exists in the same directory.
+func conflictOriginal(name string, pattern *regexp.Regexp, hasSibling func(string) bool) string {
+	if match := pattern.FindStringSubmatch(name); match != nil {
+		if original := match[1] + match[2]; original != name && hasSibling(original) {
+			return original
+		}
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i < len(base); i++ {
+		if base[i] == '-' && clientConflictSuffix.MatchString(base[i+1:]) &&
+			hasSibling(base[:i]+ext) {
+			return base[:i] + ext
+		}
+	}
+	return ""
+}
+
+// ConflictItem is a file that looks like the conflict copy of another.
+type ConflictItem struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Original string `json:"original"`
+}
+
+// childNames returns the lowercased names of the cached children of an item.
+// Only what is already in memory is used, so this never blocks on the server.
+func (f *Filesystem) childNames(inode *Inode) map[string]*Inode {
+	inode.RLock()
+	ids := append([]string{}, inode.children...)
+	inode.RUnlock()
+	names := make(map[string]*Inode, len(ids))
+	for _, id := range ids {
+		if entry, ok := f.metadata.Load(id); ok {
+			child := entry.(*Inode)
+			names[strings.ToLower(child.Name())] = child
+		}
+	}
+	return names
+}
+
+// conflictOf returns the name of the file an item is a conflict copy of, or an
+// empty string if it is not one.
+func (f *Filesystem) conflictOf(inode *Inode) string {
+	if inode.IsDir() {
+		return ""
+	}
+	parent := f.GetID(inode.ParentID())
+	if parent == nil {
+		return ""
+	}
+	siblings := f.childNames(parent)
+	return conflictOriginal(inode.Name(), conflictPattern(f.opts.ConflictName), func(name string) bool {
+		_, exists := siblings[strings.ToLower(name)]
+		return exists
+	})
+}
+
+// Conflicts returns the files that looked like conflict copies the last time
+// deltas were applied, so that they can be listed in the status file.
+func (f *Filesystem) Conflicts() []ConflictItem {
+	f.RLock()
+	defer f.RUnlock()
+	if f.conflicts == nil {
+		return make([]ConflictItem, 0)
+	}
+	return f.conflicts
+}
+
+// updateConflicts finds every cached file that looks like a conflict copy. This
+// walks the whole cache, so it is only done once per batch of deltas instead of
+// every time the status is written.
+func (f *Filesystem) updateConflicts() {
+	pattern := conflictPattern(f.opts.ConflictName)
+	conflicts := make([]ConflictItem, 0)
+	f.metadata.Range(func(key interface{}, value interface{}) bool {
+		dir := value.(*Inode)
+		if !dir.IsDir() {
+			return true
+		}
+		siblings := f.childNames(dir)
+		hasSibling := func(name string) bool {
+			_, exists := siblings[strings.ToLower(name)]
+			return exists
+		}
+		for _, child := range siblings {
+			if child.IsDir() {
+				continue
+			}
+			if original := conflictOriginal(child.Name(), pattern, hasSibling); original != "" {
+				conflicts = append(conflicts, ConflictItem{
+					ID:       child.ID(),
+					Path:     child.Path(),
+					Original: original,
+				})
+			}
+		}
+		return true
+	})
+	f.Lock()
+	f.conflicts = conflicts
+	f.Unlock()
+}
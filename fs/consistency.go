@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// checkTree looks for items whose parent and children don't agree with each
+// other, which would point to a bug in how deltas are applied, and repairs
+// them. Items that lost their parent are moved to wherever the server says they
+// are now, or evicted if it doesn't know them anymore. Returns the number of
+// problems found. See Options.CheckTree.
+func (f *Filesystem) checkTree() int {
+	type link struct {
+		parentID string
+		childID  string
+	}
+	var orphans []string
+	var dangling, unlinked []link
+
+	f.metadata.Range(func(key interface{}, value interface{}) bool {
+		inode := value.(*Inode)
+		id := key.(string)
+		if id == "root" || id == f.root {
+			return true
+		}
+		parentID := inode.ParentID()
+		if parent := f.GetID(parentID); parent == nil {
+			orphans = append(orphans, id)
+		} else {
+			parent.RLock()
+			listed := parent.children == nil // not fetched yet, can't tell
+			for _, childID := range parent.children {
+				if childID == id {
+					listed = true
+					break
+				}
+			}
+			parent.RUnlock()
+			if !listed {
+				unlinked = append(unlinked, link{parentID, id})
+			}
+		}
+
+		inode.RLock()
+		children := append([]string{}, inode.children...)
+		inode.RUnlock()
+		for _, childID := range children {
+			if child := f.GetID(childID); child == nil || child.ParentID() != id {
+				dangling = append(dangling, link{id, childID})
+			}
+		}
+		return true
+	})
+
+	for _, each := range dangling {
+		log.Warn().Str("id", each.childID).Str("parentID", each.parentID).
+			Msg("Directory listed a child that is gone or somewhere else, unlisting it.")
+		f.unlistChild(each.parentID, each.childID)
+	}
+	for _, each := range unlinked {
+		child := f.GetID(each.childID)
+		if child == nil {
+			continue
+		}
+		log.Warn().Str("id", each.childID).Str("path", child.Path()).
+			Msg("Item was missing from its directory's children, adding it back.")
+		f.InsertID(each.childID, child)
+	}
+	for _, id := range orphans {
+		f.repairOrphan(id)
+	}
+	return len(dangling) + len(unlinked) + len(orphans)
+}
+
+// unlistChild removes an ID from a directory's children without touching the
+// item itself, if there still is one.
+func (f *Filesystem) unlistChild(parentID string, childID string) {
+	parent := f.GetID(parentID)
+	if parent == nil {
+		return
+	}
+	parent.Lock()
+	defer parent.Unlock()
+	for i, id := range parent.children {
+		if id != childID {
+			continue
+		}
+		parent.children = append(parent.children[:i], parent.children[i+1:]...)
+		if child := f.GetID(childID); child != nil && child.IsDir() && parent.subdir > 0 {
+			parent.subdir--
+		}
+		return
+	}
+}
+
+// repairOrphan deals with an item whose parent is not in the cache. Items with
+// local changes are never evicted, since that would lose the changes.
+func (f *Filesystem) repairOrphan(id string) {
+	inode := f.GetID(id)
+	if inode == nil {
+		return
+	}
+	ctx := log.With().Str("id", id).Str("name", inode.Name()).
+		Str("parentID", inode.ParentID()).Logger()
+
+	if !isLocalID(id) && !f.IsOffline() {
+		item, err := graph.GetItem(id, f.auth)
+		if err != nil && !graph.IsUnknownID(err) {
+			ctx.Warn().Err(err).Msg("Item's parent is gone, and the server could not " +
+				"tell us where it is now. Trying again later.")
+			return
+		}
+		if err == nil && item.Parent != nil && f.GetID(item.Parent.ID) != nil {
+			ctx.Warn().Str("newParentID", item.Parent.ID).
+				Msg("Item's parent is gone, moving it to where the server has it.")
+			inode.Lock()
+			inode.DriveItem.Parent = item.Parent
+			inode.Unlock()
+			f.InsertID(id, inode)
+			return
+		}
+	}
+
+	if err := f.evictTree(id); err != nil {
+		ctx.Error().Err(err).
+			Msg("Item's parent is gone, but it has changes that have not been uploaded. " +
+				"Keeping it.")
+		return
+	}
+	ctx.Warn().Msg("Item's parent is gone, evicted it from the cache.")
+}
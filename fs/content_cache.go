@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -13,6 +14,9 @@ import (
 type LoopbackCache struct {
 	directory string
 	fds       sync.Map
+	// held while adding to fds, so WriteAt() can't forget an fd that was
+	// just opened
+	openM sync.Mutex
 }
 
 func NewLoopbackCache(directory string) *LoopbackCache {
@@ -65,6 +69,29 @@ func (l *LoopbackCache) IsOpen(id string) bool {
 	return ok
 }
 
+// OpenIDs returns the IDs of all files that are currently open.
+func (l *LoopbackCache) OpenIDs() []string {
+	ids := make([]string, 0)
+	l.fds.Range(func(key, value interface{}) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+	return ids
+}
+
+// Size returns the number of files in the cache and their total size in bytes.
+func (l *LoopbackCache) Size() (int, uint64) {
+	entries, err := ioutil.ReadDir(l.directory)
+	if err != nil {
+		return 0, 0
+	}
+	var size uint64
+	for _, entry := range entries {
+		size += uint64(entry.Size())
+	}
+	return len(entries), size
+}
+
 // HasContent is used to find if we have a file or not in cache (in any state)
 func (l *LoopbackCache) HasContent(id string) bool {
 	// is it already open?
@@ -94,16 +121,46 @@ func (l *LoopbackCache) Open(id string) (*os.File, error) {
 	// scenes.
 	// https://github.com/hanwen/go-fuse/issues/371#issuecomment-694799535
 	runtime.SetFinalizer(fd, nil)
-	l.fds.Store(id, fd)
+	l.openM.Lock()
+	existing, loaded := l.fds.LoadOrStore(id, fd)
+	l.openM.Unlock()
+	if loaded {
+		// someone else opened it at the same time
+		fd.Close()
+		return existing.(*os.File), nil
+	}
 	return fd, nil
 }
 
 // Close closes the currently open fd
 func (l *LoopbackCache) Close(id string) {
-	if fd, ok := l.fds.Load(id); ok {
+	// forgotten before closing, so Open() can't hand out an fd that is about
+	// to be closed
+	if fd, ok := l.fds.LoadAndDelete(id); ok {
 		file := fd.(*os.File)
 		file.Sync()
 		file.Close()
-		l.fds.Delete(id)
+	}
+}
+
+// WriteAt writes to the content of an item, opening it if it isn't already.
+// Any other handle to the file can close it at any moment, in which case it is
+// opened again until the write goes through.
+func (l *LoopbackCache) WriteAt(id string, data []byte, offset int64) (int, error) {
+	for {
+		fd, err := l.Open(id)
+		if err != nil {
+			return 0, err
+		}
+		n, err := fd.WriteAt(data, offset)
+		if !errors.Is(err, os.ErrClosed) {
+			return n, err
+		}
+		// only if nobody has opened it again already
+		l.openM.Lock()
+		if current, ok := l.fds.Load(id); ok && current.(*os.File) == fd {
+			l.fds.Delete(id)
+		}
+		l.openM.Unlock()
 	}
 }
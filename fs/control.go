@@ -0,0 +1,133 @@
+package fs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rs/zerolog/log"
+)
+
+// ForceFlush queues an upload of an item's current content, even if the
+// filesystem doesn't think it has any changes. Useful to recover from an upload
+// that got stuck.
+func (f *Filesystem) ForceFlush(id string) error {
+	inode := f.GetID(id)
+	if inode == nil {
+		return errors.New(id + " not found in cache")
+	}
+	if inode.IsDir() {
+		return errors.New("cannot flush a directory")
+	}
+	inode.Lock()
+	inode.hasChanges = true
+	inode.Unlock()
+	status := f.Fsync(nil, &fuse.FsyncIn{InHeader: fuse.InHeader{NodeId: inode.NodeID()}})
+	if status != fuse.OK {
+		return fmt.Errorf("flush failed: %s", status)
+	}
+	return nil
+}
+
+// ForceClose cancels any upload for an item, closes its file descriptor, and
+// discards its pending changes. Content that was already written to the cache
+// is kept, but will not be uploaded unless the file is written to again.
+func (f *Filesystem) ForceClose(id string) error {
+	inode := f.GetID(id)
+	if inode == nil {
+		return errors.New(id + " not found in cache")
+	}
+	f.uploads.CancelUpload(id)
+	inode.Lock()
+	inode.hasChanges = false
+	inode.Unlock()
+	f.content.Close(id)
+	return nil
+}
+
+// ForceEvict removes an item's content from the cache, so that it is
+// downloaded again the next time it is opened. Items with changes that haven't
+// been uploaded are refused, since the cache holds the only copy of them, as
+// are files that are currently open.
+func (f *Filesystem) ForceEvict(id string) error {
+	inode := f.GetID(id)
+	if inode == nil {
+		return errors.New(id + " not found in cache")
+	}
+	if inode.IsDir() {
+		return errors.New("cannot evict a directory")
+	}
+	inode.Lock()
+	defer inode.Unlock()
+	if isLocalID(id) || inode.hasChanges {
+		return errors.New("item has changes that have not been uploaded")
+	}
+	if f.content.IsOpen(id) {
+		return errors.New("item is open")
+	}
+	if err := f.content.Delete(id); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	inode.contentCTag = ""
+	return nil
+}
+
+// ControlPath is the location of the control file. Each line of the control
+// file is a command of the form "<flush|close|evict> <id>", or "pause" or
+// "resume".
+func (f *Filesystem) ControlPath() string {
+	return filepath.Join(f.cacheDir, "control")
+}
+
+// RunControlFile runs every command in the control file and then empties it.
+func (f *Filesystem) RunControlFile() error {
+	file, err := os.Open(f.ControlPath())
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		ctx := log.With().Str("command", fields[0]).Logger()
+		if fields[0] == "pause" || fields[0] == "resume" {
+			if fields[0] == "pause" {
+				f.Pause()
+			} else {
+				f.Resume()
+			}
+			ctx.Info().Msg("Control command succeeded.")
+			continue
+		}
+		if len(fields) != 2 {
+			ctx.Error().Msg("Control commands must be of the form \"<command> <id>\".")
+			continue
+		}
+		ctx = ctx.With().Str("id", fields[1]).Logger()
+
+		var err error
+		switch fields[0] {
+		case "flush":
+			err = f.ForceFlush(fields[1])
+		case "close":
+			err = f.ForceClose(fields[1])
+		case "evict":
+			err = f.ForceEvict(fields[1])
+		default:
+			err = errors.New("unknown command")
+		}
+		if err != nil {
+			ctx.Error().Err(err).Msg("Control command failed.")
+		} else {
+			ctx.Info().Msg("Control command succeeded.")
+		}
+	}
+	file.Close()
+	return os.Truncate(f.ControlPath(), 0)
+}
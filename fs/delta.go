@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jstaf/onedriver/fs/graph"
@@ -11,11 +12,74 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
+// polling slows down to at most this multiple of the DeltaLoop interval when
+// nothing is changing
+const maxDeltaBackoff = 4
+
+// deltaWait returns how long to wait before the next delta poll. Each
+// consecutive poll that came back without changes doubles the wait, up to
+// maxDeltaBackoff times the base interval.
+func deltaWait(interval time.Duration, idlePolls int) time.Duration {
+	wait := interval
+	for i := 0; i < idlePolls && wait < interval*maxDeltaBackoff; i++ {
+		wait *= 2
+	}
+	if wait > interval*maxDeltaBackoff {
+		wait = interval * maxDeltaBackoff
+	}
+	return wait
+}
+
+// markActive lets the delta loop know that the user is changing things, so it
+// should poll at full speed for a while.
+func (f *Filesystem) markActive() {
+	f.touch()
+	select {
+	case f.activity <- struct{}{}:
+	default:
+	}
+}
+
+// RequestSync asks the delta loop to check the server for changes right away
+// instead of waiting for the next poll.
+func (f *Filesystem) RequestSync() {
+	select {
+	case f.syncNow <- struct{}{}:
+	default:
+	}
+}
+
+// touch records that the kernel has just asked us to do something.
+func (f *Filesystem) touch() {
+	atomic.StoreInt64(&f.lastOp, time.Now().UnixNano())
+}
+
+// IdleTime returns how long it has been since the filesystem was last used.
+func (f *Filesystem) IdleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.lastOp)))
+}
+
 // DeltaLoop creates a new thread to poll the server for changes and should be
-// called as a goroutine
+// called as a goroutine. Polls happen every interval while things are
+// changing, and back off when the drive is idle.
 func (f *Filesystem) DeltaLoop(interval time.Duration) {
 	log.Trace().Msg("Starting delta goroutine.")
+	idlePolls := 0
 	for { // eva
+		if f.IsPaused() {
+			// Resume() requests a sync to wake us back up
+			<-f.syncNow
+			continue
+		}
+		if f.IsOffline() {
+			// no point in asking for deltas until the network is back
+			if err := graph.CheckOnline(); err != nil {
+				log.Debug().Err(err).Msg("Online check failed, staying offline.")
+				time.Sleep(2 * time.Second)
+				continue
+			}
+		}
+
 		// get deltas
 		log.Trace().Msg("Fetching deltas from server.")
 		pollSuccess := false
@@ -58,25 +122,63 @@ func (f *Filesystem) DeltaLoop(interval time.Duration) {
 			// failures should explicitly be ignored the second time around as per docs
 			f.applyDelta(deltas[id])
 		}
+		if f.opts.CheckTree {
+			if problems := f.checkTree(); problems > 0 {
+				log.Warn().Int("problems", problems).Msg("Repaired inconsistencies in the cache.")
+			}
+		}
+		f.updateConflicts()
 
 		if !f.IsOffline() {
 			f.SerializeAll()
 		}
+		if err := f.WriteStatus(); err != nil {
+			log.Error().Err(err).Msg("Could not write status file.")
+		}
 
 		if pollSuccess {
 			f.Lock()
+			wasOffline := f.offline
 			if f.offline {
 				log.Info().Msg("Delta fetch success, marking fs as online.")
 			}
 			f.offline = false
+			recheckQuota := time.Since(f.quotaCheck) > quotaCheckInterval
 			f.Unlock()
+			if recheckQuota {
+				f.checkQuota()
+			}
+			if wasOffline {
+				// in case we started offline
+				go f.retryRestoredUploads()
+			}
 
 			f.db.Batch(func(tx *bolt.Tx) error {
 				return tx.Bucket(bucketDelta).Put([]byte("deltaLink"), []byte(f.deltaLink))
 			})
 
-			// wait until next interval
-			time.Sleep(interval)
+			if len(deltas) > 0 {
+				idlePolls = 0
+			} else {
+				idlePolls++
+			}
+			timer := time.NewTimer(deltaWait(interval, idlePolls))
+			select {
+			case <-timer.C:
+			case <-f.activity:
+				// the user is making changes, check back in soon
+				timer.Stop()
+				idlePolls = 0
+				timer = time.NewTimer(deltaWait(interval, idlePolls))
+				select {
+				case <-timer.C:
+				case <-f.syncNow:
+					timer.Stop()
+				}
+			case <-f.syncNow:
+				timer.Stop()
+				idlePolls = 0
+			}
 		} else {
 			// shortened duration while offline
 			time.Sleep(2 * time.Second)
@@ -135,6 +237,21 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 
 	// do we have it at all?
 	if parent := f.GetID(parentID); parent == nil {
+		if f.GetID(id) != nil && id != f.root && delta.Deleted == nil {
+			// The item was moved somewhere we haven't cached (or outside of
+			// what we can see at all). As far as the local tree is concerned,
+			// that is the same as it being deleted.
+			ctx.Info().Str("delta", "moveOut").
+				Msg("Item moved out of the cached tree, removing it from cache.")
+			local := f.GetID(id)
+			oldParentID, oldName, nodeID := local.ParentID(), local.Name(), local.NodeID()
+			if err := f.evictTree(id); err != nil {
+				ctx.Warn().Err(err).Msg("Not removing item that was moved out of the cached tree.")
+				return nil
+			}
+			f.notifyDelete(oldParentID, nodeID, oldName)
+			return nil
+		}
 		// Nothing needs to be applied, item not in cache, so latest copy will
 		// be pulled down next time it's accessed.
 		ctx.Trace().
@@ -143,6 +260,12 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 		return nil
 	}
 
+	if name == "" && delta.Deleted == nil {
+		ctx.Warn().Str("delta", "skip").
+			Msg("Skipping delta, server sent an item with no name.")
+		return nil
+	}
+
 	local := f.GetID(id)
 
 	// was it deleted?
@@ -156,6 +279,13 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 		}
 		ctx.Info().Str("delta", "delete").
 			Msg("Applying server-side deletion of item.")
+		if local != nil {
+			f.history.record(historyDeleted, id, local.Path(), true)
+			oldParentID, oldName, nodeID := local.ParentID(), local.Name(), local.NodeID()
+			f.DeleteID(id)
+			f.notifyDelete(oldParentID, nodeID, oldName)
+			return nil
+		}
 		f.DeleteID(id)
 		return nil
 	}
@@ -170,7 +300,10 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 			ctx.Info().
 				Str("localID", localID).
 				Msg("Local item already exists under different ID.")
-			if isLocalID(localID) {
+			if isVolumeInfo(localID) {
+				f.replaceVolumeInfo(parentID, delta)
+				return nil
+			} else if isLocalID(localID) {
 				if err := f.MoveID(localID, id); err != nil {
 					ctx.Error().
 						Str("localID", localID).
@@ -182,11 +315,32 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 			ctx.Info().Str("delta", "create").
 				Msg("Creating inode from delta.")
 			f.InsertChild(parentID, NewInodeDriveItem(delta))
+			// the kernel may remember that the name didn't exist
+			f.invalidateEntry(parentID, name)
 			return nil
 		}
 	}
 
-	// was the item moved?
+	// did it turn from a file into a folder or the other way around? This can
+	// also be a different item that took over the name of the one we matched
+	// it up with above. Either way the old inode (and any children it had) is
+	// useless, and the kernel needs to forget it or lookups keep failing with
+	// ENOTDIR/EISDIR.
+	if local.IsDir() != delta.IsDir() {
+		ctx.Info().Str("delta", "retype").Bool("folder", delta.IsDir()).
+			Msg("Item changed between file and folder, replacing it in cache.")
+		oldParentID, oldName := local.ParentID(), local.Name()
+		if err := f.evictTree(local.ID()); err != nil {
+			ctx.Warn().Err(err).Msg("Not replacing item that has local changes.")
+			return nil
+		}
+		f.invalidateEntry(oldParentID, oldName)
+		f.InsertChild(parentID, NewInodeDriveItem(delta))
+		return nil
+	}
+
+	// was the item moved? names are compared case-sensitively here (unlike
+	// everywhere else) so that renames that only change case are picked up
 	localName := local.Name()
 	if local.ParentID() != parentID || local.Name() != name {
 		log.Info().
@@ -200,6 +354,7 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 		oldParentID := local.ParentID()
 		// local rename only
 		f.MovePath(oldParentID, parentID, localName, name, f.auth)
+		f.invalidateEntry(oldParentID, localName)
 		// do not return, there may be additional changes
 	}
 
@@ -213,24 +368,41 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 		sameContent := false
 		if !delta.IsDir() && delta.File != nil {
 			local.RLock()
-			sameContent = local.VerifyChecksum(delta.File.Hashes.QuickXorHash)
+			if delta.CTag != "" && delta.CTag == local.DriveItem.CTag {
+				// only the metadata changed
+				sameContent = true
+			} else if local.DriveItem.File != nil {
+				sameContent, _ = local.DriveItem.File.Hashes.Compare(delta.File.Hashes)
+			}
 			local.RUnlock()
 		}
 
 		if !sameContent {
-			//TODO check if local has changes and rename the server copy if so
+			if !delta.IsDir() && local.HasChanges() {
+				if err := f.conflictCopy(local); err != nil {
+					ctx.Error().Err(err).Msg("Could not save a conflict copy of local changes.")
+				}
+			}
 			ctx.Info().Str("delta", "overwrite").
-				Msg("Overwriting local item, no local changes to preserve.")
+				Msg("Overwriting local item with server copy.")
 			// update modtime, hashes, purge any local content in memory
 			local.Lock()
-			defer local.Unlock()
 			local.DriveItem.ModTime = delta.ModTime
 			local.DriveItem.Size = delta.Size
 			local.DriveItem.ETag = delta.ETag
+			local.DriveItem.CTag = delta.CTag
 			// the rest of these are harmless when this is a directory
 			// as they will be null anyways
 			local.DriveItem.File = delta.File
 			local.hasChanges = false
+			if f.opts.NoVerifyCache && !f.content.IsOpen(id) {
+				// cached content will not be checked on the next Open(), so it
+				// needs to go now that we know it is out of date
+				f.content.Delete(id)
+			}
+			nodeID := local.nodeID
+			local.Unlock()
+			f.invalidateContent(nodeID)
 			return nil
 		}
 	}
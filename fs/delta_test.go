@@ -7,8 +7,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/jstaf/onedriver/fs/graph"
@@ -74,6 +76,45 @@ func TestDeltaRmdir(t *testing.T) {
 	}, retrySeconds, time.Second, "File deletion not picked up by client")
 }
 
+// Programs watching a directory with inotify should find out when something in
+// it is deleted on the server.
+func TestDeltaDeleteInotify(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join(DeltaDir, "inotify")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	fname := filepath.Join(dir, "delete_me.txt")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("watch me go"), 0644))
+	_, err := os.Stat(fname) // the kernel only reports on names it knows about
+	require.NoError(t, err)
+
+	watcher, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	require.NoError(t, err)
+	defer syscall.Close(watcher)
+	_, err = syscall.InotifyAddWatch(watcher, dir, syscall.IN_DELETE)
+	require.NoError(t, err)
+
+	var item *graph.DriveItem
+	require.Eventually(t, func() bool {
+		item, err = graph.GetItemPath("/onedriver_tests/delta/inotify/delete_me.txt", auth)
+		return err == nil
+	}, retrySeconds, time.Second, "File was never uploaded.")
+	require.NoError(t, graph.Remove(item.ID, auth))
+
+	buf := make([]byte, 4096)
+	assert.Eventually(t, func() bool {
+		n, err := syscall.Read(watcher, buf)
+		for offset := 0; err == nil && offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			if event.Mask&syscall.IN_DELETE != 0 && string(bytes.TrimRight(name, "\x00")) == "delete_me.txt" {
+				return true
+			}
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+		}
+		return false
+	}, retrySeconds, time.Second, "No IN_DELETE event for a file deleted on the server.")
+}
+
 // Create a file locally, then rename it remotely and verify that the renamed
 // file still has the correct content under the new parent.
 func TestDeltaRename(t *testing.T) {
@@ -309,6 +350,58 @@ func TestDeltaFolderDeletionNonEmpty(t *testing.T) {
 		"Still found folder after emptying it first (the correct way).")
 }
 
+// Items moved to a parent we don't have cached should leave the cache, along
+// with everything in them.
+func TestDeltaMoveOutOfCache(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_move_out_of_cache"))
+	dir := NewInode("folder", 0755|fuse.S_IFDIR, nil)
+	file := NewInode("file", 0644|fuse.S_IFREG, nil)
+	cache.InsertPath("/folder", nil, dir)
+	cache.InsertPath("/folder/file", nil, file)
+
+	delta := &graph.DriveItem{
+		ID:     dir.ID(),
+		Name:   "folder",
+		Parent: &graph.DriveItemParent{ID: "some-uncached-parent"},
+		Folder: &graph.Folder{},
+	}
+	require.NoError(t, cache.applyDelta(delta))
+	assert.Nil(t, cache.GetID(dir.ID()), "Moved folder should have been removed.")
+	assert.Nil(t, cache.GetID(file.ID()), "Children of moved folder should have been removed.")
+}
+
+// A folder that turned into a file on the server should become a file locally
+// too, without any of its old children.
+func TestDeltaFolderBecomesFile(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_folder_becomes_file"))
+	dir := NewInode("folder", 0755|fuse.S_IFDIR, nil)
+	file := NewInode("file", 0644|fuse.S_IFREG, nil)
+	cache.InsertPath("/folder", nil, dir)
+	cache.InsertPath("/folder/file", nil, file)
+
+	now := time.Now()
+	delta := &graph.DriveItem{
+		ID:      dir.ID(),
+		Name:    "folder",
+		Parent:  &graph.DriveItemParent{ID: dir.ParentID()},
+		ModTime: &now,
+		Size:    5,
+		File:    &graph.File{},
+	}
+	require.NoError(t, cache.applyDelta(delta))
+	replaced := cache.GetID(dir.ID())
+	require.NotNil(t, replaced, "Item should still be in the cache.")
+	assert.False(t, replaced.IsDir(), "Item should have become a file.")
+	assert.Equal(t, uint64(5), replaced.Size())
+	assert.Nil(t, cache.GetID(file.ID()), "Children of the old folder should be gone.")
+
+	child, err := cache.GetPath("/folder", nil)
+	require.NoError(t, err)
+	assert.Equal(t, dir.ID(), child.ID(), "New item should be found under its name.")
+}
+
 // Some programs like LibreOffice and WPS Office will have a fit if the
 // modification times on their lockfiles is updated after they are written. This
 // test verifies that the delta thread does not modify modification times if the
@@ -353,3 +446,56 @@ func TestDeltaMissingHash(t *testing.T) {
 	cache.applyDelta(delta)
 	// if we survive to here without a segfault, test passed
 }
+
+// Delta polling should back off while idle, but never past the max.
+func TestDeltaWait(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, 30*time.Second, deltaWait(30*time.Second, 0))
+	assert.Equal(t, time.Minute, deltaWait(30*time.Second, 1))
+	assert.Equal(t, 2*time.Minute, deltaWait(30*time.Second, 2))
+	assert.Equal(t, 2*time.Minute, deltaWait(30*time.Second, 100))
+}
+
+// Any op from the kernel should reset the idle timer.
+func TestIdleTime(t *testing.T) {
+	t.Parallel()
+	f := &Filesystem{lastOp: time.Now().Add(-time.Hour).UnixNano()}
+	assert.True(t, f.IdleTime() >= time.Hour)
+	f.touch()
+	assert.True(t, f.IdleTime() < time.Minute)
+}
+
+func TestConflictName(t *testing.T) {
+	t.Parallel()
+	when := time.Date(2021, 11, 5, 13, 4, 5, 0, time.UTC)
+	assert.Equal(t,
+		"report (conflict on laptop 2021-11-05 13.04.05).docx",
+		conflictName("", "report.docx", "laptop", when),
+	)
+	assert.Equal(t, "Makefile.conflict", conflictName("{name}{ext}.conflict", "Makefile", "laptop", when))
+}
+
+// Conflict copies made by onedriver and by OneDrive's own clients should both be
+// recognized, but only when the original is still around.
+func TestConflictOriginal(t *testing.T) {
+	t.Parallel()
+	siblings := map[string]bool{
+		"report.docx":  true,
+		"my-notes.txt": true,
+		"scan.pdf":     true,
+		"invoice.pdf":  true,
+	}
+	hasSibling := func(name string) bool { return siblings[name] }
+	pattern := conflictPattern("")
+
+	assert.Equal(t, "report.docx",
+		conflictOriginal("report-DESKTOP-1A2B3C4.docx", pattern, hasSibling))
+	assert.Equal(t, "report.docx",
+		conflictOriginal("report (conflict on laptop 2021-11-05 13.04.05).docx", pattern, hasSibling))
+	assert.Equal(t, "my-notes.txt",
+		conflictOriginal("my-notes-LAPTOP-2.txt", pattern, hasSibling))
+	assert.Equal(t, "", conflictOriginal("summary-DESKTOP-1A2B3C4.docx", pattern, hasSibling))
+	assert.Equal(t, "", conflictOriginal("report-draft.docx", pattern, hasSibling))
+	assert.Equal(t, "", conflictOriginal("scan-1.pdf", pattern, hasSibling))
+	assert.Equal(t, "", conflictOriginal("invoice-2023.pdf", pattern, hasSibling))
+}
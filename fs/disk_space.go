@@ -0,0 +1,159 @@
+package fs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// how much space is left free on the disk the cache is on, unless
+// Options.MinFreeSpace says otherwise
+const defaultMinFreeSpace = 256 << 20
+
+// errDiskFull means there is not enough room on the disk the cache is on to
+// download a file, even after removing everything that could be removed.
+var errDiskFull = errors.New("not enough free space on the disk the cache is on")
+
+// freeSpace returns how many bytes can still be written to the filesystem path
+// is on.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+func (f *Filesystem) minFreeSpace() uint64 {
+	if f.opts.MinFreeSpace > 0 {
+		return f.opts.MinFreeSpace
+	}
+	return defaultMinFreeSpace
+}
+
+// cacheFreeSpace is the free space on whichever of the cache and temp
+// directories has the least, since downloads need room in both.
+func (f *Filesystem) cacheFreeSpace() (uint64, error) {
+	free, err := freeSpace(f.content.directory)
+	if err != nil {
+		return 0, err
+	}
+	if tempFree, err := freeSpace(f.tempDir); err == nil && tempFree < free {
+		free = tempFree
+	}
+	return free, nil
+}
+
+// IsDiskFull is true when the disk the cache is on has gotten so full that
+// files which are not already cached can't be opened.
+func (f *Filesystem) IsDiskFull() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.diskFull
+}
+
+// WatchDiskSpace checks every interval that the disk the cache is on isn't
+// running out of space, and should be called as a goroutine.
+func (f *Filesystem) WatchDiskSpace(interval time.Duration) {
+	for {
+		f.checkDiskSpace(0)
+		time.Sleep(interval)
+	}
+}
+
+// checkDiskSpace makes sure that need bytes can be written to the cache while
+// still leaving the minimum amount of space free. If there isn't enough room,
+// cached content is removed to make some, and errDiskFull is returned if that
+// still isn't enough.
+func (f *Filesystem) checkDiskSpace(need uint64) error {
+	free, err := f.cacheFreeSpace()
+	if err != nil {
+		// can't tell, so don't get in the way
+		return nil
+	}
+	want := f.minFreeSpace() + need
+	if _, cached := f.content.Size(); free < want && free+cached >= want {
+		// no point emptying the cache for a file that won't fit either way
+		log.Warn().
+			Uint64("free", free).
+			Uint64("wanted", want).
+			Msg("Disk the cache is on is almost full, removing cached file content to make room.")
+		free += f.evictContent(want - free)
+	}
+
+	// a single file that is too big doesn't make the disk full for everything
+	// else
+	full := free < f.minFreeSpace()
+	f.Lock()
+	changed := full != f.diskFull
+	f.diskFull = full
+	f.Unlock()
+	if changed && full {
+		log.Error().Uint64("free", free).
+			Msg("Disk the cache is on is full, files that aren't cached already can't be opened.")
+	} else if changed {
+		log.Info().Msg("Disk the cache is on has room again.")
+	}
+	if free < want {
+		return errDiskFull
+	}
+	return nil
+}
+
+// pinned is true for files under Options.PrefetchPaths, which are meant to
+// stay available while offline.
+func (f *Filesystem) pinned(filePath string) bool {
+	for _, prefetch := range f.opts.PrefetchPaths {
+		prefetch = strings.TrimSuffix(path.Clean("/"+prefetch), "/")
+		if strings.HasPrefix(filePath+"/", prefetch+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// evictContent removes cached content that can be downloaded again, oldest
+// first, until at least want bytes have been freed or there is nothing left to
+// remove. Open files, files with changes that aren't uploaded yet, and pinned
+// files are left alone. Returns how many bytes were freed.
+func (f *Filesystem) evictContent(want uint64) uint64 {
+	entries, err := ioutil.ReadDir(f.content.directory)
+	if err != nil {
+		return 0
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	var freed uint64
+	evicted := 0
+	for _, entry := range entries {
+		if freed >= want {
+			break
+		}
+		id := entry.Name()
+		if isLocalID(id) || f.content.IsOpen(id) {
+			// local items haven't been uploaded, this is the only copy
+			continue
+		}
+		if inode := f.GetID(id); inode != nil && (inode.HasChanges() || f.pinned(inode.Path())) {
+			continue
+		}
+		// not content.Delete(), which would close the file on anyone who just
+		// opened it
+		if err := os.Remove(f.content.contentPath(id)); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		freed += uint64(entry.Size())
+		evicted++
+	}
+	log.Info().Int("files", evicted).Uint64("bytes", freed).Msg("Removed cached file content.")
+	return freed
+}
@@ -1,11 +1,13 @@
 package fs
 
 import (
+	"errors"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -17,6 +19,27 @@ import (
 
 const timeout = time.Second
 
+// directory children fetched longer ago than this are re-fetched before ops
+// that need to be certain of a directory's contents
+const childrenTimeout = 30 * time.Second
+
+// how long after a rename the server might still list an item under its old
+// name or parent
+const renameSettle = time.Minute
+
+// how files OneDrive says are empty are opened, see Options.ZeroSizeFiles
+const (
+	zeroSizeDownload = ""
+	zeroSizeTrust    = "trust"
+)
+
+// how often to check whether the drive is still over quota
+const quotaCheckInterval = 5 * time.Minute
+
+// how long closing a file waits for its upload with Options.SyncWrites, unless
+// Options.SyncWritesTimeout says otherwise
+const defaultSyncWritesTimeout = 10 * time.Minute
+
 func (f *Filesystem) getInodeContent(i *Inode) *[]byte {
 	i.RLock()
 	defer i.RUnlock()
@@ -42,6 +65,7 @@ func (f *Filesystem) remoteID(i *Inode) (string, error) {
 		if err != nil {
 			return originalID, err
 		}
+		session.ModTime = session.ModTime.Truncate(f.mtimePrecision())
 
 		i.Lock()
 		name := i.DriveItem.Name
@@ -75,6 +99,8 @@ func (f *Filesystem) remoteID(i *Inode) (string, error) {
 		// we just successfully uploaded a copy, no need to do it again
 		i.hasChanges = false
 		i.DriveItem.ETag = session.ETag
+		i.DriveItem.CTag = session.CTag
+		i.contentCTag = session.CTag
 		i.Unlock()
 
 		// this is all we really wanted from this transaction
@@ -115,14 +141,113 @@ func isNameRestricted(name string) bool {
 	return disallowedRexp.FindStringIndex(name) != nil
 }
 
+// Init is called by the FUSE server when the filesystem is mounted. We hang on
+// to the server so that remote changes can be pushed to the kernel.
+func (f *Filesystem) Init(server *fuse.Server) {
+	f.Lock()
+	f.server = server
+	f.Unlock()
+}
+
+// invalidateAttr tells the kernel to drop any attributes it has cached for a
+// node, so that the next stat() picks up metadata changed by the server. Must
+// not be called while holding a lock on the inode, as the kernel may need to
+// call back into the filesystem before the notification completes.
+func (f *Filesystem) invalidateAttr(nodeID uint64) {
+	f.RLock()
+	server := f.server
+	f.RUnlock()
+	if server == nil || nodeID == 0 {
+		// not mounted yet, or the kernel has never looked up this node
+		return
+	}
+	// an offset of -1 invalidates only the attributes, not the page cache
+	if status := server.InodeNotify(nodeID, -1, 0); status != fuse.OK && status != fuse.ENOENT {
+		log.Debug().
+			Uint64("nodeID", nodeID).
+			Str("status", status.String()).
+			Msg("Could not invalidate kernel attribute cache.")
+	}
+}
+
+// invalidateEntry tells the kernel to forget a name it has cached in a
+// directory, like after the item was renamed on the server. Otherwise the old
+// name keeps resolving (and showing up in paths) until the entry times out.
+// Same locking rules as invalidateAttr.
+func (f *Filesystem) invalidateEntry(parentID string, name string) {
+	f.RLock()
+	server := f.server
+	f.RUnlock()
+	parent := f.GetID(parentID)
+	if server == nil || parent == nil || parent.NodeID() == 0 {
+		return
+	}
+	nodeID := parent.NodeID()
+	if status := server.EntryNotify(nodeID, f.localName(name)); status != fuse.OK && status != fuse.ENOENT {
+		log.Debug().
+			Uint64("nodeID", nodeID).
+			Str("name", name).
+			Str("status", status.String()).
+			Msg("Could not invalidate kernel entry cache.")
+	}
+}
+
+// invalidateContent is like invalidateAttr, but also drops any of the file's
+// content the kernel has cached, for when it changed on the server. Processes
+// that have the file open see the new content on their next read.
+func (f *Filesystem) invalidateContent(nodeID uint64) {
+	f.RLock()
+	server := f.server
+	f.RUnlock()
+	if server == nil || nodeID == 0 {
+		return
+	}
+	// a length of 0 means everything from the offset on
+	if status := server.InodeNotify(nodeID, 0, 0); status != fuse.OK && status != fuse.ENOENT {
+		log.Debug().
+			Uint64("nodeID", nodeID).
+			Str("status", status.String()).
+			Msg("Could not invalidate kernel content cache.")
+	}
+}
+
+// notifyDelete tells the kernel that an item was deleted on the server. Unlike
+// invalidateEntry, this also reaches inotify watchers of the directory (as an
+// IN_DELETE event), on kernels that support it. nodeID is the item's own
+// NodeID, and must be looked up before it is removed from the cache. Same
+// locking rules as invalidateAttr.
+func (f *Filesystem) notifyDelete(parentID string, nodeID uint64, name string) {
+	f.RLock()
+	server := f.server
+	f.RUnlock()
+	parent := f.GetID(parentID)
+	if server == nil || parent == nil || parent.NodeID() == 0 {
+		return
+	}
+	parentNodeID := parent.NodeID()
+	status := server.DeleteNotify(parentNodeID, nodeID, f.localName(name))
+	if status != fuse.OK && status != fuse.ENOENT {
+		log.Debug().
+			Uint64("nodeID", parentNodeID).
+			Str("name", name).
+			Str("status", status.String()).
+			Msg("Could not notify kernel of deletion.")
+	}
+}
+
 // Statfs returns information about the filesystem. Mainly useful for checking
 // quotas and storage limits.
 func (f *Filesystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
 	ctx := log.With().Str("op", "StatFs").Logger()
 	ctx.Debug().Msg("")
-	drive, err := graph.GetDrive(f.auth)
+	drive, err := f.getDrive()
 	if err != nil {
-		return fuse.EREMOTEIO
+		// report the last known quota so that "df" and friends keep working
+		// while offline
+		if drive, err = f.lastDrive(); err != nil {
+			ctx.Error().Err(err).Msg("Could not fetch drive details.")
+			return fuse.EREMOTEIO
+		}
 	}
 
 	if drive.DriveType == graph.DriveTypePersonal {
@@ -150,6 +275,8 @@ func (f *Filesystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fuse
 
 // Mkdir creates a directory.
 func (f *Filesystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	f.markActive()
+	name = f.remoteName(name)
 	if isNameRestricted(name) {
 		return fuse.EINVAL
 	}
@@ -168,19 +295,40 @@ func (f *Filesystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string
 		Str("mode", Octal(in.Mode)).
 		Logger()
 	ctx.Debug().Msg("")
+	if inode.IsBundle() {
+		ctx.Warn().Msg("Cannot create directories inside of a bundle.")
+		return fuse.EPERM
+	}
 
 	// create the new directory on the server
 	item, err := graph.Mkdir(name, id, f.auth)
+	if err != nil && strings.Contains(err.Error(), "nameAlreadyExists") {
+		// Something else created it first, most likely another process racing
+		// us to "mkdir -p" the same path. Adopt the existing directory, same as
+		// remoteID() does for files.
+		ctx.Info().Msg("Directory already exists on server, using that one.")
+		item, err = graph.GetItemChild(id, name, f.auth)
+		if err == nil && !item.IsDir() {
+			f.ops.record("mkdir", path, syscall.EEXIST)
+			return fuse.Status(syscall.EEXIST)
+		}
+	}
 	if err != nil {
 		ctx.Error().Err(err).Msg("Could not create remote directory!")
+		f.ops.record("mkdir", path, err)
 		return fuse.EREMOTEIO
 	}
 
-	newInode := NewInodeDriveItem(item)
-	newInode.mode = in.Mode | fuse.S_IFDIR
-
-	out.NodeId = f.InsertChild(id, newInode)
-	out.Attr = newInode.makeAttr()
+	newInode := f.GetID(item.ID)
+	if newInode != nil {
+		out.NodeId = newInode.NodeID()
+	} else {
+		newInode = NewInodeDriveItem(item)
+		newInode.mode = in.Mode | fuse.S_IFDIR
+		out.NodeId = f.InsertChild(id, newInode)
+	}
+	f.ops.record("mkdir", path, nil)
+	out.Attr = newInode.makeAttr(f.owner(), f.mtimePrecision())
 	out.SetAttrTimeout(timeout)
 	out.SetEntryTimeout(timeout)
 	return fuse.OK
@@ -188,22 +336,44 @@ func (f *Filesystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string
 
 // Rmdir removes a directory if it's empty.
 func (f *Filesystem) Rmdir(cancel <-chan struct{}, in *fuse.InHeader, name string) fuse.Status {
+	f.markActive()
 	parentID := f.TranslateID(in.NodeId)
 	if parentID == "" {
 		return fuse.ENOENT
 	}
-	child, _ := f.GetChild(parentID, name, f.auth)
+	child, _ := f.GetChild(parentID, f.remoteName(name), f.auth)
 	if child == nil {
 		return fuse.ENOENT
 	}
+
+	// cached children may be out of date, and deleting a directory on the
+	// server also deletes everything in it
+	id := child.ID()
+	if err := f.RefreshChildren(id, childrenTimeout, f.auth); err != nil {
+		log.Warn().
+			Str("op", "Rmdir").
+			Str("id", id).
+			Err(err).
+			Msg("Could not refresh children before removing directory.")
+	}
 	if child.HasChildren() {
+		f.ops.record("delete", child.Path(), syscall.ENOTEMPTY)
 		return fuse.Status(syscall.ENOTEMPTY)
 	}
-	return f.Unlink(cancel, in, name)
+
+	status := f.Unlink(cancel, in, name)
+	if status == fuse.EREMOTEIO {
+		// the server may have refused because the directory is not empty there
+		if remote, err := graph.GetItemChildren(id, f.auth); err == nil && len(remote) > 0 {
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
+	}
+	return status
 }
 
 // ReadDir provides a list of all the entries in the directory
 func (f *Filesystem) OpenDir(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	f.touch()
 	id := f.TranslateID(in.NodeId)
 	dir := f.GetID(id)
 	if dir == nil {
@@ -228,20 +398,37 @@ func (f *Filesystem) OpenDir(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.
 		return fuse.EREMOTEIO
 	}
 
-	parent := f.GetID(dir.ParentID())
+	var parent *Inode
+	if id != f.root {
+		parent = f.GetID(dir.ParentID())
+	}
 	if parent == nil {
 		// This is the parent of the mountpoint. The FUSE kernel module discards
-		// this info, so what we put here doesn't actually matter.
+		// this info, so what we put here doesn't actually matter, as long as it
+		// doesn't change every time the directory is listed.
 		parent = NewInode("..", 0755|fuse.S_IFDIR, nil)
 		parent.nodeID = math.MaxUint64
+		dir.RLock()
+		if dir.DriveItem.ModTime != nil {
+			modTime := *dir.DriveItem.ModTime
+			parent.DriveItem.ModTime = &modTime
+		}
+		dir.RUnlock()
 	}
 
-	entries := make([]*Inode, 2)
+	entries := make([]*Inode, 2, len(children)+2)
 	entries[0] = dir
 	entries[1] = parent
 
-	for _, child := range children {
-		entries = append(entries, child)
+	// children are keyed by lowercased name, sorting by key gives the same
+	// order every time the directory is listed
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries = append(entries, children[name])
 	}
 	f.opendirsM.Lock()
 	f.opendirs[in.NodeId] = entries
@@ -259,6 +446,7 @@ func (f *Filesystem) ReleaseDir(in *fuse.ReleaseIn) {
 
 // ReadDirPlus reads an individual directory entry AND does a lookup.
 func (f *Filesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	f.touch()
 	f.opendirsM.RLock()
 	entries, ok := f.opendirs[in.NodeId]
 	f.opendirsM.RUnlock()
@@ -290,7 +478,7 @@ func (f *Filesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *f
 	case 1:
 		entry.Name = ".."
 	default:
-		entry.Name = inode.Name()
+		entry.Name = f.localName(inode.Name())
 	}
 	entryOut := out.AddDirLookupEntry(entry)
 	if entryOut == nil {
@@ -305,7 +493,7 @@ func (f *Filesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *f
 		return fuse.EIO
 	}
 	entryOut.NodeId = entry.Ino
-	entryOut.Attr = inode.makeAttr()
+	entryOut.Attr = inode.makeAttr(f.owner(), f.mtimePrecision())
 	entryOut.SetAttrTimeout(timeout)
 	entryOut.SetEntryTimeout(timeout)
 	return fuse.OK
@@ -314,6 +502,7 @@ func (f *Filesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *f
 // ReadDir reads a directory entry. Usually doesn't get called (ReadDirPlus is
 // typically used).
 func (f *Filesystem) ReadDir(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	f.touch()
 	f.opendirsM.RLock()
 	entries, ok := f.opendirs[in.NodeId]
 	f.opendirsM.RUnlock()
@@ -345,7 +534,7 @@ func (f *Filesystem) ReadDir(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.
 	case 1:
 		entry.Name = ".."
 	default:
-		entry.Name = inode.Name()
+		entry.Name = f.localName(inode.Name())
 	}
 
 	out.AddDirEntry(entry)
@@ -355,6 +544,7 @@ func (f *Filesystem) ReadDir(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.
 // Lookup is called by the kernel when the VFS wants to know about a file inside
 // a directory.
 func (f *Filesystem) Lookup(cancel <-chan struct{}, in *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	f.touch()
 	id := f.TranslateID(in.NodeId)
 	log.Trace().
 		Str("op", "Lookup").
@@ -363,13 +553,13 @@ func (f *Filesystem) Lookup(cancel <-chan struct{}, in *fuse.InHeader, name stri
 		Str("name", name).
 		Msg("")
 
-	child, _ := f.GetChild(id, strings.ToLower(name), f.auth)
+	child, _ := f.GetChild(id, strings.ToLower(f.remoteName(name)), f.auth)
 	if child == nil {
 		return fuse.ENOENT
 	}
 
 	out.NodeId = child.NodeID()
-	out.Attr = child.makeAttr()
+	out.Attr = child.makeAttr(f.owner(), f.mtimePrecision())
 	out.SetAttrTimeout(timeout)
 	out.SetEntryTimeout(timeout)
 	return fuse.OK
@@ -377,6 +567,8 @@ func (f *Filesystem) Lookup(cancel <-chan struct{}, in *fuse.InHeader, name stri
 
 // Mknod creates a regular file. The server doesn't have this yet.
 func (f *Filesystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	f.markActive()
+	name = f.remoteName(name)
 	if isNameRestricted(name) {
 		return fuse.EINVAL
 	}
@@ -401,6 +593,14 @@ func (f *Filesystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string
 		ctx.Warn().Msg("We are offline. Refusing Mknod() to avoid data loss later.")
 		return fuse.EROFS
 	}
+	if f.IsQuotaExceeded() {
+		ctx.Warn().Msg("Drive is over quota. Refusing Mknod().")
+		return fuse.EROFS
+	}
+	if parent.IsBundle() {
+		ctx.Warn().Msg("Cannot create files inside of a bundle.")
+		return fuse.EPERM
+	}
 
 	if child, _ := f.GetChild(parentID, name, f.auth); child != nil {
 		return fuse.Status(syscall.EEXIST)
@@ -412,7 +612,7 @@ func (f *Filesystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string
 		Str("mode", Octal(in.Mode)).
 		Msg("Creating inode.")
 	out.NodeId = f.InsertChild(parentID, inode)
-	out.Attr = inode.makeAttr()
+	out.Attr = inode.makeAttr(f.owner(), f.mtimePrecision())
 	out.SetAttrTimeout(timeout)
 	out.SetEntryTimeout(timeout)
 	return fuse.OK
@@ -420,6 +620,7 @@ func (f *Filesystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string
 
 // Create creates a regular file and opens it. The server doesn't have this yet.
 func (f *Filesystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	name = f.remoteName(name)
 	// we reuse mknod here
 	result := f.Mknod(
 		cancel,
@@ -432,31 +633,68 @@ func (f *Filesystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name stri
 		&out.EntryOut,
 	)
 	if result == fuse.Status(syscall.EEXIST) {
-		// if the inode already exists, we should truncate the existing file and
-		// return the existing file inode as per "man creat"
-		parentID := f.TranslateID(in.NodeId)
-		child, _ := f.GetChild(parentID, name, f.auth)
-		log.Debug().
-			Str("op", "Create").
-			Uint64("nodeID", in.NodeId).
-			Str("id", parentID).
-			Str("childID", child.ID()).
-			Str("path", child.Path()).
-			Str("mode", Octal(in.Mode)).
-			Msg("Child inode already exists, truncating.")
-		f.content.Delete(child.ID())
-		f.content.Open(child.ID())
-		child.DriveItem.Size = 0
-		child.hasChanges = true
-		return fuse.OK
+		return f.createExisting(cancel, in, name, out)
 	}
 	// no further initialized required to open the file, it's empty
 	return result
 }
 
+// createExisting is Create() for a file that turned out to exist already (the
+// kernel only knew it didn't if its cache was out of date). The file is opened
+// as usual, and only truncated if O_TRUNC was passed, like open(2) would.
+func (f *Filesystem) createExisting(cancel <-chan struct{}, in *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	flags := int(in.Flags)
+	if flags&os.O_EXCL != 0 {
+		return fuse.Status(syscall.EEXIST)
+	}
+	parentID := f.TranslateID(in.NodeId)
+	child, _ := f.GetChild(parentID, name, f.auth)
+	if child == nil {
+		return fuse.ENOENT
+	}
+	ctx := log.With().
+		Str("op", "Create").
+		Uint64("nodeID", in.NodeId).
+		Str("id", parentID).
+		Str("childID", child.ID()).
+		Str("path", child.Path()).
+		Str("mode", Octal(in.Mode)).
+		Bool("truncate", flags&os.O_TRUNC != 0).
+		Logger()
+	ctx.Debug().Msg("Child inode already exists, opening it instead.")
+
+	nodeID := child.NodeID()
+	status := f.Open(cancel, &fuse.OpenIn{
+		InHeader: fuse.InHeader{NodeId: nodeID, Caller: in.Caller},
+		Flags:    in.Flags,
+	}, &out.OpenOut)
+	if status != fuse.OK {
+		return status
+	}
+	if flags&os.O_TRUNC != 0 {
+		child.Lock()
+		fd, err := f.content.Open(child.DriveItem.ID)
+		if err != nil {
+			child.Unlock()
+			ctx.Error().Err(err).Msg("Could not get fd.")
+			return fuse.EIO
+		}
+		fd.Truncate(0)
+		child.DriveItem.Size = 0
+		child.hasChanges = true
+		child.Unlock()
+	}
+	out.NodeId = nodeID
+	out.Attr = child.makeAttr(f.owner(), f.mtimePrecision())
+	out.SetAttrTimeout(timeout)
+	out.SetEntryTimeout(timeout)
+	return fuse.OK
+}
+
 // Open fetches a Inodes's content and initializes the .Data field with actual
 // data from the server.
 func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	f.touch()
 	id := f.TranslateID(in.NodeId)
 	inode := f.GetID(id)
 	if inode == nil {
@@ -471,6 +709,13 @@ func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Ope
 		Str("path", path).
 		Logger()
 
+	// directories are opened with OpenDir, anything else trying to read one as a
+	// file would otherwise end up trying to download its "content"
+	if inode.IsDir() {
+		ctx.Warn().Msg("Refusing Open() on a directory.")
+		return fuse.Status(syscall.EISDIR)
+	}
+
 	flags := int(in.Flags)
 	if flags&os.O_RDWR+flags&os.O_WRONLY > 0 && f.IsOffline() {
 		ctx.Warn().
@@ -479,10 +724,24 @@ func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Ope
 			Msg("Refusing Open() with write flag, FS is offline.")
 		return fuse.EROFS
 	}
+	if flags&os.O_RDWR+flags&os.O_WRONLY > 0 && f.IsQuotaExceeded() {
+		ctx.Warn().Msg("Refusing Open() with write flag, drive is over quota.")
+		return fuse.EROFS
+	}
+	if flags&os.O_RDWR+flags&os.O_WRONLY > 0 && isVolumeInfo(inode.ID()) {
+		ctx.Warn().Msg("Refusing Open() with write flag, .xdg-volume-info is read-only.")
+		return fuse.EACCES
+	}
 
 	ctx.Debug().Msg("")
 
+	if flags&os.O_RDWR+flags&os.O_WRONLY == 0 && f.streamed(inode) {
+		ctx.Info().Msg("Streaming file from server instead of downloading it.")
+		return fuse.OK
+	}
+
 	// try grabbing from disk
+	cached := f.content.HasContent(id)
 	fd, err := f.content.Open(id)
 	if err != nil {
 		ctx.Error().Err(err).Msg("Could not create cache file.")
@@ -501,13 +760,44 @@ func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Ope
 	// stay locked until end to prevent multiple Opens() from competing for
 	// downloads of the same file.
 
-	if inode.VerifyChecksum(graph.QuickXORHashStream(fd)) {
+	// OneDrive reports some files as empty that aren't, so unless we've been
+	// told otherwise, their reported size is never taken as a sign that the
+	// cached content is right
+	zeroSize := inode.DriveItem.Size == 0 && f.opts.ZeroSizeFiles != zeroSizeTrust
+
+	if f.opts.NoVerifyCache && cached && !zeroSize {
+		// the user has opted to trust the cache, so we only check that the
+		// size is what the server says it is (content is purged by the delta
+		// thread when it changes remotely)
+		if st, err := fd.Stat(); err == nil && uint64(st.Size()) == inode.DriveItem.Size {
+			ctx.Info().Msg("Found content in cache, skipping verification.")
+			return fuse.OK
+		}
+	}
+
+	if cached && inode.contentIsCurrent() {
+		// the content hasn't changed on the server since we cached it, the
+		// size is only checked in case the cache file got cut short
+		if st, err := fd.Stat(); err == nil && (uint64(st.Size()) == inode.DriveItem.Size || zeroSize) {
+			ctx.Info().Msg("Found content in cache, cTag is unchanged.")
+			if zeroSize {
+				f.sizeFromContent(inode, uint64(st.Size()), out)
+			}
+			return fuse.OK
+		}
+	}
+
+	if inode.VerifyStream(fd) {
 		// disk content is only used if the checksums match
 		ctx.Info().Msg("Found content in cache.")
 
 		// we check size ourselves in case the API file sizes are WRONG (it happens)
 		st, _ := fd.Stat()
 		inode.DriveItem.Size = uint64(st.Size())
+		inode.contentCTag = inode.DriveItem.CTag
+		if zeroSize {
+			f.sizeFromContent(inode, uint64(st.Size()), out)
+		}
 		return fuse.OK
 	}
 
@@ -515,37 +805,88 @@ func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Ope
 		"Not using cached item due to file hash mismatch, fetching content from API.",
 	)
 
-	// write to tempfile first to ensure our download is good
-	tempID := "temp-" + id
-	temp, err := f.content.Open(tempID)
-	if err != nil {
-		ctx.Error().Err(err).Msg("Failed to create tempfile for download.")
-		return fuse.EIO
+	if err := f.checkDiskSpace(inode.DriveItem.Size); err != nil {
+		ctx.Error().Err(err).Msg("Not downloading file.")
+		return fuse.Status(syscall.ENOSPC)
 	}
-	defer f.content.Delete(tempID)
 
-	// replace content only on a match
-	size, err := graph.GetItemContentStream(id, f.auth, temp)
-	if err != nil || !inode.VerifyChecksum(graph.QuickXORHashStream(temp)) {
+	// download to a temp file first to ensure our download is good, and only
+	// replace content on a match
+	temp, err := f.downloadTemp(id, "download")
+	if err == nil {
+		defer temp.Close()
+	}
+	if graph.IsUnknownID(err) {
+		// our copy of this item's ID has gone stale (evicting it needs the
+		// inode lock)
+		inode.Unlock()
+		defer inode.Lock()
+		if f.evictStale(id, path) != nil {
+			// the kernel will look the path up again and retry
+			return fuse.Status(syscall.ESTALE)
+		}
+		return fuse.ENOENT
+	}
+	if graph.IsMalwareDetected(err) {
+		ctx.Error().Err(err).Msg("OneDrive has flagged this file as malware and " +
+			"will not allow it to be downloaded. It can only be opened or deleted " +
+			"from the OneDrive website.")
+		return fuse.EACCES
+	}
+	// without any hashes, a download that completed is as good as it gets
+	if err != nil || (inode.DriveItem.HasHashes() && !inode.VerifyStream(temp)) {
 		ctx.Error().Err(err).Msg("Failed to fetch remote content.")
 		return fuse.EREMOTEIO
 	}
 	temp.Seek(0, 0) // being explicit, even though already done in hashstream func
 	fd.Seek(0, 0)
 	fd.Truncate(0)
-	io.Copy(fd, temp)
-	inode.DriveItem.Size = size
+	if _, err = io.Copy(fd, temp); err != nil {
+		// don't leave a partial copy behind to be mistaken for the real thing
+		ctx.Error().Err(err).Msg("Could not write downloaded content to cache.")
+		fd.Truncate(0)
+		if errors.Is(err, syscall.ENOSPC) {
+			return fuse.Status(syscall.ENOSPC)
+		}
+		return fuse.EIO
+	}
+	inode.DriveItem.Size = temp.Size
+	inode.contentCTag = inode.DriveItem.CTag
+	if zeroSize {
+		f.sizeFromContent(inode, temp.Size, out)
+	}
+	f.history.record(historyDownloaded, id, path, false)
 	return fuse.OK
 }
 
+// sizeFromContent is for files that OneDrive said were empty, but turned out
+// not to be. The kernel stops reading at the size it was told before, so the
+// file is read without going through the page cache this time, and has its
+// attributes refreshed for the next time. The caller must hold the inode lock.
+func (f *Filesystem) sizeFromContent(inode *Inode, size uint64, out *fuse.OpenOut) {
+	if size == 0 {
+		return
+	}
+	log.Info().Str("id", inode.DriveItem.ID).Uint64("size", size).
+		Msg("File that OneDrive reported as empty has content.")
+	inode.DriveItem.Size = size
+	out.OpenFlags |= fuse.FOPEN_DIRECT_IO
+	go f.invalidateAttr(inode.nodeID)
+}
+
 // Unlink deletes a child file.
 func (f *Filesystem) Unlink(cancel <-chan struct{}, in *fuse.InHeader, name string) fuse.Status {
+	f.markActive()
+	name = f.remoteName(name)
 	parentID := f.TranslateID(in.NodeId)
 	child, _ := f.GetChild(parentID, name, nil)
 	if child == nil {
 		// the file we are unlinking never existed
 		return fuse.ENOENT
 	}
+	if isVolumeInfo(child.ID()) {
+		return fuse.EPERM
+	}
 	if f.IsOffline() {
 		return fuse.EROFS
 	}
@@ -564,19 +905,37 @@ func (f *Filesystem) Unlink(cancel <-chan struct{}, in *fuse.InHeader, name stri
 	// if no ID, the item is local-only, and does not need to be deleted on the
 	// server
 	if !isLocalID(id) {
-		if err := graph.Remove(id, f.auth); err != nil {
+		if err := graph.Remove(id, f.auth); graph.IsUnknownID(err) {
+			ctx.Warn().Err(err).Msg("Item was already gone from the server.")
+		} else if err != nil {
 			ctx.Err(err).Msg("Failed to delete item on server. Aborting op.")
+			f.ops.record("delete", path, err)
 			return fuse.EREMOTEIO
 		}
 	}
 
 	f.DeleteID(id)
 	f.content.Delete(id)
+	f.ops.record("delete", path, nil)
+	f.history.record(historyDeleted, id, path, false)
 	return fuse.OK
 }
 
+// streamed is true for files that are read straight from the server instead of
+// the content cache, because they are larger than Options.StreamThreshold and
+// are not in the cache already. Anything that writes to a file downloads it in
+// full first, so it stops being streamed after that.
+func (f *Filesystem) streamed(inode *Inode) bool {
+	if f.opts.StreamThreshold == 0 || inode.IsDir() {
+		return false
+	}
+	id := inode.ID()
+	return !isLocalID(id) && inode.Size() > f.opts.StreamThreshold && !f.content.HasContent(id)
+}
+
 // Read an inode's data like a file.
 func (f *Filesystem) Read(cancel <-chan struct{}, in *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	f.touch()
 	inode := f.GetNodeID(in.NodeId)
 	if inode == nil {
 		return fuse.ReadResultData(make([]byte, 0)), fuse.EBADF
@@ -593,22 +952,69 @@ func (f *Filesystem) Read(cancel <-chan struct{}, in *fuse.ReadIn, buf []byte) (
 		Logger()
 	ctx.Trace().Msg("")
 
-	fd, err := f.content.Open(id)
-	if err != nil {
-		ctx.Error().Err(err).Msg("Cache Open() failed.")
-		return fuse.ReadResultData(make([]byte, 0)), fuse.EIO
+	if f.streamed(inode) {
+		size := inode.Size()
+		if in.Offset >= size {
+			return fuse.ReadResultData(make([]byte, 0)), fuse.OK
+		}
+		length := uint64(in.Size)
+		if in.Offset+length > size {
+			length = size - in.Offset
+		}
+		data, err := graph.GetItemContentRange(id, in.Offset, length, f.auth)
+		if err != nil {
+			ctx.Error().Err(err).Uint64("offset", in.Offset).Msg("Could not stream file content.")
+			return fuse.ReadResultData(make([]byte, 0)), fuse.EREMOTEIO
+		}
+		return fuse.ReadResultData(data), fuse.OK
 	}
 
-	// we are locked for the remainder of this op
+	if int(in.Size) < len(buf) {
+		buf = buf[:in.Size]
+	}
+	// Content is only ever replaced while holding the inode's lock, so the read
+	// has to happen while we hold it too, rather than handing the kernel an fd
+	// to read from later. Bounds come from the content itself, not the size we
+	// have on record, since the two can briefly disagree while it's replaced.
 	inode.RLock()
 	defer inode.RUnlock()
-	return fuse.ReadResultFd(fd.Fd(), int64(in.Offset), int(in.Size)), fuse.OK
+	for attempt := 0; ; attempt++ {
+		fd, err := f.content.Open(id)
+		if err != nil {
+			ctx.Error().Err(err).Msg("Cache Open() failed.")
+			return fuse.ReadResultData(make([]byte, 0)), fuse.EIO
+		}
+		n, err := fd.ReadAt(buf, int64(in.Offset))
+		if errors.Is(err, os.ErrClosed) && attempt == 0 {
+			// someone else closed the file under us, open it again
+			continue
+		}
+		if err != nil && err != io.EOF {
+			ctx.Error().Err(err).Uint64("offset", in.Offset).Msg("Could not read cached content.")
+			return fuse.ReadResultData(make([]byte, 0)), fuse.EIO
+		}
+		// Past the end of the content but within the file's size is a hole,
+		// like after a truncate that grew the file, and reads as zeros.
+		// Reading past the end of the file is a short (or empty) read.
+		if size := inode.DriveItem.Size; n < len(buf) && in.Offset+uint64(n) < size {
+			fill := len(buf)
+			if remaining := size - in.Offset; remaining < uint64(fill) {
+				fill = int(remaining)
+			}
+			for i := n; i < fill; i++ {
+				buf[i] = 0
+			}
+			n = fill
+		}
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
 }
 
 // Write to an Inode like a file. Note that changes are 100% local until
 // Flush() is called. Returns the number of bytes written and the status of the
 // op.
 func (f *Filesystem) Write(cancel <-chan struct{}, in *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	f.markActive()
 	id := f.TranslateID(in.NodeId)
 	inode := f.GetID(id)
 	if inode == nil {
@@ -627,23 +1033,29 @@ func (f *Filesystem) Write(cancel <-chan struct{}, in *fuse.WriteIn, data []byte
 		Logger()
 	ctx.Trace().Msg("")
 
-	fd, err := f.content.Open(id)
-	if err != nil {
-		ctx.Error().Msg("Cache Open() failed.")
-		return 0, fuse.EIO
+	if uint64(offset+nWrite) > f.maxFileSize() {
+		ctx.Warn().Msg("Write would make file larger than OneDrive allows.")
+		return 0, fuse.Status(syscall.EFBIG)
 	}
 
 	inode.Lock()
 	defer inode.Unlock()
-	n, err := fd.WriteAt(data, int64(offset))
+	n, err := f.content.WriteAt(id, data, int64(offset))
+
+	// the size is already known, so there's no need to stat the file on every
+	// write (which adds up for big files copied in small chunks). Whatever part
+	// of a failed write made it to disk still counts, or the size and the
+	// changes that get uploaded would leave it out.
+	if end := uint64(offset + n); n > 0 && end > inode.DriveItem.Size {
+		inode.DriveItem.Size = end
+	}
+	if n > 0 {
+		inode.hasChanges = true
+	}
 	if err != nil {
-		ctx.Error().Err(err).Msg("Error during write")
+		ctx.Error().Err(err).Int("written", n).Msg("Error during write")
 		return uint32(n), fuse.EIO
 	}
-
-	st, _ := fd.Stat()
-	inode.DriveItem.Size = uint64(st.Size())
-	inode.hasChanges = true
 	return uint32(n), fuse.OK
 }
 
@@ -664,6 +1076,18 @@ func (f *Filesystem) Fsync(cancel <-chan struct{}, in *fuse.FsyncIn) fuse.Status
 		Logger()
 	ctx.Debug().Msg("")
 	if inode.HasChanges() {
+		if f.IsQuotaExceeded() {
+			// the changes stay in the cache, and are uploaded once there is
+			// space again
+			ctx.Warn().Msg("Drive is out of space, not uploading changes.")
+			f.uploads.markQuotaFailed(inode)
+			return fuse.Status(syscall.ENOSPC)
+		}
+		if size := inode.Size(); size > f.maxFileSize() {
+			ctx.Error().Uint64("size", size).
+				Msg("File is larger than OneDrive allows, refusing to upload it.")
+			return fuse.Status(syscall.EFBIG)
+		}
 		inode.Lock()
 		inode.hasChanges = false
 
@@ -674,7 +1098,7 @@ func (f *Filesystem) Fsync(cancel <-chan struct{}, in *fuse.FsyncIn) fuse.Status
 			ctx.Error().Err(err).Msg("Could not get fd.")
 		}
 		fd.Sync()
-		inode.DriveItem.File.Hashes.QuickXorHash = graph.QuickXORHashStream(fd)
+		inode.DriveItem.File.Hashes = graph.LocalHashes(fd)
 		inode.Unlock()
 
 		if err := f.uploads.QueueUpload(inode); err != nil {
@@ -701,14 +1125,47 @@ func (f *Filesystem) Flush(cancel <-chan struct{}, in *fuse.FlushIn) fuse.Status
 		Str("path", inode.Path()).
 		Uint64("nodeID", in.NodeId).
 		Msg("")
-	f.Fsync(cancel, &fuse.FsyncIn{InHeader: in.InHeader})
+	// closing a file that wasn't written to shouldn't wait on anything
+	wait := f.opts.SyncWrites && inode.HasChanges()
+	status := f.Fsync(cancel, &fuse.FsyncIn{InHeader: in.InHeader})
 	f.content.Close(id)
+	if status == fuse.Status(syscall.ENOSPC) {
+		// the only way for close() to tell a program its changes didn't make it
+		return status
+	}
+	if wait && status == fuse.OK {
+		return f.waitUpload(inode)
+	}
 	return 0
 }
 
+// waitUpload blocks until an item's upload is done, for Options.SyncWrites.
+func (f *Filesystem) waitUpload(inode *Inode) fuse.Status {
+	timeout := f.opts.SyncWritesTimeout
+	if timeout <= 0 {
+		timeout = defaultSyncWritesTimeout
+	}
+	err := f.uploads.WaitUpload(inode.ID(), timeout)
+	if err == nil {
+		return fuse.OK
+	}
+	log.Error().Err(err).
+		Str("id", inode.ID()).
+		Str("path", inode.Path()).
+		Msg("Changes were not uploaded before the file was closed.")
+	switch {
+	case err == errUploadTimeout:
+		return fuse.Status(syscall.ETIMEDOUT)
+	case graph.IsQuotaExceeded(err):
+		return fuse.Status(syscall.ENOSPC)
+	}
+	return fuse.EIO
+}
+
 // Getattr returns a the Inode as a UNIX stat. Holds the read mutex for all of
 // the "metadata fetch" operations.
 func (f *Filesystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	f.touch()
 	id := f.TranslateID(in.NodeId)
 	inode := f.GetID(id)
 	if inode == nil {
@@ -721,7 +1178,7 @@ func (f *Filesystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *fu
 		Str("path", inode.Path()).
 		Msg("")
 
-	out.Attr = inode.makeAttr()
+	out.Attr = inode.makeAttr(f.owner(), f.mtimePrecision())
 	out.SetTimeout(timeout)
 	return fuse.OK
 }
@@ -734,6 +1191,12 @@ func (f *Filesystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fu
 	if i == nil {
 		return fuse.ENOENT
 	}
+	if isVolumeInfo(i.ID()) {
+		return fuse.EPERM
+	}
+	if size, valid := in.GetSize(); valid && size > f.maxFileSize() {
+		return fuse.Status(syscall.EFBIG)
+	}
 	path := i.Path()
 	isDir := i.IsDir() // holds an rlock
 	i.Lock()
@@ -784,13 +1247,16 @@ func (f *Filesystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fu
 	}
 
 	i.Unlock()
-	out.Attr = i.makeAttr()
+	out.Attr = i.makeAttr(f.owner(), f.mtimePrecision())
 	out.SetTimeout(timeout)
 	return fuse.OK
 }
 
 // Rename renames and/or moves an inode.
 func (f *Filesystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, name string, newName string) fuse.Status {
+	f.markActive()
+	name = f.remoteName(name)
+	newName = f.remoteName(newName)
 	if isNameRestricted(newName) {
 		return fuse.EINVAL
 	}
@@ -806,14 +1272,27 @@ func (f *Filesystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, name stri
 	// to use GetPath() to prefetch it. In order for the fs to know about this
 	// inode, it has already fetched all of the inodes up to the new destination.
 	newParentItem := f.GetNodeID(in.Newdir)
+	if newParentItem == nil {
+		// depending on traversal order, the destination may not be cached yet
+		newParentItem = f.fetchNodeID(in.Newdir)
+	}
 	if newParentItem == nil {
 		return fuse.ENOENT
 	}
 	dest := filepath.Join(newParentItem.Path(), newName)
+	newParentID := newParentItem.ID()
 
 	inode, _ := f.GetChild(oldParentID, name, f.auth)
+	if inode == nil {
+		return fuse.ENOENT
+	}
+	if isVolumeInfo(inode.ID()) {
+		return fuse.EPERM
+	}
+	// whatever is at the destination gets replaced. Looked up now, since the
+	// server may not list the new state right after the rename.
+	replaced, _ := f.GetChild(newParentID, newName, f.auth)
 	id, err := f.remoteID(inode)
-	newParentID := newParentItem.ID()
 
 	ctx := log.With().
 		Str("op", "Rename").
@@ -837,15 +1316,28 @@ func (f *Filesystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, name stri
 	// perform remote rename
 	if err = graph.Rename(id, newName, newParentID, f.auth); err != nil {
 		ctx.Error().Err(err).Msg("Failed to rename remote item.")
+		f.ops.record("rename", path, err)
 		return fuse.EREMOTEIO
 	}
 
-	// now rename local copy
-	if err = f.MovePath(oldParentID, newParentID, name, newName, f.auth); err != nil {
+	// Now rename the local copy. This is done with what we already know rather
+	// than by asking the server, which can keep returning the old name and
+	// parent for a little while. Anything it does get wrong in the meantime is
+	// fixed by the next delta.
+	if replaced != nil && replaced.ID() != inode.ID() {
+		f.DeleteID(replaced.ID())
+		f.content.Delete(replaced.ID())
+	}
+	if err = f.moveInode(inode, newParentID, newName); err != nil {
 		ctx.Error().Err(err).Msg("Failed to rename local item.")
+		f.ops.record("rename", path, err)
 		return fuse.EIO
 	}
+	inode.Lock()
+	inode.movedAt = time.Now()
+	inode.Unlock()
 
 	// whew! item renamed
+	f.ops.record("rename", path, nil)
 	return fuse.OK
 }
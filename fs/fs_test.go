@@ -6,15 +6,21 @@ package fs
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -163,6 +169,48 @@ func TestRenameMove(t *testing.T) {
 	require.NotNil(t, st, "Renamed file does not exist.")
 }
 
+// A renamed file should be found under its new name straight away, even if the
+// directory is re-listed before the server has caught up with the rename.
+func TestRenameImmediateStat(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "rename_immediate.txt")
+	dname := filepath.Join(TestDir, "rename_immediate_moved.txt")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("stat me right away\n"), 0644))
+	require.NoError(t, os.Rename(fname, dname))
+	st, err := os.Stat(dname)
+	require.NoError(t, err)
+	assert.Equal(t, "rename_immediate_moved.txt", st.Name())
+
+	parent, err := fs.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	require.NoError(t, fs.RefreshChildren(parent.ID(), 0, auth))
+	_, err = os.Stat(dname)
+	assert.NoError(t, err, "Renamed file went missing after re-listing its directory.")
+	_, err = os.Stat(fname)
+	assert.True(t, os.IsNotExist(err), "Old name came back after re-listing its directory.")
+}
+
+// Renaming into a directory that was just created on the server (and so has
+// never been cached) should work.
+func TestRenameToNewRemoteDir(t *testing.T) {
+	t.Parallel()
+	parent, err := graph.GetItemPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	_, err = graph.Mkdir("rename_new_remote_dir", parent.ID, auth)
+	require.NoError(t, err)
+
+	fname := filepath.Join(TestDir, "rename_new_remote_dir.txt")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("move me"), 0644))
+	dest := filepath.Join(TestDir, "rename_new_remote_dir", "moved.txt")
+	require.Eventually(t, func() bool {
+		return os.Rename(fname, dest) == nil
+	}, retrySeconds, time.Second, "Could not rename into new remote directory.")
+
+	content, err := ioutil.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("move me"), content)
+}
+
 // test that copies work as expected
 func TestCopy(t *testing.T) {
 	t.Parallel()
@@ -422,6 +470,41 @@ func TestGIOTrash(t *testing.T) {
 	}
 }
 
+// Directory entries should come back in the same (sorted) order every time,
+// regardless of the order the server or cache gave them to us in.
+func TestReaddirStableOrder(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join(TestDir, "readdir_order")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	for _, name := range []string{"b.txt", "C.txt", "a.txt", "d"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+
+	readNames := func() []string {
+		// unlike ioutil.ReadDir(), Readdirnames() does not sort its results
+		handle, err := os.Open(dir)
+		require.NoError(t, err)
+		defer handle.Close()
+		names, err := handle.Readdirnames(-1)
+		require.NoError(t, err)
+		return names
+	}
+	expected := []string{"a.txt", "b.txt", "C.txt", "d"}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, expected, readNames())
+	}
+}
+
+// Files can't grow past OneDrive's size limit, and should fail immediately
+// instead of on upload.
+func TestTruncateTooLarge(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "truncate_too_large.txt")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("small"), 0644))
+	err := os.Truncate(fname, int64(graph.MaxFileSize)+1)
+	assert.ErrorIs(t, err, syscall.EFBIG)
+}
+
 // Test that we are able to work around onedrive paging limits when
 // listing a folder's children.
 func TestListChildrenPaging(t *testing.T) {
@@ -497,3 +580,437 @@ func TestDisallowedFilenames(t *testing.T) {
 		filepath.Join(TestDir, "invalid_vti_directory"),
 	))
 }
+
+// With MapRestrictedChars, names OneDrive would refuse should become allowed
+// on the server and come back unchanged.
+func TestMapRestrictedChars(t *testing.T) {
+	t.Parallel()
+	name := `what? a "name": <1|2> *\.txt`
+	mapped := &Filesystem{opts: Options{MapRestrictedChars: true}}
+	remote := mapped.remoteName(name)
+	assert.False(t, isNameRestricted(remote))
+	assert.Equal(t, "what\uf03f a \uf022name\uf022\uf03a \uf03c1\uf07c2\uf03e \uf02a\uf05c.txt", remote)
+	assert.Equal(t, name, mapped.localName(remote))
+
+	unmapped := &Filesystem{}
+	assert.Equal(t, name, unmapped.remoteName(name))
+	assert.Equal(t, remote, unmapped.localName(remote))
+}
+
+// An item's description should be readable and writable as an xattr, and be
+// removable.
+func TestDescriptionXAttr(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "description_xattr.txt")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("describe me"), 0644))
+
+	description := []byte("a file with a description")
+	require.NoError(t, syscall.Setxattr(fname, xattrDescription, description, 0))
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(fname, xattrDescription, buf)
+	require.NoError(t, err)
+	assert.Equal(t, description, buf[:n])
+
+	item, err := graph.GetItemPath("/onedriver_tests/description_xattr.txt", auth)
+	require.NoError(t, err)
+	assert.Equal(t, string(description), item.Description)
+
+	require.NoError(t, syscall.Removexattr(fname, xattrDescription))
+	_, err = syscall.Getxattr(fname, xattrDescription, buf)
+	assert.ErrorIs(t, err, syscall.ENODATA)
+}
+
+// Writes past the end of a file should grow it, and writes within it should
+// leave its size alone.
+func TestWriteSize(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_write_size"))
+	inode := NewInode("write_size.txt", 0644|fuse.S_IFREG, nil)
+	cache.InsertPath("/write_size.txt", nil, inode)
+	inode.setContent(cache, []byte("0123456789"))
+
+	write := func(offset uint64, data string) {
+		_, status := cache.Write(
+			context.Background().Done(),
+			&fuse.WriteIn{InHeader: fuse.InHeader{NodeId: inode.NodeID()}, Offset: offset},
+			[]byte(data),
+		)
+		require.Equal(t, fuse.OK, status)
+	}
+	write(2, "ab")
+	assert.Equal(t, uint64(10), inode.Size())
+	write(8, "abcd")
+	assert.Equal(t, uint64(12), inode.Size())
+	write(20, "x")
+	assert.Equal(t, uint64(21), inode.Size())
+}
+
+// Reads should see either the old or the new content of a file whose content
+// is replaced while it is being read, never a mix of the two or an error. The
+// same goes for when another handle to the file closes it.
+func TestReadConcurrentReplace(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_read_concurrent_replace"))
+	inode := NewInode("read_concurrent_replace.txt", 0644|fuse.S_IFREG, nil)
+	cache.InsertPath("/read_concurrent_replace.txt", nil, inode)
+	before, after := bytes.Repeat([]byte("a"), 256*1024), bytes.Repeat([]byte("b"), 256*1024)
+	inode.setContent(cache, before)
+	id := inode.ID()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			// the same thing Open() does when it fetches newer content
+			inode.Lock()
+			fd, err := cache.content.Open(id)
+			if err == nil {
+				fd.Seek(0, 0)
+				fd.Truncate(0)
+				if i%2 == 0 {
+					fd.Write(after)
+				} else {
+					fd.Write(before)
+				}
+			}
+			inode.Unlock()
+			cache.content.Close(id)
+		}
+	}()
+
+	buf := make([]byte, len(before))
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		result, status := cache.Read(
+			context.Background().Done(),
+			&fuse.ReadIn{InHeader: fuse.InHeader{NodeId: inode.NodeID()}, Size: uint32(len(buf))},
+			buf,
+		)
+		require.Equal(t, fuse.OK, status)
+		data, _ := result.Bytes(buf)
+		require.Len(t, data, len(before))
+		require.True(t, bytes.Equal(before, data) || bytes.Equal(after, data),
+			"Read a mix of old and new content.")
+	}
+}
+
+// Parts of a file that were never written, like after growing it with
+// truncate, should read as zeros, even where the cached content doesn't reach.
+func TestReadHoles(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_read_holes"))
+	inode := NewInode("read_holes.txt", 0644|fuse.S_IFREG, nil)
+	cache.InsertPath("/read_holes.txt", nil, inode)
+	inode.setContent(cache, []byte("abc"))
+
+	read := func(offset uint64, size int) []byte {
+		buf := make([]byte, size)
+		for i := range buf {
+			buf[i] = 'x' // so that zeros can't come from the buffer itself
+		}
+		result, status := cache.Read(
+			context.Background().Done(),
+			&fuse.ReadIn{
+				InHeader: fuse.InHeader{NodeId: inode.NodeID()},
+				Offset:   offset,
+				Size:     uint32(size),
+			},
+			buf,
+		)
+		require.Equal(t, fuse.OK, status)
+		data, _ := result.Bytes(buf)
+		return data
+	}
+
+	var out fuse.AttrOut
+	in := &fuse.SetAttrIn{}
+	in.NodeId = inode.NodeID()
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = 8
+	require.Equal(t, fuse.OK, cache.SetAttr(context.Background().Done(), in, &out))
+	assert.Equal(t, []byte("abc\x00\x00\x00\x00\x00"), read(0, 16))
+	assert.Equal(t, []byte("\x00\x00"), read(6, 16))
+
+	// content that falls short of the file's size reads the same way
+	inode.Lock()
+	inode.DriveItem.Size = 12
+	inode.Unlock()
+	assert.Equal(t, make([]byte, 4), read(8, 16))
+	assert.Empty(t, read(12, 16), "Reading past the end should not return anything.")
+}
+
+// Writes should not fail or lose track of the file's size when another handle
+// closes the file in the middle of them.
+func TestWriteConcurrentClose(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_write_concurrent_close"))
+	inode := NewInode("write_concurrent_close.txt", 0644|fuse.S_IFREG, nil)
+	cache.InsertPath("/write_concurrent_close.txt", nil, inode)
+	id := inode.ID()
+
+	chunk := []byte("written ")
+	write := func(i int) {
+		n, status := cache.Write(
+			context.Background().Done(),
+			&fuse.WriteIn{
+				InHeader: fuse.InHeader{NodeId: inode.NodeID()},
+				Offset:   uint64(i * len(chunk)),
+			},
+			chunk,
+		)
+		require.Equal(t, fuse.OK, status)
+		require.Equal(t, uint32(len(chunk)), n)
+	}
+	write(0)
+
+	// the same as another handle closing the file right after Write() got it
+	fd, err := cache.content.Open(id)
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+	write(1)
+
+	// and closing it properly in between writes
+	cache.content.Close(id)
+	write(2)
+
+	assert.Equal(t, uint64(3*len(chunk)), inode.Size())
+	assert.Equal(t, bytes.Repeat(chunk, 3), cache.content.Get(id))
+	// the content can be shorter than the size on record, but never longer
+	st, err := os.Stat(cache.content.contentPath(id))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, uint64(st.Size()), inode.Size())
+	assert.True(t, inode.HasChanges())
+}
+
+// Copying a large file into the mount in small chunks, like cp does.
+func BenchmarkWriteSequential(b *testing.B) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "bench_write_sequential"))
+	chunk := make([]byte, 4096)
+	for i := 0; i < b.N; i++ {
+		inode := NewInode("write_sequential.bin", 0644|fuse.S_IFREG, nil)
+		cache.InsertPath("/write_sequential.bin", nil, inode)
+		inode.setContent(cache, []byte{})
+		b.SetBytes(64 * 1024 * 1024)
+		for offset := uint64(0); offset < 64*1024*1024; offset += uint64(len(chunk)) {
+			cache.Write(
+				context.Background().Done(),
+				&fuse.WriteIn{
+					InHeader: fuse.InHeader{NodeId: inode.NodeID()},
+					Offset:   offset,
+					Size:     uint32(len(chunk)),
+				},
+				chunk,
+			)
+		}
+		cache.content.Close(inode.ID())
+		cache.content.Delete(inode.ID())
+		cache.DeleteID(inode.ID())
+	}
+}
+
+// Two processes running "mkdir -p" on the same path at once should both
+// succeed, and end up with the same directory.
+func TestMkdirConcurrent(t *testing.T) {
+	t.Parallel()
+	parent, err := fs.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+
+	const name = "mkdir_concurrent"
+	var wg sync.WaitGroup
+	statuses := make([]fuse.Status, 4)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = fs.Mkdir(
+				context.Background().Done(),
+				&fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: parent.NodeID()}, Mode: 0755},
+				name,
+				&fuse.EntryOut{},
+			)
+		}(i)
+	}
+	wg.Wait()
+	defer fs.Rmdir(context.Background().Done(), &fuse.InHeader{NodeId: parent.NodeID()}, name)
+
+	for i, status := range statuses {
+		assert.Equal(t, fuse.OK, status, "mkdir %d failed", i)
+	}
+	children, err := graph.GetItemChildren(parent.ID(), auth)
+	require.NoError(t, err)
+	found := 0
+	for _, child := range children {
+		if strings.EqualFold(child.Name, name) {
+			found++
+		}
+	}
+	assert.Equal(t, 1, found, "Directory should only exist once on the server.")
+}
+
+// Files should have a download URL that works without authentication.
+func TestDownloadURLXAttr(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "download_url.txt")
+	content := []byte("download me directly")
+	require.NoError(t, ioutil.WriteFile(fname, content, 0644))
+
+	buf := make([]byte, 4096)
+	var url string
+	assert.Eventually(t, func() bool {
+		n, err := syscall.Getxattr(fname, xattrDownloadURL, buf)
+		url = string(buf[:n])
+		return err == nil
+	}, retrySeconds, time.Second, "File never got a download URL.")
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	downloaded, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+
+	_, err = syscall.Getxattr(TestDir, xattrDownloadURL, buf)
+	assert.ErrorIs(t, err, syscall.ENODATA, "Folders should not have a download URL.")
+}
+
+// Symlinks should be refused, without leaving anything behind.
+func TestSymlinkRefused(t *testing.T) {
+	t.Parallel()
+	link := filepath.Join(TestDir, "symlink_refused")
+	err := os.Symlink("/etc/hostname", link)
+	assert.ErrorIs(t, err, syscall.EPERM)
+	_, err = os.Lstat(link)
+	assert.True(t, os.IsNotExist(err), "Nothing should have been created.")
+}
+
+// Image and photo facets from the server should show up as xattrs.
+func TestMediaXAttr(t *testing.T) {
+	t.Parallel()
+	item := graph.DriveItem{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"name": "IMG_0001.jpg",
+		"image": {"width": 4032, "height": 3024},
+		"photo": {
+			"takenDateTime": "2021-06-01T17:30:00Z",
+			"cameraMake": "Apple",
+			"cameraModel": "iPhone 12"
+		}
+	}`), &item))
+	assert.Equal(t, "4032", mediaXAttr(item, xattrImageWidth))
+	assert.Equal(t, "3024", mediaXAttr(item, xattrImageHeight))
+	assert.Equal(t, "2021-06-01T17:30:00Z", mediaXAttr(item, xattrPhotoTaken))
+	assert.Equal(t, "Apple iPhone 12", mediaXAttr(item, xattrPhotoCamera))
+
+	item.Photo.CameraMake, item.Photo.CameraModel = "Canon", "Canon EOS 5D"
+	assert.Equal(t, "Canon EOS 5D", mediaXAttr(item, xattrPhotoCamera))
+
+	assert.Equal(t, "", mediaXAttr(graph.DriveItem{}, xattrImageWidth),
+		"Items without an image facet should not have the attribute.")
+}
+
+func TestSharepointXAttr(t *testing.T) {
+	t.Parallel()
+	item := graph.DriveItem{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"name": "report.docx",
+		"sharepointIds": {
+			"siteId": "3f2a8c1e-site",
+			"webId": "9b7d4e20-web",
+			"listId": "c5e1f0a2-list",
+			"listItemId": "42"
+		}
+	}`), &item))
+	assert.Equal(t, "3f2a8c1e-site", sharepointXAttr(item, xattrSharepointSite))
+	assert.Equal(t, "9b7d4e20-web", sharepointXAttr(item, xattrSharepointWeb))
+	assert.Equal(t, "c5e1f0a2-list", sharepointXAttr(item, xattrSharepointList))
+	assert.Equal(t, "42", sharepointXAttr(item, xattrSharepointListItem))
+
+	assert.Equal(t, "", sharepointXAttr(graph.DriveItem{}, xattrSharepointSite),
+		"Items from personal drives should not have the attribute.")
+}
+
+// Opening a directory as a file should fail with EISDIR instead of trying to
+// download it.
+func TestOpenDirAsFile(t *testing.T) {
+	t.Parallel()
+	inode, err := fs.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	status := fs.Open(
+		context.Background().Done(),
+		&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: inode.NodeID()}, Flags: uint32(os.O_RDONLY)},
+		&fuse.OpenOut{},
+	)
+	assert.Equal(t, fuse.Status(syscall.EISDIR), status)
+}
+
+// The mountpoint's parent is made up, but should show the same times every time
+// the root is listed rather than whenever it was listed.
+func TestOpenDirRootParent(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_open_dir_root_parent"))
+	root := cache.GetID("root")
+	require.NotNil(t, root)
+	parentAttr := func() fuse.Attr {
+		in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: root.NodeID()}}
+		require.Equal(t, fuse.OK, cache.OpenDir(context.Background().Done(), in, &fuse.OpenOut{}))
+		cache.opendirsM.RLock()
+		defer cache.opendirsM.RUnlock()
+		return cache.opendirs[root.NodeID()][1].makeAttr(cache.owner(), cache.mtimePrecision())
+	}
+
+	first := parentAttr()
+	time.Sleep(1100 * time.Millisecond)
+	second := parentAttr()
+	assert.Equal(t, first.Mtime, second.Mtime)
+	assert.Equal(t, root.makeAttr(cache.owner(), cache.mtimePrecision()).Mtime, first.Mtime)
+}
+
+// A rename on the server that only changes the case of a name should still
+// show up locally.
+func TestRefreshChildrenCaseRename(t *testing.T) {
+	t.Parallel()
+	parent, err := fs.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	item, err := graph.Mkdir("case_rename", parent.ID(), auth)
+	require.NoError(t, err)
+	defer graph.Remove(item.ID, auth)
+	require.NoError(t, fs.RefreshChildren(parent.ID(), 0, auth))
+
+	require.NoError(t, graph.Rename(item.ID, "CASE_RENAME", parent.ID(), auth))
+	require.NoError(t, fs.RefreshChildren(parent.ID(), 0, auth))
+	child, err := fs.GetChild(parent.ID(), "case_rename", auth)
+	require.NoError(t, err)
+	assert.Equal(t, "CASE_RENAME", child.Name())
+}
+
+// Downloads to a temp file should have the item's content, and clean up after
+// themselves.
+func TestDownloadTemp(t *testing.T) {
+	t.Parallel()
+	content := []byte("downloaded to disk")
+	item, err := graph.GetItemPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	resp, err := graph.Put(
+		fmt.Sprintf("/me/drive/items/%s:/download_temp.txt:/content", item.ID),
+		auth,
+		bytes.NewReader(content),
+	)
+	require.NoError(t, err)
+	var uploaded graph.DriveItem
+	require.NoError(t, json.Unmarshal(resp, &uploaded))
+
+	temp, err := fs.downloadTemp(uploaded.ID, "test")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(content)), temp.Size)
+	downloaded, err := ioutil.ReadAll(temp)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+
+	require.NoError(t, temp.Close())
+	_, err = os.Stat(temp.Name())
+	assert.True(t, os.IsNotExist(err), "Temp file should be removed once closed.")
+}
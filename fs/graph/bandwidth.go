@@ -0,0 +1,152 @@
+package graph
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limiter caps the rate of a transfer direction, shared by every request. It is
+// a token bucket holding up to a second's worth of bytes, which may go into
+// debt: a read that overdraws it makes the next one wait for the debt to be
+// paid off, so the average rate stays under the limit.
+type limiter struct {
+	sync.Mutex
+	rate   uint64 // bytes per second, 0 means unlimited
+	tokens float64
+	last   time.Time
+	meter  rateMeter // how fast things are actually going
+}
+
+var uploadLimit, downloadLimit limiter
+
+// transfer rates are averaged over this many seconds
+const rateWindow = 5
+
+// rateMeter is a moving average of how many bytes go by each second. Bytes are
+// counted into one bucket per second, and only the last rateWindow full seconds
+// are averaged, so a transfer that stops shows up as a rate of 0 shortly after.
+type rateMeter struct {
+	sync.Mutex
+	bytes   [rateWindow]uint64
+	seconds [rateWindow]int64 // which second each bucket is counting
+}
+
+func (m *rateMeter) add(n int, now time.Time) {
+	second := now.Unix()
+	bucket := second % rateWindow
+	m.Lock()
+	defer m.Unlock()
+	if m.seconds[bucket] != second {
+		m.seconds[bucket] = second
+		m.bytes[bucket] = 0
+	}
+	m.bytes[bucket] += uint64(n)
+}
+
+func (m *rateMeter) rate(now time.Time) uint64 {
+	current := now.Unix()
+	m.Lock()
+	defer m.Unlock()
+	var total uint64
+	for i, second := range m.seconds {
+		if second < current && second >= current-rateWindow {
+			total += m.bytes[i]
+		}
+	}
+	return total / rateWindow
+}
+
+// GetTransferRates returns how fast uploads and downloads have been going over
+// the last few seconds, in bytes per second.
+func GetTransferRates() (upload, download uint64) {
+	now := time.Now()
+	return uploadLimit.meter.rate(now), downloadLimit.meter.rate(now)
+}
+
+// SetBandwidthLimits caps upload and download speeds in bytes per second.
+// Zero means unlimited. Limits apply to all requests, including ones already
+// in progress.
+func SetBandwidthLimits(upload, download uint64) {
+	uploadLimit.set(upload)
+	downloadLimit.set(download)
+}
+
+// GetBandwidthLimits returns the current upload and download limits.
+func GetBandwidthLimits() (upload, download uint64) {
+	return uploadLimit.get(), downloadLimit.get()
+}
+
+func (l *limiter) set(rate uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if rate != l.rate {
+		// start with an empty bucket so a new limit takes effect right away
+		l.rate = rate
+		l.tokens = 0
+		l.last = time.Now()
+	}
+}
+
+func (l *limiter) get() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.rate
+}
+
+// wait blocks until n bytes may be transferred.
+func (l *limiter) wait(n int) {
+	l.Lock()
+	if l.rate == 0 || n <= 0 {
+		l.Unlock()
+		return
+	}
+	now := time.Now()
+	rate := float64(l.rate)
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.Unlock()
+	time.Sleep(wait)
+}
+
+// limitedReader is a reader that is slowed down by a limiter.
+type limitedReader struct {
+	io.ReadCloser
+	limiter *limiter
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	// keep reads small enough that a single one doesn't starve other transfers
+	if rate := r.limiter.get(); rate > 0 && uint64(len(p)) > rate {
+		p = p[:rate]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.limiter.meter.add(n, time.Now())
+	r.limiter.wait(n)
+	return n, err
+}
+
+// LimitUpload applies the upload limit to a request's body.
+func LimitUpload(request *http.Request) {
+	if request.Body != nil {
+		request.Body = limitedReader{ReadCloser: request.Body, limiter: &uploadLimit}
+	}
+}
+
+// readLimited reads and closes the body of a response at no more than the
+// download limit.
+func readLimited(response *http.Response) []byte {
+	body, _ := ioutil.ReadAll(limitedReader{ReadCloser: response.Body, limiter: &downloadLimit})
+	response.Body.Close()
+	return body
+}
@@ -0,0 +1,95 @@
+package graph
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slots bounds how many requests may be talking to the server at once, shared
+// by every request. Requests over the limit queue up until one finishes.
+type slots struct {
+	sync.Mutex
+	free  *sync.Cond
+	limit int // 0 means unlimited
+	inUse int
+}
+
+// uploads only use uploadSlots when it has a limit of its own, otherwise they
+// share requestSlots with everything else
+var requestSlots, uploadSlots = newSlots(), newSlots()
+
+// total nanoseconds requests have spent queued, see RequestStats.QueuedTime
+var queuedNanos int64
+
+func newSlots() *slots {
+	s := &slots{}
+	s.free = sync.NewCond(&s.Mutex)
+	return s
+}
+
+// SetMaxRequests limits how many requests may be made to the server at the
+// same time. Uploads count against maxUploads instead, unless it is zero, in
+// which case they share the same limit as everything else. A max of zero means
+// unlimited.
+func SetMaxRequests(max, maxUploads int) {
+	requestSlots.set(max)
+	uploadSlots.set(maxUploads)
+}
+
+// AcquireUploadSlot blocks until an upload may be sent, for uploads that are
+// not made through this package. The returned function must be called once the
+// upload's response has been read.
+func AcquireUploadSlot() (release func()) {
+	return slotsFor(true).acquire()
+}
+
+// slotsFor picks which limit a request counts against.
+func slotsFor(upload bool) *slots {
+	if upload && uploadSlots.get() > 0 {
+		return uploadSlots
+	}
+	return requestSlots
+}
+
+func (s *slots) set(limit int) {
+	s.Lock()
+	s.limit = limit
+	s.Unlock()
+	// a higher limit may let more than one request through
+	s.free.Broadcast()
+}
+
+func (s *slots) get() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.limit
+}
+
+// acquire blocks until a slot is free, and returns a function that gives it
+// back.
+func (s *slots) acquire() func() {
+	start := time.Now()
+	queued := false
+	s.Lock()
+	for s.limit > 0 && s.inUse >= s.limit {
+		queued = true
+		s.free.Wait()
+	}
+	s.inUse++
+	s.Unlock()
+	if queued {
+		atomic.AddUint64(&requestStats.Queued, 1)
+		atomic.AddInt64(&queuedNanos, int64(time.Since(start)))
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.Lock()
+			s.inUse--
+			s.Unlock()
+			s.free.Signal()
+		})
+	}
+}
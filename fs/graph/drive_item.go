@@ -3,15 +3,26 @@ package graph
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// files larger than this are downloaded in chunks of this size
+const downloadChunkSize = 10 * 1024 * 1024
+
+// MaxFileSize is the largest file OneDrive will accept (250GB).
+const MaxFileSize uint64 = 250 * 1024 * 1024 * 1024
+
 // DriveTypePersonal and friends represent the possible different values for a
 // drive's type when fetched from the API.
 const (
@@ -36,10 +47,19 @@ type Folder struct {
 	ChildCount uint32 `json:"childCount,omitempty"`
 }
 
+// Bundle is used for parsing only. Bundles are collections of other items, like
+// photo albums, and are treated as directories.
+// https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/bundle
+type Bundle struct {
+	ChildCount uint32    `json:"childCount,omitempty"`
+	Album      *struct{} `json:"album,omitempty"`
+}
+
 // Hashes are integrity hashes used to determine if file content has changed.
 // https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/hashes
 type Hashes struct {
 	SHA1Hash     string `json:"sha1Hash,omitempty"`
+	SHA256Hash   string `json:"sha256Hash,omitempty"`
 	QuickXorHash string `json:"quickXorHash,omitempty"`
 }
 
@@ -49,6 +69,31 @@ type File struct {
 	Hashes Hashes `json:"hashes,omitempty"`
 }
 
+// Image has the dimensions of an image file, in pixels.
+// https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/image
+type Image struct {
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// Photo is what OneDrive read from a photo's EXIF data.
+// https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/photo
+type Photo struct {
+	TakenDateTime *time.Time `json:"takenDateTime,omitempty"`
+	CameraMake    string     `json:"cameraMake,omitempty"`
+	CameraModel   string     `json:"cameraModel,omitempty"`
+}
+
+// SharepointIDs identify an item to SharePoint. They are only available for
+// items in business drives and SharePoint document libraries.
+// https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/sharepointids
+type SharepointIDs struct {
+	SiteID     string `json:"siteId,omitempty"`
+	WebID      string `json:"webId,omitempty"`
+	ListID     string `json:"listId,omitempty"`
+	ListItemID string `json:"listItemId,omitempty"`
+}
+
 // Deleted is used for detecting when items get deleted on the server
 // https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/deleted
 type Deleted struct {
@@ -61,18 +106,34 @@ type DriveItem struct {
 	ID               string           `json:"id,omitempty"`
 	Name             string           `json:"name,omitempty"`
 	Size             uint64           `json:"size,omitempty"`
+	Description      string           `json:"description,omitempty"`
 	ModTime          *time.Time       `json:"lastModifiedDatetime,omitempty"`
 	Parent           *DriveItemParent `json:"parentReference,omitempty"`
 	Folder           *Folder          `json:"folder,omitempty"`
+	Bundle           *Bundle          `json:"bundle,omitempty"`
 	File             *File            `json:"file,omitempty"`
+	Image            *Image           `json:"image,omitempty"`
+	Photo            *Photo           `json:"photo,omitempty"`
+	SharepointIDs    *SharepointIDs   `json:"sharepointIds,omitempty"`
 	Deleted          *Deleted         `json:"deleted,omitempty"`
 	ConflictBehavior string           `json:"@microsoft.graph.conflictBehavior,omitempty"`
 	ETag             string           `json:"eTag,omitempty"`
+	// unlike the eTag, only changes when the item's content does
+	CTag string `json:"cTag,omitempty"`
+	// only sent when explicitly requested, see GetItemDownloadURL()
+	DownloadURL string `json:"@microsoft.graph.downloadUrl,omitempty"`
 }
 
 // IsDir returns if the DriveItem represents a directory or not
 func (d *DriveItem) IsDir() bool {
-	return d.Folder != nil
+	return d.Folder != nil || d.Bundle != nil
+}
+
+// IsBundle returns if the DriveItem is a bundle (like a photo album). Bundles
+// can be browsed like directories, but their children are references to items
+// that live elsewhere, so nothing can be created in them directly.
+func (d *DriveItem) IsBundle() bool {
+	return d.Bundle != nil
 }
 
 // ModTimeUnix returns the modification time as a unix uint64 time
@@ -80,9 +141,58 @@ func (d *DriveItem) ModTimeUnix() uint64 {
 	return uint64(d.ModTime.Unix())
 }
 
+// driveItemFields are the fields of a DriveItem that we actually use. Only these
+// are requested from the server to keep responses small, so this must be kept
+// in sync with the DriveItem struct. The exceptions are sharepointIds (see
+// sharepointFields), and ConflictBehavior and DownloadURL, which are not item
+// fields but instructions to and annotations from the server.
+const driveItemFields = "id,name,size,description,lastModifiedDateTime," +
+	"parentReference,folder,bundle,file,image,photo,deleted,eTag,cTag"
+
+// sharepointFields are only requested from drives that have them, since
+// personal drives don't.
+const sharepointFields = ",sharepointIds"
+
+var selectSharepoint int32
+
+// SelectSharepointIDs sets whether SharepointIDs are requested along with the
+// rest of an item's fields. They should only be requested from business drives
+// and document libraries.
+func SelectSharepointIDs(enable bool) {
+	var value int32
+	if enable {
+		value = 1
+	}
+	atomic.StoreInt32(&selectSharepoint, value)
+}
+
+// withSelect limits the fields returned by a request for DriveItems to the
+// ones we use.
+func withSelect(resource string) string {
+	separator := "?"
+	if strings.Contains(resource, "?") {
+		separator = "&"
+	}
+	fields := driveItemFields
+	if atomic.LoadInt32(&selectSharepoint) == 1 {
+		fields += sharepointFields
+	}
+	return resource + separator + "$select=" + fields
+}
+
+// withCount asks for the total number of children to be sent along with the
+// first page of a children listing.
+func withCount(resource string) string {
+	separator := "?"
+	if strings.Contains(resource, "?") {
+		separator = "&"
+	}
+	return resource + separator + "$count=true"
+}
+
 // getItem is the internal method used to lookup items
 func getItem(path string, auth *Auth) (*DriveItem, error) {
-	body, err := Get(path, auth)
+	body, err := Get(withSelect(path), auth)
 	if err != nil {
 		return nil, err
 	}
@@ -103,19 +213,45 @@ func GetItem(id string, auth *Auth) (*DriveItem, error) {
 
 // GetItemChild fetches the named child of an item.
 func GetItemChild(id string, name string, auth *Auth) (*DriveItem, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		// these would address something other than a child of the item
+		return nil, fmt.Errorf("invalid child name %q", name)
+	}
 	return getItem(
 		fmt.Sprintf("%s:/%s", IDPath(id), url.PathEscape(name)),
 		auth,
 	)
 }
 
+// GetItemDownloadURL fetches a pre-authenticated URL that an item's content can
+// be downloaded from without a token (from GET /me/drive/items/{id} with
+// "$select=id,@microsoft.graph.downloadUrl"). The URL only works for a short
+// while, typically an hour, so it should be fetched right before it is used and
+// never stored. Folders do not have one.
+func GetItemDownloadURL(id string, auth *Auth) (string, error) {
+	body, err := Get(IDPath(id)+"?$select=id,@microsoft.graph.downloadUrl", auth)
+	if err != nil {
+		return "", err
+	}
+	item := DriveItem{}
+	if err = json.Unmarshal(body, &item); err != nil {
+		return "", err
+	}
+	if item.DownloadURL == "" {
+		return "", errors.New("server did not return a download URL")
+	}
+	return item.DownloadURL, nil
+}
+
 // GetItemPath fetches a DriveItem by path. Only used in special cases, like for the
 // root item.
 func GetItemPath(path string, auth *Auth) (*DriveItem, error) {
 	return getItem(ResourcePath(path), auth)
 }
 
-// GetItemContent retrieves an item's content from the Graph endpoint.
+// GetItemContent retrieves an item's content from the Graph endpoint. The whole
+// file is held in memory, so GetItemContentStream is a better fit for anything
+// that might be large.
 func GetItemContent(id string, auth *Auth) ([]byte, uint64, error) {
 	buf := bytes.NewBuffer(make([]byte, 0))
 	n, err := GetItemContentStream(id, auth, buf)
@@ -133,14 +269,14 @@ func GetItemContentStream(id string, auth *Auth, output io.Writer) (uint64, erro
 		return 0, err
 	}
 
-	const downloadChunkSize = 10 * 1024 * 1024
 	downloadURL := fmt.Sprintf("/me/drive/items/%s/content", id)
 	if item.Size <= downloadChunkSize {
 		// simple one-shot download
-		content, err := Get(downloadURL, auth)
+		content, header, err := request(downloadURL, auth, "GET", nil)
 		if err != nil {
 			return 0, err
 		}
+		checkDownloadName(item, header)
 		n, err := output.Write(content)
 		return uint64(n), err
 	}
@@ -154,13 +290,16 @@ func GetItemContentStream(id string, auth *Auth, output io.Writer) (uint64, erro
 			Str("id", item.ID).
 			Str("name", item.Name).
 			Msgf("Downloading bytes %d-%d/%d.", start, end, item.Size)
-		content, err := Get(downloadURL, auth, Header{
+		content, header, err := request(downloadURL, auth, "GET", nil, Header{
 			key:   "Range",
 			value: fmt.Sprintf("bytes=%d-%d", start, end),
 		})
 		if err != nil {
 			return n, err
 		}
+		if i == 0 {
+			checkDownloadName(item, header)
+		}
 		written, err := output.Write(content)
 		n += uint64(written)
 		if err != nil {
@@ -175,6 +314,114 @@ func GetItemContentStream(id string, auth *Auth, output io.Writer) (uint64, erro
 	return n, nil
 }
 
+// GetItemContentRange downloads length bytes of an item's content starting at
+// offset, without fetching the rest of it. Fewer bytes are returned if the
+// range runs past the end of the file.
+func GetItemContentRange(id string, offset uint64, length uint64, auth *Auth) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+	return Get(fmt.Sprintf("/me/drive/items/%s/content", id), auth, Header{
+		key:   "Range",
+		value: fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+	})
+}
+
+// DownloadToFile downloads an item's content to a file at destPath. If destPath
+// already holds the start of the file (like from an interrupted download), only
+// the remaining bytes are fetched. The finished file is verified against the
+// hash reported by the server.
+func DownloadToFile(id string, destPath string, auth *Auth) error {
+	item, err := GetItem(id, auth)
+	if err != nil {
+		return err
+	}
+	if item.IsDir() {
+		return errors.New("cannot download a directory")
+	}
+
+	file, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := uint64(stat.Size())
+	if offset > item.Size {
+		// not a partial copy of this file, start over
+		if err = file.Truncate(0); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	if _, err = file.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	if offset > 0 {
+		log.Info().
+			Str("id", item.ID).
+			Str("name", item.Name).
+			Str("path", destPath).
+			Msgf("Resuming download at byte %d/%d.", offset, item.Size)
+	}
+
+	downloadURL := fmt.Sprintf("/me/drive/items/%s/content", id)
+	for offset < item.Size {
+		end := offset + downloadChunkSize - 1
+		if end >= item.Size {
+			end = item.Size - 1
+		}
+		content, err := Get(downloadURL, auth, Header{
+			key:   "Range",
+			value: fmt.Sprintf("bytes=%d-%d", offset, end),
+		})
+		if err != nil {
+			return err
+		}
+		if len(content) == 0 {
+			return errors.New("server returned no content for requested range")
+		}
+		written, err := file.Write(content)
+		offset += uint64(written)
+		if err != nil {
+			return err
+		}
+	}
+
+	if item.HasHashes() && !item.VerifyStream(file) {
+		return fmt.Errorf("checksum of %s did not match after download", destPath)
+	}
+	return nil
+}
+
+// checkDownloadName compares the filename from a download's Content-Disposition
+// header against the name of the item we meant to download. A mismatch means
+// that the ID resolved to something other than what we looked up (like after a
+// concurrent remote rename). This is purely informational.
+func checkDownloadName(item *DriveItem, header http.Header) bool {
+	disposition := header.Get("Content-Disposition")
+	if disposition == "" {
+		return true
+	}
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil || params["filename"] == "" {
+		return true
+	}
+	if params["filename"] != item.Name {
+		log.Warn().
+			Str("id", item.ID).
+			Str("name", item.Name).
+			Str("downloadName", params["filename"]).
+			Msg("Downloaded file name did not match the requested item, " +
+				"it may have been renamed or replaced during the download.")
+		return false
+	}
+	return true
+}
+
 // Remove removes a directory or file by ID
 func Remove(id string, auth *Auth) error {
 	return Delete("/me/drive/items/"+id, auth)
@@ -223,37 +470,174 @@ func Rename(itemID string, itemName string, parentID string, auth *Auth) error {
 	return err
 }
 
+// SetDescription sets the description of an item. An empty description clears
+// it. No other fields of the item are modified.
+func SetDescription(id string, description string, auth *Auth) error {
+	// DriveItem can't be used here, omitempty would drop an empty description
+	jsonPatch, _ := json.Marshal(map[string]string{"description": description})
+	_, err := Patch("/me/drive/items/"+id, auth, bytes.NewReader(jsonPatch))
+	return err
+}
+
 // only used for parsing
 type driveChildren struct {
 	Children []*DriveItem `json:"value"`
 	NextLink string       `json:"@odata.nextLink"`
+	Count    *int         `json:"@odata.count"` // nil if the server didn't say
 }
 
+// parseChildren parses a page of children. Items without a name occasionally
+// show up (usually shared or system items), and are dropped since there is no
+// way to represent them in a directory listing.
+func parseChildren(body []byte) (driveChildren, error) {
+	var page driveChildren
+	if err := json.Unmarshal(body, &page); err != nil {
+		return page, err
+	}
+	named := make([]*DriveItem, 0, len(page.Children))
+	for _, child := range page.Children {
+		if child.Name == "" {
+			log.Warn().
+				Str("id", child.ID).
+				Msg("Server returned an item with no name, skipping it.")
+			continue
+		}
+		named = append(named, child)
+	}
+	page.Children = named
+	return page, nil
+}
+
+// a directory would need this many pages of children (200 items each by
+// default) before we assume the server is sending us in circles
+const maxChildrenPages = 10000
+
 // this is the internal method that actually fetches an item's children
 func getItemChildren(pollURL string, auth *Auth) ([]*DriveItem, error) {
+	return collectChildren(withCount(pollURL), func(url string) ([]byte, error) {
+		return Get(url, auth)
+	})
+}
+
+// collectChildren follows the pages of a children listing using get. Children
+// are de-duplicated by ID, and we bail out if the server sends us the same
+// nextLink twice or an absurd number of pages. If the server says how many
+// children there are, the result is sized for them up front.
+func collectChildren(pollURL string, get func(string) ([]byte, error)) ([]*DriveItem, error) {
+	return collectChildrenUntil(pollURL, get, nil)
+}
+
+// collectChildrenUntil is collectChildren, except that no more pages are
+// fetched once stop returns true for the last child on a page. stop is called
+// for every child, in order, and may be nil.
+func collectChildrenUntil(pollURL string, get func(string) ([]byte, error),
+	stop func(*DriveItem) bool) ([]*DriveItem, error) {
 	fetched := make([]*DriveItem, 0)
-	for pollURL != "" {
-		body, err := Get(pollURL, auth)
+	count := -1
+	seen := make(map[string]bool)
+	visited := make(map[string]bool)
+	for pages := 0; pollURL != ""; pages++ {
+		if visited[pollURL] || pages >= maxChildrenPages {
+			log.Error().
+				Str("url", pollURL).
+				Int("pages", pages).
+				Msg("Server pagination is not advancing, giving up on remaining pages.")
+			break
+		}
+		visited[pollURL] = true
+
+		body, err := get(pollURL)
 		if err != nil {
 			return fetched, err
 		}
-		var pollResult driveChildren
-		json.Unmarshal(body, &pollResult)
+		pollResult, _ := parseChildren(body)
+		if pollResult.Count != nil && count < 0 {
+			count = *pollResult.Count
+			// a bogus count shouldn't make us allocate a huge slice
+			if count > cap(fetched) && count <= maxChildrenPages*200 {
+				sized := make([]*DriveItem, len(fetched), count)
+				copy(sized, fetched)
+				fetched = sized
+			}
+		}
 
 		// there can be multiple pages of 200 items each (default).
 		// continue to next interation if we have an @odata.nextLink value
-		fetched = append(fetched, pollResult.Children...)
+		stopped := false
+		for _, child := range pollResult.Children {
+			if !seen[child.ID] {
+				seen[child.ID] = true
+				fetched = append(fetched, child)
+			}
+			if stop != nil {
+				stopped = stop(child)
+			}
+		}
 		pollURL = strings.TrimPrefix(pollResult.NextLink, GraphURL)
+		if stopped {
+			break
+		}
+	}
+	if count >= 0 && count != len(fetched) && pollURL == "" {
+		// nameless and duplicate children are dropped, so this can be expected
+		log.Debug().
+			Int("count", count).
+			Int("fetched", len(fetched)).
+			Msg("Number of children fetched did not match the count from the server.")
 	}
 	return fetched, nil
 }
 
 // GetItemChildren fetches all children of an item denoted by ID.
 func GetItemChildren(id string, auth *Auth) ([]*DriveItem, error) {
-	return getItemChildren(childrenPathID(id), auth)
+	return getItemChildren(withSelect(childrenPathID(id)), auth)
+}
+
+// GetItemChildrenSince fetches the children of an item that were modified after
+// since, which is a lot less to fetch than all of them for a large directory
+// where little has changed. Deleted children do not show up, only delta can
+// tell about those.
+func GetItemChildrenSince(id string, since time.Time, auth *Auth) ([]*DriveItem, error) {
+	pollURL := withCount(withSelect(
+		childrenPathID(id) + "?$orderby=lastModifiedDateTime%20desc"))
+	return collectChildrenSince(pollURL, since, func(url string) ([]byte, error) {
+		return Get(url, auth)
+	})
+}
+
+// collectChildrenSince follows a children listing sorted newest first, and stops
+// fetching pages once it gets to children older than since. Not every drive
+// sorts the way it was asked to, and if the listing turns out not to be sorted,
+// every page is fetched instead.
+func collectChildrenSince(pollURL string, since time.Time, get func(string) ([]byte, error)) ([]*DriveItem, error) {
+	var previous *time.Time
+	sorted := true
+	fetched, err := collectChildrenUntil(pollURL, get, func(child *DriveItem) bool {
+		if child.ModTime == nil {
+			return false
+		}
+		if previous != nil && child.ModTime.After(*previous) {
+			if sorted {
+				log.Debug().Str("url", pollURL).
+					Msg("Children were not sorted by modification time, fetching all of them.")
+			}
+			sorted = false
+		}
+		previous = child.ModTime
+		return sorted && !child.ModTime.After(since)
+	})
+
+	changed := make([]*DriveItem, 0)
+	for _, child := range fetched {
+		// no mtime means we can't tell, so it is treated as changed
+		if child.ModTime == nil || child.ModTime.After(since) {
+			changed = append(changed, child)
+		}
+	}
+	return changed, err
 }
 
 // GetItemChildrenPath fetches all children of an item denoted by path.
 func GetItemChildrenPath(path string, auth *Auth) ([]*DriveItem, error) {
-	return getItemChildren(childrenPath(path), auth)
+	return getItemChildren(withSelect(childrenPath(path)), auth)
 }
@@ -1,9 +1,17 @@
 package graph
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetItem(t *testing.T) {
@@ -17,3 +25,177 @@ func TestGetItem(t *testing.T) {
 	_, err = GetItemPath("/lkjfsdlfjdwjkfl", &auth)
 	assert.Error(t, err, "We didn't return an error for a non-existent item!")
 }
+
+// The Content-Disposition filename should be compared against the item name,
+// including names encoded as per RFC 5987.
+func TestCheckDownloadName(t *testing.T) {
+	t.Parallel()
+	item := &DriveItem{ID: "abc", Name: "résumé.txt"}
+	header := http.Header{}
+	assert.True(t, checkDownloadName(item, header), "Missing header is not a mismatch.")
+
+	header.Set("Content-Disposition", `attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`)
+	assert.True(t, checkDownloadName(item, header))
+
+	header.Set("Content-Disposition", `attachment; filename="other.txt"`)
+	assert.False(t, checkDownloadName(item, header))
+}
+
+// Partially downloaded files should be resumed, and the result should be
+// identical to the original.
+func TestDownloadToFileResume(t *testing.T) {
+	t.Parallel()
+	var auth Auth
+	auth.FromFile(".auth_tokens.json")
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	resp, err := Put(
+		ResourcePath("/onedriver_tests/download_resume.txt")+":/content",
+		&auth,
+		bytes.NewReader(content),
+	)
+	require.NoError(t, err)
+	item := DriveItem{}
+	require.NoError(t, json.Unmarshal(resp, &item))
+
+	dest := filepath.Join(os.TempDir(), "onedriver_download_resume.txt")
+	defer os.Remove(dest)
+	require.NoError(t, ioutil.WriteFile(dest, content[:10], 0644))
+	require.NoError(t, DownloadToFile(item.ID, dest, &auth))
+	downloaded, _ := ioutil.ReadFile(dest)
+	assert.Equal(t, content, downloaded)
+}
+
+// A nameless item in a page of children should be dropped without affecting the
+// rest of the listing.
+func TestParseChildrenNameless(t *testing.T) {
+	t.Parallel()
+	page, err := parseChildren([]byte(`{"value": [
+		{"id": "a", "name": "first.txt", "file": {}},
+		{"id": "b", "name": "", "file": {}},
+		{"id": "c", "file": {}},
+		{"id": "d", "name": "second", "folder": {}}
+	]}`))
+	require.NoError(t, err)
+	require.Len(t, page.Children, 2)
+	assert.Equal(t, "first.txt", page.Children[0].Name)
+	assert.Equal(t, "second", page.Children[1].Name)
+}
+
+// Bundles like photo albums come with a bundle facet instead of a folder facet,
+// and should still be browsable.
+func TestDriveItemBundleIsDir(t *testing.T) {
+	t.Parallel()
+	var item DriveItem
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"id": "album",
+		"name": "Vacation",
+		"bundle": {"childCount": 3, "album": {}}
+	}`), &item))
+	assert.True(t, item.IsDir())
+	assert.True(t, item.IsBundle())
+	assert.Equal(t, uint32(3), item.Bundle.ChildCount)
+}
+
+// A server that keeps sending the same nextLink should not make us loop forever
+// or produce duplicate children.
+func TestCollectChildrenRepeatedNextLink(t *testing.T) {
+	t.Parallel()
+	requests := 0
+	children, err := collectChildren("/page", func(url string) ([]byte, error) {
+		requests++
+		return []byte(`{
+			"value": [{"id": "a", "name": "a.txt"}, {"id": "b", "name": "b.txt"}],
+			"@odata.nextLink": "` + GraphURL + `/page"
+		}`), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Len(t, children, 2)
+}
+
+// The count the server sends with the first page should size the listing, and
+// listings without one should still work.
+func TestCollectChildrenCount(t *testing.T) {
+	t.Parallel()
+	pages := map[string]string{
+		"/first": `{
+			"value": [{"id": "a", "name": "a.txt"}],
+			"@odata.count": 3,
+			"@odata.nextLink": "` + GraphURL + `/second"
+		}`,
+		"/second": `{"value": [{"id": "b", "name": "b.txt"}, {"id": "c", "name": "c.txt"}]}`,
+	}
+	get := func(url string) ([]byte, error) {
+		return []byte(pages[url]), nil
+	}
+	children, err := collectChildren("/first", get)
+	require.NoError(t, err)
+	assert.Len(t, children, 3)
+	assert.Equal(t, 3, cap(children))
+
+	children, err = collectChildren("/second", get)
+	require.NoError(t, err)
+	assert.Len(t, children, 2)
+}
+
+func TestWithSelect(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "/me/drive/root?$select="+driveItemFields, withSelect("/me/drive/root"))
+	assert.Equal(t,
+		"/me/drive/root/children?$top=10&$select="+driveItemFields,
+		withSelect("/me/drive/root/children?$top=10"),
+	)
+}
+
+// sharepointIds should only be selected once we know the drive has them. Not
+// parallel, since this changes what every request selects.
+func TestSelectSharepointIDs(t *testing.T) {
+	SelectSharepointIDs(true)
+	defer SelectSharepointIDs(false)
+	assert.Equal(t, "/me/drive/root?$select="+driveItemFields+",sharepointIds",
+		withSelect("/me/drive/root"))
+}
+
+// Listings sorted newest first should stop once they get to older children, and
+// ones that aren't sorted should be fetched in full.
+func TestCollectChildrenSince(t *testing.T) {
+	t.Parallel()
+	since := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	child := func(id string, modTime string) string {
+		return `{"id": "` + id + `", "name": "` + id + `.txt", "lastModifiedDateTime": "` +
+			modTime + `"}`
+	}
+	sorted := map[string]string{
+		"/first": `{"value": [` + child("a", "2021-06-03T00:00:00Z") + `, ` +
+			child("b", "2021-06-02T00:00:00Z") + `], "@odata.nextLink": "` + GraphURL + `/second"}`,
+		"/second": `{"value": [` + child("c", "2021-06-01T12:00:00Z") + `, ` +
+			child("d", "2021-05-01T00:00:00Z") + `], "@odata.nextLink": "` + GraphURL + `/third"}`,
+		"/third": `{"value": [` + child("e", "2021-04-01T00:00:00Z") + `]}`,
+	}
+	requests := 0
+	children, err := collectChildrenSince("/first", since, func(url string) ([]byte, error) {
+		requests++
+		return []byte(sorted[url]), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests, "Pages after the first old child should not be fetched.")
+	ids := make([]string, 0)
+	for _, child := range children {
+		ids = append(ids, child.ID)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, ids)
+
+	unsorted := map[string]string{
+		"/first": `{"value": [` + child("d", "2021-05-01T00:00:00Z") + `, ` +
+			child("a", "2021-06-03T00:00:00Z") + `], "@odata.nextLink": "` + GraphURL + `/second"}`,
+		"/second": `{"value": [` + child("c", "2021-06-01T12:00:00Z") + `]}`,
+	}
+	requests = 0
+	children, err = collectChildrenSince("/first", since, func(url string) ([]byte, error) {
+		requests++
+		return []byte(unsorted[url]), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests, "Unsorted listings should be fetched in full.")
+	assert.Len(t, children, 2)
+}
@@ -4,14 +4,20 @@
 package graph
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/imdario/mergo"
@@ -21,6 +27,14 @@ import (
 // GraphURL is the API endpoint of Microsoft Graph
 const GraphURL = "https://graph.microsoft.com/v1.0"
 
+// HTTPClient makes every request to the server, including the ones to log in.
+// It can be replaced before any requests are made, like to use a fake
+// transport in tests or a custom one when embedding this package. SetTimeouts()
+// and SetProxy() only work if its transport is an *http.Transport. It has a transport
+// of its own, so that configuring it leaves http.DefaultTransport (and whatever
+// else in the program uses it) alone.
+var HTTPClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+
 // graphError is an internal struct used when decoding Graph's error messages
 type graphError struct {
 	Error struct {
@@ -29,6 +43,115 @@ type graphError struct {
 	} `json:"error"`
 }
 
+// error codes OneDrive uses to tell us to slow down, regardless of HTTP status
+var throttleCodes = map[string]bool{
+	"activityLimitReached": true,
+	"throttledRequest":     true,
+	"tooManyRequests":      true,
+}
+
+const (
+	minThrottleBackoff = 2 * time.Second
+	maxThrottleBackoff = 5 * time.Minute
+)
+
+// throttle tracks the cooldown that applies to all requests after the server
+// has told us that we are making too many of them.
+var throttle struct {
+	sync.Mutex
+	until   time.Time
+	backoff time.Duration
+}
+
+// RequestStats counts the requests made to the Graph API since startup.
+type RequestStats struct {
+	Requests  uint64 `json:"requests"`
+	Errors    uint64 `json:"errors"`
+	Throttled uint64 `json:"throttled"`
+	// requests that had to wait for others to finish, see SetMaxRequests()
+	Queued     uint64        `json:"queued"`
+	QueuedTime time.Duration `json:"queuedTime"`
+}
+
+var requestStats RequestStats
+
+// ErrPaused is returned instead of making a request while requests are paused.
+// IsOffline() treats it like any other network failure.
+var ErrPaused = errors.New("requests to the server are paused")
+
+var paused int32
+
+// SetPaused stops (or allows again) all requests to the server. Requests in
+// progress are not interrupted.
+func SetPaused(pause bool) {
+	var value int32
+	if pause {
+		value = 1
+	}
+	atomic.StoreInt32(&paused, value)
+}
+
+// IsPaused returns whether requests to the server are paused.
+func IsPaused() bool {
+	return atomic.LoadInt32(&paused) == 1
+}
+
+// GetRequestStats returns a snapshot of the request counters.
+func GetRequestStats() RequestStats {
+	return RequestStats{
+		Requests:   atomic.LoadUint64(&requestStats.Requests),
+		Errors:     atomic.LoadUint64(&requestStats.Errors),
+		Throttled:  atomic.LoadUint64(&requestStats.Throttled),
+		Queued:     atomic.LoadUint64(&requestStats.Queued),
+		QueuedTime: time.Duration(atomic.LoadInt64(&queuedNanos)),
+	}
+}
+
+// throttleWait blocks until any active cooldown has elapsed.
+func throttleWait() {
+	throttle.Lock()
+	wait := time.Until(throttle.until)
+	throttle.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// throttleBackoff starts (or lengthens) a cooldown. The server's Retry-After
+// value is used if present, otherwise the backoff doubles each time.
+func throttleBackoff(retryAfter string) time.Duration {
+	throttle.Lock()
+	defer throttle.Unlock()
+	if throttle.backoff == 0 {
+		throttle.backoff = minThrottleBackoff
+	} else if throttle.backoff < maxThrottleBackoff {
+		throttle.backoff *= 2
+	}
+	backoff := throttle.backoff
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		backoff = time.Duration(seconds) * time.Second
+	}
+	throttle.until = time.Now().Add(backoff)
+	return backoff
+}
+
+// throttleReset clears the backoff after a request goes through normally.
+func throttleReset() {
+	throttle.Lock()
+	throttle.backoff = 0
+	throttle.Unlock()
+}
+
+// isThrottled checks a response for any of the ways the server tells us to
+// slow down. Normal responses are only parsed if they look like an error.
+func isThrottled(status int, body []byte) (bool, graphError) {
+	var gerr graphError
+	if status >= 400 || bytes.HasPrefix(bytes.TrimSpace(body), []byte(`{"error"`)) {
+		json.Unmarshal(body, &gerr)
+	}
+	return status == 429 || throttleCodes[gerr.Error.Code], gerr
+}
+
 // This is an additional header that can be specified to Request
 type Header struct {
 	key, value string
@@ -36,16 +159,37 @@ type Header struct {
 
 // Request performs an authenticated request to Microsoft Graph
 func Request(resource string, auth *Auth, method string, content io.Reader, headers ...Header) ([]byte, error) {
+	body, _, err := request(resource, auth, method, content, headers...)
+	return body, err
+}
+
+// request is the same as Request, but also returns the response headers
+func request(resource string, auth *Auth, method string, content io.Reader, headers ...Header) ([]byte, http.Header, error) {
+	atomic.AddUint64(&requestStats.Requests, 1)
+	body, header, err := sendRequest(resource, auth, method, content, headers...)
+	if err != nil {
+		atomic.AddUint64(&requestStats.Errors, 1)
+	}
+	return body, header, err
+}
+
+// sendRequest does the actual work of request
+func sendRequest(resource string, auth *Auth, method string, content io.Reader, headers ...Header) ([]byte, http.Header, error) {
+	if IsPaused() {
+		// this also keeps auth tokens from being refreshed
+		return nil, nil, ErrPaused
+	}
 	if auth == nil || auth.AccessToken == "" {
 		// a catch all condition to avoid wiping our auth by accident
 		log.Error().Msg("Auth was empty and we attempted to make a request with it!")
-		return nil, errors.New("cannot make a request with empty auth")
+		return nil, nil, errors.New("cannot make a request with empty auth")
 	}
 
 	auth.Refresh()
 
-	client := &http.Client{Timeout: 60 * time.Second}
+	client := HTTPClient
 	request, _ := http.NewRequest(method, GraphURL+resource, content)
+	LimitUpload(request)
 	request.Header.Add("Authorization", "bearer "+auth.AccessToken)
 	switch method { // request type-specific code here
 	case "PATCH":
@@ -57,16 +201,48 @@ func Request(resource string, auth *Auth, method string, content io.Reader, head
 		request.Header.Add("Content-Type", "text/plain")
 	}
 	for _, header := range headers {
+		if header.value == "" && strings.HasPrefix(header.key, "If-") {
+			// some items have no eTag, and an empty condition is a 400 rather
+			// than no condition at all
+			continue
+		}
 		request.Header.Add(header.key, header.value)
 	}
 
-	response, err := client.Do(request)
+	// uploading content is the only thing done with a PUT
+	pool := slotsFor(method == "PUT")
+	throttleWait()
+	response, body, err := send(client, request, pool)
 	if err != nil {
 		// the actual request failed
-		return nil, err
+		return nil, nil, err
 	}
-	body, _ := ioutil.ReadAll(response.Body)
-	response.Body.Close()
+
+	if throttled, gerr := isThrottled(response.StatusCode, body); throttled {
+		atomic.AddUint64(&requestStats.Throttled, 1)
+		backoff := throttleBackoff(response.Header.Get("Retry-After"))
+		log.Warn().
+			Int("status", response.StatusCode).
+			Str("code", gerr.Error.Code).
+			Str("message", gerr.Error.Message).
+			Msgf("Server is throttling requests, backing off for %s.", backoff)
+		if content != nil {
+			// request body has already been consumed, caller needs to retry
+			return nil, nil, fmt.Errorf("HTTP %d - %s: %s",
+				response.StatusCode, gerr.Error.Code, gerr.Error.Message)
+		}
+		throttleWait()
+		response, body, err = send(client, request, pool)
+		if err != nil {
+			return nil, nil, err
+		}
+		if throttled, gerr = isThrottled(response.StatusCode, body); throttled {
+			throttleBackoff(response.Header.Get("Retry-After"))
+			return nil, nil, fmt.Errorf("HTTP %d - %s: %s",
+				response.StatusCode, gerr.Error.Code, gerr.Error.Message)
+		}
+	}
+	throttleReset()
 
 	if response.StatusCode == 401 {
 		var err graphError
@@ -77,28 +253,39 @@ func Request(resource string, auth *Auth, method string, content io.Reader, head
 			Msg("Authentication token invalid or new app permissions required, " +
 				"forcing reauth before retrying.")
 
-		reauth := newAuth(auth.AuthConfig, auth.path, false)
+		reauth := reauthenticate(auth)
 		mergo.Merge(auth, reauth, mergo.WithOverride)
+		auth.path = reauth.path
 		request.Header.Set("Authorization", "bearer "+auth.AccessToken)
 	}
 	if response.StatusCode >= 500 || response.StatusCode == 401 {
 		// the onedrive API is having issues, retry once
-		response, err = client.Do(request)
+		response, body, err = send(client, request, pool)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		body, _ = ioutil.ReadAll(response.Body)
-		response.Body.Close()
 	}
 
 	if response.StatusCode >= 400 {
 		// something was wrong with the request
 		var err graphError
 		json.Unmarshal(body, &err)
-		return nil, fmt.Errorf("HTTP %d - %s: %s",
+		return nil, nil, fmt.Errorf("HTTP %d - %s: %s",
 			response.StatusCode, err.Error.Code, err.Error.Message)
 	}
-	return body, nil
+	return body, response.Header, nil
+}
+
+// send makes a single attempt at a request and reads its response, holding
+// one of pool's slots for as long as that takes.
+func send(client *http.Client, request *http.Request, pool *slots) (*http.Response, []byte, error) {
+	release := pool.acquire()
+	defer release()
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	return response, readLimited(response), nil
 }
 
 // Get is a convenience wrapper around Request
@@ -127,6 +314,31 @@ func Delete(resource string, auth *Auth, headers ...Header) error {
 	return err
 }
 
+// CancelUploadSession deletes an upload session along with anything uploaded
+// to it so far, with a DELETE on the uploadUrl returned by createUploadSession.
+// Upload URLs are pre-authenticated and are not on the Graph host, so they are
+// used as-is and no token is sent. Graph has no endpoint that lists a drive's
+// upload sessions, so callers have to keep track of the URLs themselves.
+// Sessions that are already gone are not an error.
+func CancelUploadSession(uploadURL string) error {
+	if IsPaused() {
+		return ErrPaused
+	}
+	request, err := http.NewRequest("DELETE", uploadURL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 400 && response.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("HTTP %d - could not cancel upload session", response.StatusCode)
+	}
+	return nil
+}
+
 // IDPath computes the resource path for an item by ID
 func IDPath(id string) string {
 	if id == "root" {
@@ -135,8 +347,18 @@ func IDPath(id string) string {
 	return "/me/drive/items/" + url.PathEscape(id)
 }
 
+// cleanPath normalizes an item's path so that odd sequences of FUSE calls
+// cannot produce a malformed Graph URL: duplicate and trailing slashes are
+// removed, "." and ".." are resolved, and the result is always absolute. Like
+// the kernel does, ".." at the root stays at the root, so a path can never point
+// outside of the drive.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
 // ResourcePath translates an item's path to the proper path used by Graph
 func ResourcePath(path string) string {
+	path = cleanPath(path)
 	if path == "/" {
 		return "/me/drive/root"
 	}
@@ -145,7 +367,7 @@ func ResourcePath(path string) string {
 
 // ChildrenPath returns the path to an item's children
 func childrenPath(path string) string {
-	if path == "/" {
+	if cleanPath(path) == "/" {
 		return ResourcePath(path) + "/children"
 	}
 	return ResourcePath(path) + ":/children"
@@ -192,14 +414,59 @@ type Drive struct {
 	Quota     DriveQuota `json:"quota,omitempty"`
 }
 
-// GetDrive is used to fetch the details of the user's OneDrive.
+// GetDrive is used to fetch the details of the user's OneDrive. The drive is
+// remembered for auth, so that it is never switched to fallback tokens for some
+// other drive.
 func GetDrive(auth *Auth) (Drive, error) {
 	resp, err := Get("/me/drive", auth)
 	drive := Drive{}
 	if err != nil {
 		return drive, err
 	}
-	return drive, json.Unmarshal(resp, &drive)
+	if err = json.Unmarshal(resp, &drive); err == nil && auth != nil {
+		auth.driveID = drive.ID
+	}
+	return drive, err
+}
+
+// IsMalwareDetected checks if an error from Request() means that the server
+// refused to hand over an item's content because it thinks it contains malware.
+func IsMalwareDetected(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "malwareDetected")
+}
+
+// IsQuotaExceeded checks if an error means that the drive is out of space,
+// which the server signals with HTTP 507 or a quota error code.
+func IsQuotaExceeded(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "HTTP 507") ||
+		strings.Contains(msg, "quotaLimitReached") ||
+		strings.Contains(msg, "insufficientStorage")
+}
+
+// error codes the server uses when it does not recognize an item ID
+var unknownIDCodes = []string{"itemNotFound", "invalidResourceId", "malformedId"}
+
+// IsUnknownID checks if an error from Request() means that the server does not
+// know about the item ID used in the request (like when a cached ID has gone
+// stale).
+func IsUnknownID(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, "HTTP 404 - ") {
+		return true
+	}
+	for _, code := range unknownIDCodes {
+		if strings.Contains(msg, " - "+code+":") {
+			return true
+		}
+	}
+	return false
 }
 
 // IsOffline checks if an error string from Request() is indicative of being offline.
@@ -212,3 +479,132 @@ func IsOffline(err error) bool {
 	rexp := regexp.MustCompile("HTTP [0-9]+ - ")
 	return !rexp.MatchString(err.Error())
 }
+
+const (
+	// DefaultConnectTimeout is how long connecting to the server (including the
+	// TLS handshake) may take.
+	DefaultConnectTimeout = 15 * time.Second
+	// DefaultHeaderTimeout is how long the server may take to start responding
+	// to a request once it has been sent.
+	DefaultHeaderTimeout = 60 * time.Second
+)
+
+func init() {
+	SetTimeouts(0, 0) // can't fail, HTTPClient starts out with an *http.Transport
+}
+
+// SetTimeouts configures how long connecting to the server and waiting for
+// the start of its response may take, zero meaning the default. There is no
+// limit on how long the rest of a response may take, so that big downloads
+// and directory listings over slow connections aren't cut off partway
+// through.
+func SetTimeouts(connect time.Duration, header time.Duration) error {
+	transport := httpTransport()
+	if transport == nil {
+		return errors.New("HTTPClient does not support timeouts")
+	}
+	if connect <= 0 {
+		connect = DefaultConnectTimeout
+	}
+	if header <= 0 {
+		header = DefaultHeaderTimeout
+	}
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connect,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = connect
+	transport.ResponseHeaderTimeout = header
+	return nil
+}
+
+// ParseProxy checks that a proxy is a URL like "http://proxy.example.com:3128".
+func ParseProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+	}
+	return proxyURL, nil
+}
+
+// SetProxy sends every request made through HTTPClient through a proxy (see
+// ParseProxy). Nothing else in the program is affected, so each mount can have
+// its own. An empty proxy goes back to the default of using the one from
+// $HTTPS_PROXY, if any.
+func SetProxy(proxy string) error {
+	transport := httpTransport()
+	if transport == nil {
+		return errors.New("HTTPClient does not support proxies")
+	}
+	if proxy == "" {
+		transport.Proxy = http.ProxyFromEnvironment
+		return nil
+	}
+	proxyURL, err := ParseProxy(proxy)
+	if err != nil {
+		return err
+	}
+	transport.Proxy = http.ProxyURL(proxyURL)
+	return nil
+}
+
+// DefaultOnlineCheck is what CheckOnline() requests unless SetOnlineCheck() was
+// given something else.
+const DefaultOnlineCheck = GraphURL + "/"
+
+var onlineCheck atomic.Value // string, empty for DefaultOnlineCheck
+
+// SetOnlineCheck changes the URL CheckOnline() requests, for networks where
+// being able to reach some other host (like an internal one that is only up
+// when the proxy to OneDrive is) is a better sign of being online. An empty URL
+// goes back to DefaultOnlineCheck.
+func SetOnlineCheck(check string) error {
+	if check != "" {
+		checkURL, err := url.Parse(check)
+		if err != nil || (checkURL.Scheme != "http" && checkURL.Scheme != "https") ||
+			checkURL.Host == "" {
+			return fmt.Errorf("invalid online check URL %q", check)
+		}
+	}
+	onlineCheck.Store(check)
+	return nil
+}
+
+// CheckOnline makes a request to the online check URL (see SetOnlineCheck) to
+// see if the network is up. Any response counts, even an error, since the host
+// had to be reachable to send it.
+func CheckOnline() error {
+	if IsPaused() {
+		return ErrPaused
+	}
+	check, _ := onlineCheck.Load().(string)
+	if check == "" {
+		check = DefaultOnlineCheck
+	}
+	request, err := http.NewRequest("HEAD", check, nil)
+	if err != nil {
+		return err
+	}
+	response, err := HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// ResetConnections drops any idle connections to the server, so the next
+// request opens a fresh one. Connections kept open across a suspend/resume
+// cycle or a network change are usually dead, and would otherwise only be
+// discovered by requests failing.
+func ResetConnections() {
+	HTTPClient.CloseIdleConnections()
+}
+
+// httpTransport returns the transport used by HTTPClient, or nil if it is not
+// one that can be configured. A client without a transport of its own would
+// use http.DefaultTransport, which is not ours to configure.
+func httpTransport() *http.Transport {
+	transport, _ := HTTPClient.Transport.(*http.Transport)
+	return transport
+}
@@ -1,6 +1,11 @@
 package graph
 
 import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +21,31 @@ func TestResourcePath(t *testing.T) {
 	)
 }
 
+// Paths should be normalized before being turned into a URL.
+func TestResourcePathNormalized(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "/me/drive/root", ResourcePath(""))
+	assert.Equal(t, "/me/drive/root", ResourcePath("//"))
+	assert.Equal(t, "/me/drive/root", ResourcePath("/a/.."))
+	assert.Equal(t, "/me/drive/root:%2Fa%2Fb", ResourcePath("/a/b/"))
+	assert.Equal(t, "/me/drive/root:%2Fa%2Fb", ResourcePath("//a//./b"))
+	assert.Equal(t, "/me/drive/root:%2Fa", ResourcePath("a"))
+	assert.Equal(t, "/me/drive/root:%2Fb", ResourcePath("/a/../b"))
+	assert.Equal(t, "/me/drive/root:%2Fb", ResourcePath("/../../b"),
+		"Paths should not be able to escape the root.")
+
+	assert.Equal(t, "/me/drive/root/children", childrenPath("/a/../"))
+	assert.Equal(t, "/me/drive/root:%2Fa:/children", childrenPath("/a/"))
+}
+
+func TestGetItemChildInvalidName(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		_, err := GetItemChild("root", name, nil)
+		assert.Error(t, err, "%q should not be accepted as a child name", name)
+	}
+}
+
 func TestRequestUnauthenticated(t *testing.T) {
 	t.Parallel()
 	badAuth := &Auth{
@@ -26,3 +56,227 @@ func TestRequestUnauthenticated(t *testing.T) {
 	_, err := Get("/me/drive/root", badAuth)
 	assert.Error(t, err, "An unauthenticated request was not handled as an error")
 }
+
+// Throttling can be signalled by error codes, even without an HTTP 429.
+func TestIsThrottled(t *testing.T) {
+	t.Parallel()
+	throttled, _ := isThrottled(429, nil)
+	assert.True(t, throttled)
+
+	throttled, gerr := isThrottled(200,
+		[]byte(`{"error": {"code": "activityLimitReached", "message": "slow down"}}`))
+	assert.True(t, throttled)
+	assert.Equal(t, "slow down", gerr.Error.Message)
+
+	throttled, _ = isThrottled(400, []byte(`{"error": {"code": "invalidRequest"}}`))
+	assert.False(t, throttled)
+
+	throttled, _ = isThrottled(200, []byte(`{"id": "error"}`))
+	assert.False(t, throttled)
+}
+
+func TestIsUnknownID(t *testing.T) {
+	t.Parallel()
+	assert.True(t, IsUnknownID(errors.New("HTTP 404 - itemNotFound: Item does not exist")))
+	assert.True(t, IsUnknownID(errors.New("HTTP 400 - invalidResourceId: Invalid ID")))
+	assert.False(t, IsUnknownID(errors.New("HTTP 400 - invalidRequest: bad")))
+	assert.False(t, IsUnknownID(nil))
+}
+
+func TestIsQuotaExceeded(t *testing.T) {
+	t.Parallel()
+	assert.True(t, IsQuotaExceeded(errors.New(
+		"small upload failed: HTTP 507 - insufficientStorage: Insufficient Space Available",
+	)))
+	assert.True(t, IsQuotaExceeded(errors.New(
+		`error uploading chunk - HTTP 507: {"error":{"code":"quotaLimitReached"}}`,
+	)))
+	assert.False(t, IsQuotaExceeded(errors.New("HTTP 400 - invalidRequest: bad")))
+	assert.False(t, IsQuotaExceeded(nil))
+}
+
+func TestIsMalwareDetected(t *testing.T) {
+	t.Parallel()
+	assert.True(t, IsMalwareDetected(errors.New(
+		"HTTP 403 - malwareDetected: Malicious software was detected in the requested resource.",
+	)))
+	assert.False(t, IsMalwareDetected(errors.New("HTTP 403 - accessDenied: nope")))
+	assert.False(t, IsMalwareDetected(nil))
+}
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+	var l limiter
+	start := time.Now()
+	l.wait(1 << 20)
+	assert.True(t, time.Since(start) < 10*time.Millisecond, "Unlimited transfers should not wait.")
+
+	l.set(1 << 20)
+	start = time.Now()
+	l.wait(1 << 18)
+	l.wait(1 << 18)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 450*time.Millisecond && elapsed < time.Second,
+		"Transferring 512KiB at 1MiB/s took %s.", elapsed)
+}
+
+// Requests over the limit should queue until an earlier one is finished.
+func TestSlots(t *testing.T) {
+	t.Parallel()
+	s := newSlots()
+	s.set(1)
+	release := s.acquire()
+	queued := GetRequestStats().Queued
+
+	acquired := make(chan func())
+	go func() { acquired <- s.acquire() }()
+	select {
+	case <-acquired:
+		t.Fatal("Second request should have waited for the first one.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release()
+	release() // giving a slot back twice should not free up another one
+	select {
+	case second := <-acquired:
+		defer second()
+	case <-time.After(time.Second):
+		t.Fatal("Second request was never let through.")
+	}
+	s.Lock()
+	assert.Equal(t, 1, s.inUse)
+	s.Unlock()
+	assert.True(t, GetRequestStats().Queued > queued, "Queued request was not counted.")
+}
+
+// Uploads should only get their own limit if one is set. Not parallel, since
+// the limits apply to every other request.
+func TestSlotsFor(t *testing.T) {
+	defer SetMaxRequests(0, 0)
+	SetMaxRequests(4, 0)
+	assert.Same(t, requestSlots, slotsFor(true))
+	SetMaxRequests(4, 1)
+	assert.Same(t, uploadSlots, slotsFor(true))
+	assert.Same(t, requestSlots, slotsFor(false))
+}
+
+// Rates should be averaged over the last few full seconds, and drop back to 0
+// once a transfer stops.
+func TestRateMeter(t *testing.T) {
+	t.Parallel()
+	var m rateMeter
+	start := time.Unix(1000, 0)
+	for i := 0; i < rateWindow; i++ {
+		m.add(1000, start.Add(time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, uint64(0), m.rate(start), "Nothing should be counted yet.")
+	assert.Equal(t, uint64(800), m.rate(start.Add((rateWindow-1)*time.Second)),
+		"The second in progress should not count towards the average.")
+	assert.Equal(t, uint64(1000), m.rate(start.Add(rateWindow*time.Second)))
+	assert.Equal(t, uint64(0), m.rate(start.Add(3*rateWindow*time.Second)),
+		"Old transfers should not count.")
+}
+
+// Requests made while paused should fail right away, the same way as when
+// offline. Not parallel, since pausing affects every other request.
+func TestPaused(t *testing.T) {
+	SetPaused(true)
+	defer SetPaused(false)
+	_, err := Get("/me/drive/root", nil)
+	assert.Equal(t, ErrPaused, err)
+	assert.True(t, IsOffline(err))
+}
+
+// roundTripFunc is a fake transport for HTTPClient.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestParseProxy(t *testing.T) {
+	t.Parallel()
+	proxy, err := ParseProxy("http://proxy.example.com:3128")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "proxy.example.com:3128", proxy.Host)
+	}
+	_, err = ParseProxy("proxy.example.com:3128")
+	assert.Error(t, err, "Proxies need a scheme.")
+}
+
+// The online check should pass as long as its host answers at all. Not parallel,
+// since the online check URL is shared.
+func TestCheckOnline(t *testing.T) {
+	defer SetOnlineCheck("")
+	assert.Error(t, SetOnlineCheck("intranet.example.com"), "URLs need a scheme.")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	assert.NoError(t, SetOnlineCheck(server.URL))
+	assert.NoError(t, CheckOnline())
+
+	server.Close()
+	assert.Error(t, CheckOnline(), "Should be offline once the host is gone.")
+}
+
+// Configuring HTTPClient should not change the transport the rest of the
+// program uses.
+func TestSetTimeoutsOwnTransport(t *testing.T) {
+	defer SetTimeouts(0, 0)
+	assert.NoError(t, SetTimeouts(time.Second, 2*time.Second))
+	assert.Equal(t, 2*time.Second, httpTransport().ResponseHeaderTimeout)
+	assert.Zero(t, http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout)
+}
+
+// A proxy should only apply to our own requests, not to every other HTTP client
+// in the program.
+func TestSetProxyOwnTransport(t *testing.T) {
+	defer SetProxy("")
+	assert.NoError(t, SetProxy("http://proxy.example.com:3128"))
+	request, _ := http.NewRequest("GET", GraphURL, nil)
+
+	proxy, err := httpTransport().Proxy(request)
+	if assert.NoError(t, err) && assert.NotNil(t, proxy) {
+		assert.Equal(t, "proxy.example.com:3128", proxy.Host)
+	}
+	proxy, _ = http.DefaultTransport.(*http.Transport).Proxy(request)
+	if proxy != nil {
+		assert.NotEqual(t, "proxy.example.com:3128", proxy.Host)
+	}
+}
+
+// Requests should go through HTTPClient, so it can be swapped out. Not
+// parallel, since every other request would go through the fake too.
+func TestHTTPClient(t *testing.T) {
+	original := HTTPClient
+	defer func() { HTTPClient = original }()
+	var sent *http.Request
+	HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent = r
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(`{"id": "fake"}`)),
+		}, nil
+	})}
+	assert.Error(t, SetTimeouts(0, 0), "Fake transports can't have timeouts.")
+
+	fakeAuth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+	body, err := Get("/me/drive/root", fakeAuth)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id": "fake"}`, string(body))
+	if assert.NotNil(t, sent) {
+		assert.Equal(t, GraphURL+"/me/drive/root", sent.URL.String())
+		assert.Equal(t, "bearer token", sent.Header.Get("Authorization"))
+	}
+
+	// items without an eTag should not turn into an empty condition
+	_, err = Get("/me/drive/root", fakeAuth, Header{key: "If-None-Match", value: ""})
+	assert.NoError(t, err)
+	if assert.NotNil(t, sent) {
+		_, exists := sent.Header["If-None-Match"]
+		assert.False(t, exists)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync/atomic"
 
 	"github.com/jstaf/onedriver/fs/graph/quickxorhash"
 )
@@ -65,6 +66,135 @@ func (d *DriveItem) VerifyChecksum(checksum string) bool {
 	return strings.EqualFold(d.File.Hashes.QuickXorHash, checksum)
 }
 
+// kinds of hashes, see SetPreferredHash()
+const (
+	HashQuickXor = "quickxor"
+	HashSHA256   = "sha256"
+	HashSHA1     = "sha1"
+)
+
+var preferredHash atomic.Value // string, empty for the usual order
+
+// SetPreferredHash makes one kind of hash be checked before the others
+// whenever the server provides it. This is for the odd business tenant that
+// sends QuickXorHashes which don't match the content, but gets another kind
+// right. An empty kind goes back to the usual order.
+func SetPreferredHash(kind string) error {
+	switch kind {
+	case "", HashQuickXor, HashSHA256, HashSHA1:
+		preferredHash.Store(kind)
+		return nil
+	}
+	return fmt.Errorf("unknown kind of hash %q, must be one of %s, %s or %s",
+		kind, HashQuickXor, HashSHA256, HashSHA1)
+}
+
+func getPreferredHash() string {
+	kind, _ := preferredHash.Load().(string)
+	return kind
+}
+
+// hashOrder is the order kinds of hashes are checked in: QuickXorHash (which
+// every drive type has nowadays), SHA256, then SHA1, unless another kind is
+// preferred.
+func hashOrder() []string {
+	order := []string{HashQuickXor, HashSHA256, HashSHA1}
+	preferred := getPreferredHash()
+	if preferred == "" {
+		return order
+	}
+	sorted := []string{preferred}
+	for _, kind := range order {
+		if kind != preferred {
+			sorted = append(sorted, kind)
+		}
+	}
+	return sorted
+}
+
+// get returns the hash of one kind, or an empty string if there isn't one.
+func (h Hashes) get(kind string) string {
+	switch kind {
+	case HashQuickXor:
+		return h.QuickXorHash
+	case HashSHA256:
+		return h.SHA256Hash
+	case HashSHA1:
+		return h.SHA1Hash
+	}
+	return ""
+}
+
+// hashStream computes one kind of hash of a stream.
+func hashStream(kind string, reader io.ReadSeeker) string {
+	switch kind {
+	case HashSHA256:
+		return SHA256HashStream(reader)
+	case HashSHA1:
+		return SHA1HashStream(reader)
+	}
+	return QuickXORHashStream(reader)
+}
+
+// LocalHashes computes the hashes kept for content written locally: the
+// QuickXorHash that uploads are checked with, plus the preferred kind of hash
+// if it is a different one.
+func LocalHashes(reader io.ReadSeeker) Hashes {
+	hashes := Hashes{QuickXorHash: QuickXORHashStream(reader)}
+	switch getPreferredHash() {
+	case HashSHA256:
+		hashes.SHA256Hash = SHA256HashStream(reader)
+	case HashSHA1:
+		hashes.SHA1Hash = SHA1HashStream(reader)
+	}
+	return hashes
+}
+
+// Compare checks two sets of hashes against each other using the first kind of
+// hash that both have, in the order from hashOrder(). ok is false if they have
+// no kind of hash in common, in which case nothing can be said about whether
+// they match. It is also false if only one of them has the preferred kind,
+// since the other kinds are what can't be trusted.
+func (h Hashes) Compare(other Hashes) (equal bool, ok bool) {
+	preferred := getPreferredHash()
+	for _, kind := range hashOrder() {
+		mine, theirs := h.get(kind), other.get(kind)
+		if mine != "" && theirs != "" {
+			return strings.EqualFold(mine, theirs), true
+		}
+		if kind == preferred && (mine != "" || theirs != "") {
+			return false, false
+		}
+	}
+	return false, false
+}
+
+// HasHashes returns true if the server gave us any kind of hash for the item's
+// content. A few kinds of items (usually ones without an eTag either) have
+// none, and their content cannot be verified at all.
+func (d *DriveItem) HasHashes() bool {
+	if d.File == nil {
+		return false
+	}
+	hashes := d.File.Hashes
+	return hashes.QuickXorHash != "" || hashes.SHA256Hash != "" || hashes.SHA1Hash != ""
+}
+
+// VerifyStream checks a stream against whichever hash the server gave us for
+// the item, in the same order of preference as Compare(). Only the one hash is
+// computed. Items without any hashes never match.
+func (d *DriveItem) VerifyStream(reader io.ReadSeeker) bool {
+	if d.File == nil {
+		return false
+	}
+	for _, kind := range hashOrder() {
+		if hash := d.File.Hashes.get(kind); hash != "" {
+			return strings.EqualFold(hash, hashStream(kind, reader))
+		}
+	}
+	return false
+}
+
 // ETagIsMatch returns true if the etag matches the one in the DriveItem
 func (d *DriveItem) ETagIsMatch(etag string) bool {
 	return d.ETag != "" && d.ETag == etag
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -81,3 +82,77 @@ func TestHashSeekPosition(t *testing.T) {
 	assert.Equal(t, SHA1Hash(&content), SHA1HashStream(tmp))
 	assert.Equal(t, SHA256Hash(&content), SHA256HashStream(tmp))
 }
+
+// Whichever hash both sides have should be used, instead of giving up when the
+// preferred one is missing.
+func TestHashesCompare(t *testing.T) {
+	t.Parallel()
+	content := []byte("some content to compare")
+	all := Hashes{
+		QuickXorHash: QuickXORHash(&content),
+		SHA256Hash:   SHA256Hash(&content),
+		SHA1Hash:     SHA1Hash(&content),
+	}
+
+	equal, ok := all.Compare(Hashes{SHA1Hash: strings.ToLower(all.SHA1Hash)})
+	assert.True(t, ok)
+	assert.True(t, equal, "Hashes should be compared case-insensitively.")
+
+	equal, ok = all.Compare(Hashes{SHA256Hash: SHA1Hash(&content)})
+	assert.True(t, ok)
+	assert.False(t, equal)
+
+	_, ok = Hashes{SHA1Hash: all.SHA1Hash}.Compare(Hashes{QuickXorHash: all.QuickXorHash})
+	assert.False(t, ok, "Hashes with nothing in common cannot be compared.")
+}
+
+func TestVerifyStreamFallback(t *testing.T) {
+	t.Parallel()
+	content := []byte("some content to verify")
+	reader := bytes.NewReader(content)
+
+	item := DriveItem{File: &File{Hashes: Hashes{SHA1Hash: SHA1Hash(&content)}}}
+	assert.True(t, item.VerifyStream(reader))
+	item.File.Hashes = Hashes{SHA256Hash: SHA256Hash(&content)}
+	assert.True(t, item.VerifyStream(reader))
+	item.File.Hashes.SHA256Hash = "nope"
+	assert.False(t, item.VerifyStream(reader))
+
+	assert.False(t, (&DriveItem{File: &File{}}).VerifyStream(reader),
+		"Items without hashes should never match.")
+	assert.False(t, (&DriveItem{}).VerifyStream(reader))
+
+	assert.True(t, item.HasHashes())
+	assert.False(t, (&DriveItem{File: &File{}}).HasHashes())
+	assert.False(t, (&DriveItem{}).HasHashes())
+}
+
+// A preferred kind of hash should be checked first whenever it is there, even if
+// the QuickXorHash is wrong. Not parallel, since this changes how every hash is
+// checked.
+func TestPreferredHash(t *testing.T) {
+	assert.Error(t, SetPreferredHash("md5"))
+	assert.NoError(t, SetPreferredHash(HashSHA1))
+	defer SetPreferredHash("")
+
+	content := []byte("some content with a bad quickxorhash")
+	reader := bytes.NewReader(content)
+	item := DriveItem{File: &File{Hashes: Hashes{
+		QuickXorHash: "bad",
+		SHA1Hash:     SHA1Hash(&content),
+	}}}
+	assert.True(t, item.VerifyStream(reader))
+
+	local := LocalHashes(reader)
+	assert.Equal(t, QuickXORHash(&content), local.QuickXorHash)
+	assert.Equal(t, item.File.Hashes.SHA1Hash, local.SHA1Hash)
+	equal, ok := item.File.Hashes.Compare(local)
+	assert.True(t, ok)
+	assert.True(t, equal)
+
+	_, ok = item.File.Hashes.Compare(Hashes{QuickXorHash: local.QuickXorHash})
+	assert.False(t, ok, "Only one side has the preferred hash, so it must be computed.")
+
+	item.File.Hashes.SHA1Hash = ""
+	assert.False(t, item.VerifyStream(reader), "Other hashes are still used without it.")
+}
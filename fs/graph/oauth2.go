@@ -10,6 +10,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/imdario/mergo"
@@ -23,6 +24,7 @@ const (
 	authCodeURL     = "https://login.microsoftonline.com/common/oauth2/v2.0/authorize"
 	authTokenURL    = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
 	authRedirectURL = "https://login.live.com/oauth20_desktop.srf"
+	authScopes      = "user.read files.readwrite.all offline_access"
 )
 
 func (a *AuthConfig) applyDefaults() error {
@@ -31,6 +33,7 @@ func (a *AuthConfig) applyDefaults() error {
 		CodeURL:     authCodeURL,
 		TokenURL:    authTokenURL,
 		RedirectURL: authRedirectURL,
+		Scopes:      authScopes,
 	})
 }
 
@@ -40,6 +43,9 @@ type AuthConfig struct {
 	CodeURL     string `json:"codeURL" yaml:"codeURL"`
 	TokenURL    string `json:"tokenURL" yaml:"tokenURL"`
 	RedirectURL string `json:"redirectURL" yaml:"redirectURL"`
+	// space-separated list of OAuth2 scopes to request, offline_access is
+	// required to be able to refresh tokens
+	Scopes string `json:"scopes" yaml:"scopes"`
 }
 
 // Auth represents a set of oauth2 authentication tokens
@@ -51,6 +57,7 @@ type Auth struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	path         string // auth tokens remember their path for use by Refresh()
+	driveID      string // the last drive GetDrive() found, see reauthenticate()
 }
 
 // AuthError is an authentication error from the Microsoft API. Generally we don't see
@@ -95,7 +102,7 @@ func (a *Auth) Refresh() {
 			"&redirect_uri=" + a.RedirectURL +
 			"&refresh_token=" + a.RefreshToken +
 			"&grant_type=refresh_token")
-		resp, err := http.Post(a.TokenURL,
+		resp, err := HTTPClient.Post(a.TokenURL,
 			"application/x-www-form-urlencoded",
 			postData)
 
@@ -124,22 +131,206 @@ func (a *Auth) Refresh() {
 				Bytes("response", body).
 				Int("http_code", resp.StatusCode).
 				Msg("Failed to renew access tokens. Attempting to reauthenticate.")
-			a = newAuth(a.AuthConfig, a.path, false)
+			reauth := reauthenticate(a)
+			mergo.Merge(a, reauth, mergo.WithOverride)
+			a.path = reauth.path
 		} else {
 			a.ToFile(a.path)
 		}
 	}
 }
 
+// renewAuth trades an auth's refresh token for new tokens. Unlike Refresh(),
+// it never prompts the user to log in again. ok is false if the server
+// rejected the refresh token.
+func renewAuth(auth *Auth) (renewed *Auth, ok bool, err error) {
+	resp, err := HTTPClient.PostForm(auth.TokenURL, url.Values{
+		"client_id":     {auth.ClientID},
+		"redirect_uri":  {auth.RedirectURL},
+		"refresh_token": {auth.RefreshToken},
+		"grant_type":    {"refresh_token"},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	fresh := *auth
+	fresh.AccessToken = ""
+	json.Unmarshal(body, &fresh)
+	if resp.StatusCode != http.StatusOK || fresh.AccessToken == "" {
+		return nil, false, nil
+	}
+	fresh.ExpiresAt = time.Now().Unix() + fresh.ExpiresIn
+	return &fresh, true, nil
+}
+
+// CurrentAuth loads the auth tokens at path for use by something other than
+// onedriver. If the access token expires within margin, the tokens are renewed
+// first and saved back to path. Like ValidateAuth(), this never prompts the
+// user to log in, and it is safe to use on the tokens of a running mount, which
+// keeps working with the tokens it already has.
+func CurrentAuth(path string, margin time.Duration) (*Auth, error) {
+	auth := &Auth{}
+	if err := auth.FromFile(path); err != nil {
+		return nil, err
+	}
+	if auth.RefreshToken == "" {
+		return nil, errors.New("no refresh token, log in again")
+	}
+	if time.Until(time.Unix(auth.ExpiresAt, 0)) > margin {
+		return auth, nil
+	}
+	renewed, ok, err := renewAuth(auth)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("tokens were rejected by the server, log in again")
+	}
+	return renewed, renewed.ToFile(path)
+}
+
+// ValidateAuth checks whether the auth tokens stored at path are still usable,
+// and which account they belong to. Unlike Refresh(), this never prompts the
+// user to log in again and only writes to path if expired tokens were
+// successfully renewed. valid is false if the server rejected the tokens, err
+// is only set if the check itself could not be completed (like when offline).
+func ValidateAuth(path string) (account string, valid bool, err error) {
+	auth := &Auth{}
+	if err = auth.FromFile(path); err != nil {
+		return "", false, err
+	}
+	if auth.AccessToken == "" || auth.RefreshToken == "" {
+		return auth.Account, false, nil
+	}
+
+	if auth.ExpiresAt <= time.Now().Unix() {
+		renewed, ok, err := renewAuth(auth)
+		if err != nil || !ok {
+			return auth.Account, false, err
+		}
+		auth = renewed
+		if err = auth.ToFile(path); err != nil {
+			return auth.Account, true, err
+		}
+	}
+
+	body, status, err := getWithoutReauth("/me", auth)
+	if err != nil {
+		return auth.Account, false, err
+	}
+	switch {
+	case status == http.StatusUnauthorized:
+		return auth.Account, false, nil
+	case status >= 400:
+		return auth.Account, false, fmt.Errorf("HTTP %d - %s", status, body)
+	}
+	user := User{}
+	if err = json.Unmarshal(body, &user); err != nil {
+		return auth.Account, false, err
+	}
+	return user.UserPrincipalName, true, nil
+}
+
+// getWithoutReauth makes a GET request with auth as-is. Request() reauthenticates
+// on a 401, which is no good when checking whether tokens work.
+func getWithoutReauth(resource string, auth *Auth) ([]byte, int, error) {
+	request, _ := http.NewRequest("GET", GraphURL+resource, nil)
+	request.Header.Add("Authorization", "bearer "+auth.AccessToken)
+	resp, err := HTTPClient.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return body, resp.StatusCode, nil
+}
+
+// fallbackAuth are auth token files to switch to instead of asking the user to
+// log in again, see SetFallbackAuth()
+var fallbackAuth struct {
+	sync.Mutex
+	paths []string
+}
+
+// SetFallbackAuth sets auth token files to switch to when the tokens in use are
+// rejected for good, so that a mount nobody is watching keeps working instead
+// of waiting for someone to log in again. They are tried in order, and the
+// first that still works is used from then on. Tokens for a different drive
+// than the one already in use are skipped.
+func SetFallbackAuth(paths []string) {
+	fallbackAuth.Lock()
+	defer fallbackAuth.Unlock()
+	fallbackAuth.paths = paths
+}
+
+// reauthenticate gets new tokens to replace auth's, which the server has
+// rejected. The fallback auth files are tried first, and the user is only asked
+// to log in again if none of them work. The result keeps the path its tokens
+// should be saved to.
+func reauthenticate(auth *Auth) *Auth {
+	if fallback := useFallbackAuth(auth); fallback != nil {
+		return fallback
+	}
+	fresh := newAuth(auth.AuthConfig, auth.path, false)
+	fresh.path = auth.path
+	fresh.driveID = auth.driveID
+	return fresh
+}
+
+// useFallbackAuth returns the first of the fallback auth files whose tokens work
+// and reach the same drive as auth, or nil if none of them do.
+func useFallbackAuth(auth *Auth) *Auth {
+	fallbackAuth.Lock()
+	paths := fallbackAuth.paths
+	fallbackAuth.Unlock()
+
+	for _, path := range paths {
+		if path == auth.path {
+			continue
+		}
+		ctx := log.With().Str("path", path).Logger()
+		candidate, err := CurrentAuth(path, 0)
+		if err != nil {
+			ctx.Warn().Err(err).Msg("Could not use fallback auth tokens.")
+			continue
+		}
+		body, status, err := getWithoutReauth("/me/drive", candidate)
+		if err != nil || status >= 400 {
+			ctx.Warn().Err(err).Int("status", status).Msg("Fallback auth tokens do not work.")
+			continue
+		}
+		drive := Drive{}
+		json.Unmarshal(body, &drive)
+		if auth.driveID != "" && drive.ID != auth.driveID {
+			ctx.Warn().Str("driveID", drive.ID).
+				Msg("Fallback auth tokens are for a different drive, skipping them.")
+			continue
+		}
+		ctx.Warn().Str("account", candidate.Account).
+			Msg("Auth tokens were rejected, switching to fallback auth tokens.")
+		candidate.path = path
+		candidate.driveID = drive.ID
+		return candidate
+	}
+	return nil
+}
+
 // Get the appropriate authentication URL for the Graph OAuth2 challenge.
 func getAuthURL(a AuthConfig) string {
 	return a.CodeURL +
 		"?client_id=" + a.ClientID +
-		"&scope=" + url.PathEscape("user.read files.readwrite.all offline_access") +
+		"&scope=" + url.PathEscape(a.Scopes) +
 		"&response_type=code" +
 		"&redirect_uri=" + a.RedirectURL
 }
 
+// errNoBrowser means the built-in browser could not be shown, like when there is
+// no display to show it on or WebKit2GTK is broken.
+var errNoBrowser = errors.New("built-in browser could not be started")
+
 // getAuthCodeHeadless has the user perform authentication in their own browser
 // instead of WebKit2GTK and then input the auth code in the terminal.
 func getAuthCodeHeadless(a AuthConfig, accountName string) string {
@@ -168,16 +359,17 @@ func parseAuthCode(url string) (string, error) {
 }
 
 // Exchange an auth code for a set of access tokens (returned as a new Auth struct).
-func getAuthTokens(a AuthConfig, authCode string) *Auth {
+func getAuthTokens(a AuthConfig, authCode string) (*Auth, error) {
 	postData := strings.NewReader("client_id=" + a.ClientID +
 		"&redirect_uri=" + a.RedirectURL +
 		"&code=" + authCode +
 		"&grant_type=authorization_code")
-	resp, err := http.Post(a.TokenURL,
+	resp, err := HTTPClient.Post(a.TokenURL,
 		"application/x-www-form-urlencoded",
 		postData)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Could not POST to obtain auth tokens.")
+		log.Error().Err(err).Msg("Could not POST to obtain auth tokens.")
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -208,16 +400,16 @@ func getAuthTokens(a AuthConfig, authCode string) *Auth {
 				Err(err).
 				Logger()
 		}
-		fields.Fatal().Msg(
-			"Failed to retrieve access tokens. Authentication cannot continue.",
-		)
+		fields.Error().Msg("Failed to retrieve access tokens.")
+		return nil, fmt.Errorf("could not retrieve access tokens (HTTP %d)", resp.StatusCode)
 	}
-	return &auth
+	return &auth, nil
 }
 
 // newAuth performs initial authentication flow and saves tokens to disk. The headless
 // parameter determines if we will try to auth directly in the terminal instead of
-// doing it via embedded browser.
+// doing it via embedded browser. Builds without an embedded browser always auth in
+// the terminal, and so does everything else if the embedded browser can't start.
 func newAuth(config AuthConfig, path string, headless bool) *Auth {
 	// load the old account name
 	old := Auth{}
@@ -225,13 +417,18 @@ func newAuth(config AuthConfig, path string, headless bool) *Auth {
 
 	config.applyDefaults()
 	var code string
-	if headless {
+	var err error
+	if headless || !embeddedBrowser {
 		code = getAuthCodeHeadless(config, old.Account)
-	} else {
-		// in a build without CGO, this will be the same as above
-		code = getAuthCode(config, old.Account)
+	} else if code, err = getAuthCode(config, old.Account); err != nil {
+		log.Warn().Err(err).
+			Msg("Could not log in with the built-in browser, logging in through the terminal instead.")
+		code = getAuthCodeHeadless(config, old.Account)
+	}
+	auth, err := getAuthTokens(config, code)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Authentication cannot continue.")
 	}
-	auth := getAuthTokens(config, code)
 
 	if user, err := GetUser(auth); err == nil {
 		auth.Account = user.UserPrincipalName
@@ -240,6 +437,37 @@ func newAuth(config AuthConfig, path string, headless bool) *Auth {
 	return auth
 }
 
+// AuthURL is the URL a user has to visit to log in. After logging in, they are
+// redirected to a URL that can be passed to ReauthenticateWithURL().
+func AuthURL(config AuthConfig) string {
+	config.applyDefaults()
+	return getAuthURL(config)
+}
+
+// ReauthenticateWithURL finishes logging in with the URL a user was redirected
+// to after visiting AuthURL(). The new tokens replace the existing ones and are
+// saved to disk. Unlike Authenticate(), this never exits on failure, so it is
+// safe to use while the filesystem is mounted.
+func (a *Auth) ReauthenticateWithURL(redirect string) error {
+	code, err := parseAuthCode(redirect)
+	if err != nil {
+		return err
+	}
+	config := a.AuthConfig
+	config.applyDefaults()
+	auth, err := getAuthTokens(config, code)
+	if err != nil {
+		return err
+	}
+	auth.Account = a.Account
+	if user, err := GetUser(auth); err == nil {
+		auth.Account = user.UserPrincipalName
+	}
+	// only the tokens and account change, the same way as in reauthenticate()
+	mergo.Merge(a, auth, mergo.WithOverride)
+	return a.ToFile(a.path)
+}
+
 // Authenticate performs authentication to Graph or load auth/refreshes it
 // from an existing file. If headless is true, we will authenticate in the
 // terminal.
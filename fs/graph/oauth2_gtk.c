@@ -130,10 +130,28 @@ static void web_view_load_changed(WebKitWebView *web_view, WebKitLoadEvent load_
 }
 
 /**
- * Open a popup GTK auth window and return the final redirect location.
+ * Close the window if the web process behind it dies, it would stay blank forever
+ * otherwise.
+ */
+static void web_view_process_terminated(WebKitWebView *web_view,
+                                        WebKitWebProcessTerminationReason reason,
+                                        gboolean *failed) {
+    g_print("Webkit web process terminated (reason %d), giving up on the auth window.\n",
+            reason);
+    *failed = TRUE;
+    GtkWidget *parent = gtk_widget_get_parent(GTK_WIDGET(web_view));
+    gtk_widget_destroy(parent);
+}
+
+/**
+ * Open a popup GTK auth window and return the final redirect location. Returns
+ * NULL if the window could not be shown, or the browser in it crashed.
  */
 char *webkit_auth_window(char *auth_url, char *account_name) {
-    gtk_init(NULL, NULL);
+    if (!gtk_init_check(NULL, NULL)) {
+        g_print("Could not initialize GTK.\n");
+        return NULL;
+    }
     GtkWidget *auth_window = gtk_window_new(GTK_WINDOW_TOPLEVEL);
     if (account_name && strlen(account_name) > 0) {
         char title[512];
@@ -146,7 +164,13 @@ char *webkit_auth_window(char *auth_url, char *account_name) {
     }
 
     // create browser and add to gtk window
-    WebKitWebView *web_view = WEBKIT_WEB_VIEW(webkit_web_view_new());
+    GtkWidget *web_view_widget = webkit_web_view_new();
+    if (!web_view_widget) {
+        g_print("Could not create a WebKit web view.\n");
+        gtk_widget_destroy(auth_window);
+        return NULL;
+    }
+    WebKitWebView *web_view = WEBKIT_WEB_VIEW(web_view_widget);
     gtk_container_add(GTK_CONTAINER(auth_window), GTK_WIDGET(web_view));
     webkit_web_view_load_uri(web_view, auth_url);
 
@@ -156,6 +180,9 @@ char *webkit_auth_window(char *auth_url, char *account_name) {
                      &auth_redirect_value);
     g_signal_connect(web_view, "load-failed-with-tls-errors",
                      G_CALLBACK(web_view_load_failed_tls), NULL);
+    gboolean failed = FALSE;
+    g_signal_connect(web_view, "web-process-terminated",
+                     G_CALLBACK(web_view_process_terminated), &failed);
     g_signal_connect(auth_window, "destroy", G_CALLBACK(destroy_window), web_view);
 
     // show and grab focus
@@ -163,5 +190,8 @@ char *webkit_auth_window(char *auth_url, char *account_name) {
     gtk_widget_show_all(auth_window);
     gtk_main();
 
+    if (failed) {
+        return NULL;
+    }
     return strdup(auth_redirect_value);
 }
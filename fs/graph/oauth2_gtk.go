@@ -11,20 +11,32 @@ package graph
 import "C"
 
 import (
+	"fmt"
+	"os"
 	"unsafe"
 
 	"github.com/rs/zerolog/log"
 )
 
+// logging in can happen in a popup browser, unless --no-browser was given
+const embeddedBrowser = true
+
 // Fetch the auth code required as the first part of oauth2 authentication. Uses
-// webkit2gtk to create a popup browser.
-func getAuthCode(a AuthConfig, accountName string) string {
+// webkit2gtk to create a popup browser. Returns errNoBrowser if the browser
+// could not be shown, so that the caller can log in some other way.
+func getAuthCode(a AuthConfig, accountName string) (string, error) {
+	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return "", fmt.Errorf("%w: no display to show it on", errNoBrowser)
+	}
 	cAuthURL := C.CString(getAuthURL(a))
 	cAccountName := C.CString(accountName)
 	cResponse := C.webkit_auth_window(cAuthURL, cAccountName)
-	response := C.GoString(cResponse)
 	C.free(unsafe.Pointer(cAuthURL))
 	C.free(unsafe.Pointer(cAccountName))
+	if cResponse == nil {
+		return "", errNoBrowser
+	}
+	response := C.GoString(cResponse)
 	C.free(unsafe.Pointer(cResponse))
 
 	code, err := parseAuthCode(response)
@@ -33,7 +45,7 @@ func getAuthCode(a AuthConfig, accountName string) string {
 		log.Fatal().Msg("No validation code returned, or code was invalid. " +
 			"Please restart the application and try again.")
 	}
-	return code
+	return code, nil
 }
 
 // uriGetHost is exclusively here for testing because we cannot use CGo in tests,
@@ -3,7 +3,14 @@
 
 package graph
 
-// accountName arg is only present for compatibility with the non-headless C version.
-func getAuthCode(config AuthConfig, accountName string) string {
-	return getAuthCodeHeadless(config, accountName)
+// There is no built-in browser without cgo, since it needs WebKit2GTK. Logging
+// in always happens in the terminal instead, as if --no-browser was given, so
+// that onedriver can be built with CGO_ENABLED=0 and run on a server.
+const embeddedBrowser = false
+
+// getAuthCode is only here so newAuth compiles, and is never called when
+// embeddedBrowser is false. The accountName arg is only present for
+// compatibility with the non-headless C version.
+func getAuthCode(config AuthConfig, accountName string) (string, error) {
+	return getAuthCodeHeadless(config, accountName), nil
 }
@@ -0,0 +1,34 @@
+//go:build !linux || !cgo
+// +build !linux !cgo
+
+package graph
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Without cgo, logging in has to happen in the terminal whether or not
+// --no-browser was given.
+func TestGetAuthCodeHeadless(t *testing.T) {
+	assert.False(t, embeddedBrowser, "There is no browser to log in with in this build.")
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	fmt.Fprintln(w, "https://login.live.com/oauth20_desktop.srf?code=M.R3_BAY.abc-123&lc=1033")
+	w.Close()
+
+	config := AuthConfig{}
+	config.applyDefaults()
+	code, err := getAuthCode(config, "")
+	require.NoError(t, err)
+	assert.Equal(t, "M.R3_BAY.abc-123", code)
+}
@@ -1,6 +1,8 @@
 package graph
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -58,4 +60,85 @@ func TestAuthConfigMerge(t *testing.T) {
 	assert.NoError(t, testConfig.applyDefaults())
 	assert.Equal(t, "test", testConfig.RedirectURL)
 	assert.Equal(t, authClientID, testConfig.ClientID)
+	assert.Equal(t, authScopes, testConfig.Scopes)
+}
+
+func TestValidateAuth(t *testing.T) {
+	t.Parallel()
+	require.FileExists(t, ".auth_tokens.json")
+
+	account, valid, err := ValidateAuth(".auth_tokens.json")
+	require.NoError(t, err)
+	assert.True(t, valid, "Known good auth tokens were not valid.")
+	assert.NotEqual(t, "", account)
+
+	// tokens the server has never seen should be rejected, but should not count
+	// as a failure to perform the check
+	bogus := filepath.Join(os.TempDir(), "onedriver_bogus_auth.json")
+	defer os.Remove(bogus)
+	require.NoError(t, Auth{
+		AccessToken:  "not-a-token",
+		RefreshToken: "not-a-token",
+		ExpiresAt:    0,
+	}.ToFile(bogus))
+	_, valid, err = ValidateAuth(bogus)
+	assert.NoError(t, err)
+	assert.False(t, valid, "Bogus auth tokens were reported as valid.")
+}
+
+// Tokens should only be renewed when they are about to expire, and renewed
+// tokens should be saved.
+func TestCurrentAuth(t *testing.T) {
+	t.Parallel()
+	require.FileExists(t, ".auth_tokens.json")
+	var auth Auth
+	require.NoError(t, auth.FromFile(".auth_tokens.json"))
+
+	path := filepath.Join(os.TempDir(), "onedriver_current_auth.json")
+	defer os.Remove(path)
+	auth.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	require.NoError(t, auth.ToFile(path))
+	current, err := CurrentAuth(path, 5*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, auth.AccessToken, current.AccessToken,
+		"Tokens that are still good should be used as they are.")
+
+	auth.ExpiresAt = time.Now().Add(time.Minute).Unix()
+	require.NoError(t, auth.ToFile(path))
+	current, err = CurrentAuth(path, 5*time.Minute)
+	require.NoError(t, err)
+	assert.True(t, current.ExpiresAt > time.Now().Add(5*time.Minute).Unix(),
+		"Tokens about to expire should have been renewed.")
+
+	var saved Auth
+	require.NoError(t, saved.FromFile(path))
+	assert.Equal(t, current.AccessToken, saved.AccessToken)
+}
+
+// Rejected tokens should be replaced by the first fallback that works, as long
+// as it is for the same drive. Not parallel, since the fallbacks are global.
+func TestFallbackAuth(t *testing.T) {
+	require.FileExists(t, ".auth_tokens.json")
+	var auth Auth
+	require.NoError(t, auth.FromFile(".auth_tokens.json"))
+	drive, err := GetDrive(&auth)
+	require.NoError(t, err)
+
+	fallback := filepath.Join(os.TempDir(), "onedriver_fallback_auth.json")
+	defer os.Remove(fallback)
+	require.NoError(t, auth.ToFile(fallback))
+	missing := filepath.Join(os.TempDir(), "onedriver_missing_auth.json")
+	SetFallbackAuth([]string{missing, fallback})
+	defer SetFallbackAuth(nil)
+
+	rejected := &Auth{path: "rejected_auth.json", driveID: drive.ID}
+	replacement := useFallbackAuth(rejected)
+	require.NotNil(t, replacement, "Working fallback tokens were not used.")
+	assert.Equal(t, fallback, replacement.path)
+	assert.Equal(t, drive.ID, replacement.driveID)
+	assert.NotEqual(t, "", replacement.AccessToken)
+
+	rejected.driveID = "some-other-drive"
+	assert.Nil(t, useFallbackAuth(rejected),
+		"Fallback tokens for a different drive should not be used.")
 }
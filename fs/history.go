@@ -0,0 +1,123 @@
+package fs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// number of events kept in the history file, oldest are dropped first
+const maxHistory = 500
+
+// things that can happen to a file, as recorded in the history
+const (
+	historyUploaded   = "uploaded"
+	historyDownloaded = "downloaded"
+	historyDeleted    = "deleted"
+	historyConflict   = "conflict"
+)
+
+// HistoryEvent is something onedriver did to a file, as shown to the user. The
+// debug log has far more detail, this is just the outcome.
+type HistoryEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	ID     string    `json:"id"`
+	Path   string    `json:"path"`
+	// the change came from the server, rather than something done in the mount
+	Remote bool `json:"remote,omitempty"`
+}
+
+// history is a bounded log of recent HistoryEvents. It is kept in memory and
+// saved to the history file along with the status file.
+type history struct {
+	sync.Mutex
+	path   string
+	events []HistoryEvent
+	dirty  bool
+}
+
+// newHistory picks up where the history file at path left off.
+func newHistory(path string) *history {
+	events, _ := ReadHistory(path)
+	return &history{path: path, events: events}
+}
+
+func (h *history) record(action string, id string, path string, remote bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, HistoryEvent{
+		Time:   time.Now(),
+		Action: action,
+		ID:     id,
+		Path:   path,
+		Remote: remote,
+	})
+	if len(h.events) > maxHistory {
+		h.events = append([]HistoryEvent{}, h.events[len(h.events)-maxHistory:]...)
+	}
+	h.dirty = true
+}
+
+// since returns the events that happened after a point in time, oldest first.
+func (h *history) since(t time.Time) []HistoryEvent {
+	h.Lock()
+	defer h.Unlock()
+	out := make([]HistoryEvent, 0)
+	for _, event := range h.events {
+		if event.Time.After(t) {
+			out = append(out, event)
+		}
+	}
+	return out
+}
+
+// save writes the history file if anything happened since it was last saved.
+func (h *history) save() error {
+	h.Lock()
+	defer h.Unlock()
+	if !h.dirty {
+		return nil
+	}
+	contents, err := json.Marshal(h.events)
+	if err != nil {
+		return err
+	}
+	// written to a temp file and moved into place so that --history never sees
+	// half of a file
+	temp := h.path + ".tmp"
+	if err = ioutil.WriteFile(temp, contents, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(temp, h.path); err != nil {
+		return err
+	}
+	h.dirty = false
+	return nil
+}
+
+// ReadHistory reads a history file. It is safe to call while the filesystem is
+// mounted.
+func ReadHistory(path string) ([]HistoryEvent, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]HistoryEvent, 0)
+	err = json.Unmarshal(contents, &events)
+	return events, err
+}
+
+// HistoryPath is the location of the history file for a mount's cache
+// directory.
+func HistoryPath(cacheDir string) string {
+	return filepath.Join(cacheDir, "history.json")
+}
+
+// History returns what happened to files after a point in time, oldest first.
+func (f *Filesystem) History(since time.Time) []HistoryEvent {
+	return f.history.since(since)
+}
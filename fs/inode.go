@@ -3,7 +3,6 @@ package fs
 import (
 	"encoding/json"
 	"math/rand"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -29,15 +28,20 @@ type Inode struct {
 	hasChanges bool     // used to trigger an upload on flush
 	subdir     uint32   // used purely by NLink()
 	mode       uint32   // do not set manually
+
+	childrenFetched time.Time // when children were last fetched from the server
+	contentCTag     string    // server's cTag for the content in the cache
+	movedAt         time.Time // when the item was last renamed or moved locally
 }
 
 // SerializeableInode is like a Inode, but can be serialized for local storage
 // to disk
 type SerializeableInode struct {
 	graph.DriveItem
-	Children []string
-	Subdir   uint32
-	Mode     uint32
+	Children    []string
+	Subdir      uint32
+	Mode        uint32
+	ContentCTag string `json:",omitempty"`
 }
 
 // NewInode initializes a new Inode
@@ -72,10 +76,11 @@ func (i *Inode) AsJSON() []byte {
 	i.RLock()
 	defer i.RUnlock()
 	data, _ := json.Marshal(SerializeableInode{
-		DriveItem: i.DriveItem,
-		Children:  i.children,
-		Subdir:    i.subdir,
-		Mode:      i.mode,
+		DriveItem:   i.DriveItem,
+		Children:    i.children,
+		Subdir:      i.subdir,
+		Mode:        i.mode,
+		ContentCTag: i.contentCTag,
 	})
 	return data
 }
@@ -89,13 +94,21 @@ func NewInodeJSON(data []byte) (*Inode, error) {
 		return nil, err
 	}
 	return &Inode{
-		DriveItem: raw.DriveItem,
-		children:  raw.Children,
-		mode:      raw.Mode,
-		subdir:    raw.Subdir,
+		DriveItem:   raw.DriveItem,
+		children:    raw.Children,
+		mode:        raw.Mode,
+		subdir:      raw.Subdir,
+		contentCTag: raw.ContentCTag,
 	}, nil
 }
 
+// contentIsCurrent is true when the cTag shows that the cached content is the
+// same version as the server's, so it doesn't need to be hashed to find out.
+// The caller must hold the inode lock.
+func (i *Inode) contentIsCurrent() bool {
+	return i.contentCTag != "" && i.contentCTag == i.DriveItem.CTag
+}
+
 // NewInodeDriveItem creates a new Inode from a DriveItem
 func NewInodeDriveItem(item *graph.DriveItem) *Inode {
 	if item == nil {
@@ -204,6 +217,14 @@ func (i *Inode) HasChanges() bool {
 	return i.hasChanges
 }
 
+// recentlyMoved is true if the item was renamed or moved so recently that the
+// server might not show it yet.
+func (i *Inode) recentlyMoved() bool {
+	i.RLock()
+	defer i.RUnlock()
+	return time.Since(i.movedAt) < renameSettle
+}
+
 // HasChildren returns true if the item has more than 0 children
 func (i *Inode) HasChildren() bool {
 	i.RLock()
@@ -212,22 +233,24 @@ func (i *Inode) HasChildren() bool {
 }
 
 // makeattr is a convenience function to create a set of filesystem attrs for
-// use with syscalls that use or modify attrs.
-func (i *Inode) makeAttr() fuse.Attr {
-	mtime := i.ModTime()
+// use with syscalls that use or modify attrs. Times are truncated to precision.
+func (i *Inode) makeAttr(owner fuse.Owner, precision time.Duration) fuse.Attr {
+	i.RLock()
+	mtime := i.DriveItem.ModTime.Truncate(precision)
+	i.RUnlock()
+	secs, nsecs := uint64(mtime.Unix()), uint32(mtime.Nanosecond())
 	return fuse.Attr{
-		Ino:   i.NodeID(),
-		Size:  i.Size(),
-		Nlink: i.NLink(),
-		Ctime: mtime,
-		Mtime: mtime,
-		Atime: mtime,
-		Mode:  i.Mode(),
-		// whatever user is running the filesystem is the owner
-		Owner: fuse.Owner{
-			Uid: uint32(os.Getuid()),
-			Gid: uint32(os.Getgid()),
-		},
+		Ino:       i.NodeID(),
+		Size:      i.Size(),
+		Nlink:     i.NLink(),
+		Ctime:     secs,
+		Mtime:     secs,
+		Atime:     secs,
+		Ctimensec: nsecs,
+		Mtimensec: nsecs,
+		Atimensec: nsecs,
+		Mode:      i.Mode(),
+		Owner:     owner,
 	}
 }
 
@@ -237,15 +260,26 @@ func (i *Inode) IsDir() bool {
 	return i.Mode()&fuse.S_IFDIR > 0
 }
 
+// IsBundle returns true if the item is a bundle, like a photo album.
+func (i *Inode) IsBundle() bool {
+	i.RLock()
+	defer i.RUnlock()
+	return i.DriveItem.IsBundle()
+}
+
 // Mode returns the permissions/mode of the file.
 func (i *Inode) Mode() uint32 {
 	i.RLock()
 	defer i.RUnlock()
 	if i.mode == 0 { // only 0 if fetched from Graph API
+		var readOnly uint32
+		if i.DriveItem.IsBundle() {
+			readOnly = 0222
+		}
 		if i.DriveItem.IsDir() {
-			return fuse.S_IFDIR | 0755
+			return fuse.S_IFDIR | 0755&^readOnly
 		}
-		return fuse.S_IFREG | 0644
+		return fuse.S_IFREG | 0644&^readOnly
 	}
 	return i.mode
 }
@@ -3,6 +3,7 @@ package fs
 import (
 	"context"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -146,3 +147,60 @@ func TestDoubleCreate(t *testing.T) {
 		"IDs did not match when create run twice on same file.",
 	)
 }
+
+// Which version of an item's content is cached should survive a restart, and
+// content only counts as current while the cTag is unchanged.
+func TestContentCTag(t *testing.T) {
+	t.Parallel()
+	inode := NewInodeDriveItem(&graph.DriveItem{ID: "ctag-test", Name: "ctag.txt", CTag: "ctag-1"})
+	assert.False(t, inode.contentIsCurrent(), "Nothing has been cached yet.")
+	inode.contentCTag = "ctag-1"
+
+	restored, err := NewInodeJSON(inode.AsJSON())
+	require.NoError(t, err)
+	assert.True(t, restored.contentIsCurrent())
+
+	restored.DriveItem.CTag = "ctag-2"
+	assert.False(t, restored.contentIsCurrent(),
+		"Content should not be current once the server's content changes.")
+}
+
+// Files should be owned by whoever runs onedriver, unless told otherwise.
+func TestOwner(t *testing.T) {
+	t.Parallel()
+	filesystem := &Filesystem{}
+	inode := NewInode("owner.txt", 0644|fuse.S_IFREG, nil)
+	attr := inode.makeAttr(filesystem.owner(), filesystem.mtimePrecision())
+	assert.Equal(t, uint32(os.Getuid()), attr.Uid)
+	assert.Equal(t, uint32(os.Getgid()), attr.Gid)
+
+	uid, gid := uint32(1001), uint32(0)
+	filesystem.opts.UID, filesystem.opts.GID = &uid, &gid
+	attr = inode.makeAttr(filesystem.owner(), filesystem.mtimePrecision())
+	assert.Equal(t, uint32(1001), attr.Uid)
+	assert.Equal(t, uint32(0), attr.Gid, "Root's group should be usable too.")
+}
+
+// Reported and uploaded mtimes should be truncated to the same precision.
+func TestMtimePrecision(t *testing.T) {
+	t.Parallel()
+	filesystem := &Filesystem{}
+	inode := NewInode("mtime.txt", 0644|fuse.S_IFREG, nil)
+	mtime := time.Unix(1600000000, 123456789)
+	inode.DriveItem.ModTime = &mtime
+
+	attr := inode.makeAttr(filesystem.owner(), filesystem.mtimePrecision())
+	assert.Equal(t, uint64(1600000000), attr.Mtime)
+	assert.Equal(t, uint32(0), attr.Mtimensec, "Whole seconds should be the default.")
+
+	filesystem.opts.MtimePrecision = time.Millisecond
+	attr = inode.makeAttr(filesystem.owner(), filesystem.mtimePrecision())
+	assert.Equal(t, uint64(1600000000), attr.Mtime)
+	assert.Equal(t, uint32(123000000), attr.Mtimensec)
+
+	session, err := NewUploadSession(inode, &[]byte{})
+	require.NoError(t, err)
+	truncated := session.ModTime.Truncate(filesystem.mtimePrecision())
+	assert.Equal(t, int64(attr.Mtimensec), int64(truncated.Nanosecond()),
+		"Uploaded mtime should match the one that was reported.")
+}
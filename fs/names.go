@@ -0,0 +1,46 @@
+package fs
+
+import "strings"
+
+// characters that are allowed locally but not on OneDrive (other than "/")
+const restrictedChars = `"*:<>?\|`
+
+// restricted characters are mapped to this offset in the Unicode private use
+// area, which is what Samba's catia module and macOS's SMB client use
+const restrictedCharOffset = 0xF000
+
+var (
+	restrictedToRemote = newCharMapper(false)
+	restrictedToLocal  = newCharMapper(true)
+)
+
+func newCharMapper(toLocal bool) *strings.Replacer {
+	pairs := make([]string, 0, 2*len(restrictedChars))
+	for _, c := range restrictedChars {
+		local, remote := string(c), string(c+restrictedCharOffset)
+		if toLocal {
+			pairs = append(pairs, remote, local)
+		} else {
+			pairs = append(pairs, local, remote)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// remoteName translates a name from the kernel to the name it has on the
+// server. Inodes always carry the server's name.
+func (f *Filesystem) remoteName(name string) string {
+	if !f.opts.MapRestrictedChars {
+		return name
+	}
+	return restrictedToRemote.Replace(name)
+}
+
+// localName translates a name from the server to the one shown locally, and is
+// the reverse of remoteName().
+func (f *Filesystem) localName(name string) string {
+	if !f.opts.MapRestrictedChars {
+		return name
+	}
+	return restrictedToLocal.Replace(name)
+}
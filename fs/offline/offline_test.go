@@ -7,6 +7,7 @@ package offline
 import (
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/jstaf/onedriver/fs"
@@ -113,3 +114,12 @@ func TestOfflineRmdir(t *testing.T) {
 		t.Fatal("Removing a directory should have failed offline.")
 	}
 }
+
+// StatFs should fall back to the last quota we saw instead of failing, otherwise
+// "df" and file managers break while offline.
+func TestOfflineStatFs(t *testing.T) {
+	t.Parallel()
+	var st syscall.Statfs_t
+	require.NoError(t, syscall.Statfs(TestDir, &st))
+	require.NotZero(t, st.Blocks, "StatFs failed, got 0 blocks!")
+}
@@ -51,21 +51,22 @@ func TestMain(m *testing.M) {
 	log.Info().Msg("Setup offline tests ------------------------------")
 
 	// reuses the cached data from the previous tests
+	filesystem := fs.NewFilesystem(auth, filepath.Join(testDBLoc, "test"))
 	server, _ := fuse.NewServer(
-		fs.NewFilesystem(auth, filepath.Join(testDBLoc, "test")),
+		filesystem,
 		mountLoc,
 		&fuse.MountOptions{
-			Name:          "onedriver",
-			FsName:        "onedriver",
-			DisableXAttrs: true,
-			MaxBackground: 1024,
+			Name:                 "onedriver",
+			FsName:               "onedriver",
+			IgnoreSecurityLabels: true,
+			MaxBackground:        1024,
 		},
 	)
 
 	// setup sigint handler for graceful unmount on interrupt/terminate
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
-	go fs.UnmountHandler(sigChan, server)
+	go fs.UnmountHandler(sigChan, server, filesystem)
 
 	// mount fs in background thread
 	go server.Serve()
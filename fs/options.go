@@ -0,0 +1,113 @@
+package fs
+
+import "time"
+
+// Options are the user-configurable settings for a Filesystem. The zero value
+// of every option is the default behavior, so options that disable something
+// are named negatively. Options are normally loaded as part of the onedriver
+// config file and then overridden by command line flags.
+type Options struct {
+	// NoVerifyCache skips recomputing the hash of cached content every time a
+	// file is opened. Cached content is trusted as long as its size matches
+	// the size reported by the server, and is discarded whenever the server
+	// reports that an item's content has changed.
+	NoVerifyCache bool `yaml:"noVerifyCache"`
+
+	// TempDir is where transient files like in-progress downloads are written.
+	// It is wiped on startup and shutdown, so it must not be shared with
+	// anything else. Defaults to a subdirectory of the cache directory.
+	TempDir string `yaml:"tempDir"`
+
+	// UploadWorkers is the maximum number of uploads that run at the same
+	// time. Zero means the default of 5.
+	UploadWorkers int `yaml:"uploadWorkers"`
+
+	// UploadRetryTimeout is how long an upload keeps retrying while the server
+	// keeps failing with 5xx errors, before it is given up on and shows up as
+	// failed in the status file. Zero means one hour.
+	UploadRetryTimeout time.Duration `yaml:"uploadRetryTimeout"`
+
+	// MaxFileSize is the largest file, in bytes, that can be written. Zero
+	// means the OneDrive limit of graph.MaxFileSize. Some business tenants
+	// have a different limit.
+	MaxFileSize uint64 `yaml:"maxFileSize"`
+
+	// PrefetchPaths are paths (relative to the root of the drive) whose files
+	// are downloaded in the background after mounting, so that they are
+	// available offline.
+	PrefetchPaths []string `yaml:"prefetchPaths"`
+
+	// IdleTimeout unmounts the filesystem after it has gone this long without
+	// being used. Zero means never.
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+
+	// ConflictName is the template used to name the copy of a file's local
+	// changes when it was also changed on the server. Supports the {name},
+	// {ext}, {hostname}, and {time} tokens.
+	ConflictName string `yaml:"conflictName"`
+
+	// OrderedUploads uploads the files in a directory one at a time, in the
+	// order they were written, so that a file never shows up on the server
+	// before the files written ahead of it.
+	OrderedUploads bool `yaml:"orderedUploads"`
+
+	// UploadBarrier is a file name pattern (like "*.done"). Matching files are
+	// only uploaded once every other upload in the same directory has
+	// finished, so they can be used to tell when a directory is complete.
+	UploadBarrier string `yaml:"uploadBarrier"`
+
+	// MapRestrictedChars allows names containing characters that OneDrive does
+	// not, like ":". They are stored on the server as look-alike characters
+	// from the Unicode private use area, the same way Samba and macOS do it.
+	MapRestrictedChars bool `yaml:"mapRestrictedChars"`
+
+	// StreamThreshold is the size, in bytes, above which files opened
+	// read-only are not downloaded into the cache. Instead, each read fetches
+	// just the part of the file being read from the server. Zero means files
+	// are always downloaded in full when opened.
+	StreamThreshold uint64 `yaml:"streamThreshold"`
+
+	// ZeroSizeFiles decides how files that OneDrive says are empty are opened,
+	// since some of them aren't (Office files in particular). Empty (the
+	// default) downloads their content anyway, unless that version of the file
+	// was downloaded before, and uses the size of what was downloaded. "trust"
+	// takes the size OneDrive reports at its word.
+	ZeroSizeFiles string `yaml:"zeroSizeFiles"`
+
+	// CheckTree checks that the parents and children of every cached item
+	// agree with each other after each batch of deltas is applied, logs what
+	// doesn't, and repairs it. Meant for tracking down sync bugs, since it
+	// walks the whole cache every time.
+	CheckTree bool `yaml:"checkTree"`
+
+	// BandwidthSchedule limits upload and download speeds during certain times
+	// of day. Outside of every rule, bandwidth is unlimited. See
+	// ScheduleBandwidth().
+	BandwidthSchedule []BandwidthRule `yaml:"bandwidthSchedule"`
+
+	// SyncWrites makes closing a file wait until its changes have been
+	// uploaded, instead of uploading them in the background. Closing fails if
+	// the upload fails or takes longer than SyncWritesTimeout (zero means
+	// 10 minutes).
+	SyncWrites        bool          `yaml:"syncWrites"`
+	SyncWritesTimeout time.Duration `yaml:"syncWritesTimeout"`
+
+	// UID and GID are the user and group that every file appears to be owned
+	// by, like the user a Samba share is exported as. Unset means the user
+	// running onedriver. This only changes what is reported, not who can
+	// access the mount.
+	UID *uint32 `yaml:"uid"`
+	GID *uint32 `yaml:"gid"`
+
+	// MtimePrecision is what modification times are truncated to, both when
+	// they are reported and when they are uploaded, so that tools like rsync
+	// and make see the same time locally and on the server. Zero means whole
+	// seconds; use 1ns to keep every bit of precision.
+	MtimePrecision time.Duration `yaml:"mtimePrecision"`
+
+	// MinFreeSpace is how many bytes to keep free on the disk the cache is
+	// on. Below this, cached content that can be downloaded again is removed,
+	// and if that doesn't free up enough, files that aren't cached can't be
+	// opened. Zero means 256MiB.
+	MinFreeSpace uint64 `yaml:"minFreeSpace"`
+}
@@ -0,0 +1,33 @@
+package fs
+
+import (
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// Pause stops all network activity without unmounting: no more uploads, polls
+// for changes, or token refreshes. The filesystem acts like it is offline in
+// the meantime, so cached files can still be read but nothing can be changed.
+// Uploads that were interrupted start over once sync is resumed.
+func (f *Filesystem) Pause() {
+	if f.IsPaused() {
+		return
+	}
+	log.Info().Msg("Pausing sync.")
+	graph.SetPaused(true)
+}
+
+// Resume undoes Pause() and checks the server for changes right away.
+func (f *Filesystem) Resume() {
+	if !f.IsPaused() {
+		return
+	}
+	log.Info().Msg("Resuming sync.")
+	graph.SetPaused(false)
+	f.RequestSync()
+}
+
+// IsPaused returns whether sync has been paused with Pause().
+func (f *Filesystem) IsPaused() bool {
+	return graph.IsPaused()
+}
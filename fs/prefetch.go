@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PrefetchStatus is the progress of downloading the configured prefetch paths.
+type PrefetchStatus struct {
+	Paths    []string  `json:"paths"`
+	Started  time.Time `json:"started"`
+	Finished bool      `json:"finished"`
+	Files    int       `json:"files"` // files found so far
+	Done     int       `json:"done"`  // files that were already cached or downloaded
+	Failed   []string  `json:"failed,omitempty"`
+}
+
+// prefetchTracker guards a PrefetchStatus so it can be read by the status file
+// while a prefetch is running.
+type prefetchTracker struct {
+	sync.Mutex
+	status *PrefetchStatus
+}
+
+func (p *prefetchTracker) update(fn func(status *PrefetchStatus)) {
+	p.Lock()
+	defer p.Unlock()
+	if p.status != nil {
+		fn(p.status)
+	}
+}
+
+// snapshot returns a copy of the current progress, or nil if nothing has been
+// prefetched.
+func (p *prefetchTracker) snapshot() *PrefetchStatus {
+	p.Lock()
+	defer p.Unlock()
+	if p.status == nil {
+		return nil
+	}
+	status := *p.status
+	status.Failed = append([]string{}, p.status.Failed...)
+	return &status
+}
+
+// Prefetch downloads the content of every file under paths that is not already
+// cached, so that it is available while offline. It should be run as a
+// goroutine once the filesystem has been mounted.
+func (f *Filesystem) Prefetch(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	f.prefetch.Lock()
+	f.prefetch.status = &PrefetchStatus{Paths: paths, Started: time.Now()}
+	f.prefetch.Unlock()
+
+	for _, path := range paths {
+		if f.IsOffline() {
+			log.Warn().Msg("Filesystem is offline, giving up on prefetching.")
+			break
+		}
+		inode, err := f.GetPath(path, f.auth)
+		if err != nil || inode == nil {
+			log.Error().Err(err).Str("path", path).Msg("Could not find path to prefetch.")
+			f.prefetch.update(func(status *PrefetchStatus) {
+				status.Failed = append(status.Failed, path)
+			})
+			continue
+		}
+		f.prefetchTree(inode)
+	}
+
+	f.prefetch.update(func(status *PrefetchStatus) {
+		status.Finished = true
+		log.Info().
+			Int("files", status.Files).
+			Int("failed", len(status.Failed)).
+			Msg("Finished prefetching files.")
+	})
+	if err := f.WriteStatus(); err != nil {
+		log.Error().Err(err).Msg("Could not write status file.")
+	}
+}
+
+// prefetchTree downloads every file at or below inode.
+func (f *Filesystem) prefetchTree(inode *Inode) {
+	if !inode.IsDir() {
+		f.prefetch.update(func(status *PrefetchStatus) { status.Files++ })
+		err := f.prefetchFile(inode)
+		f.prefetch.update(func(status *PrefetchStatus) {
+			if err != nil {
+				status.Failed = append(status.Failed, inode.Path())
+			} else {
+				status.Done++
+			}
+		})
+		return
+	}
+
+	children, err := f.GetChildrenID(inode.ID(), f.auth)
+	if err != nil {
+		log.Error().Err(err).Str("path", inode.Path()).
+			Msg("Could not fetch children to prefetch.")
+		f.prefetch.update(func(status *PrefetchStatus) {
+			status.Failed = append(status.Failed, inode.Path())
+		})
+		return
+	}
+	for _, child := range children {
+		f.prefetchTree(child)
+	}
+}
+
+// prefetchFile downloads a single file's content into the cache, unless it is
+// already there.
+func (f *Filesystem) prefetchFile(inode *Inode) error {
+	id := inode.ID()
+	if isLocalID(id) || f.content.HasContent(id) {
+		return nil
+	}
+	ctx := log.With().Str("id", id).Str("path", inode.Path()).Logger()
+
+	if err := f.checkDiskSpace(inode.Size()); err != nil {
+		ctx.Error().Err(err).Msg("Not prefetching file.")
+		return err
+	}
+	temp, err := f.downloadTemp(id, "prefetch")
+	if err != nil {
+		ctx.Error().Err(err).Msg("Failed to prefetch content.")
+		return err
+	}
+	defer temp.Close()
+
+	inode.Lock()
+	defer inode.Unlock()
+	if inode.DriveItem.HasHashes() && !inode.VerifyStream(temp) {
+		ctx.Error().Msg("Prefetched content did not match checksum.")
+		return errors.New("checksum mismatch")
+	}
+	if f.content.IsOpen(id) || inode.hasChanges {
+		// someone opened the file while we were downloading it, their copy wins
+		return nil
+	}
+	fd, err := f.content.Open(id)
+	if err != nil {
+		return err
+	}
+	defer f.content.Close(id)
+	fd.Truncate(0)
+	if _, err = io.Copy(fd, temp); err != nil {
+		ctx.Error().Err(err).Msg("Failed to write prefetched content to cache.")
+		f.content.Delete(id)
+		return err
+	}
+	inode.contentCTag = inode.DriveItem.CTag
+	ctx.Debug().Msg("Prefetched file content.")
+	return nil
+}
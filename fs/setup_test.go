@@ -64,17 +64,17 @@ func TestMain(m *testing.M) {
 		fs,
 		mountLoc,
 		&fuse.MountOptions{
-			Name:          "onedriver",
-			FsName:        "onedriver",
-			DisableXAttrs: true,
-			MaxBackground: 1024,
+			Name:                 "onedriver",
+			FsName:               "onedriver",
+			IgnoreSecurityLabels: true,
+			MaxBackground:        1024,
 		},
 	)
 
 	// setup sigint handler for graceful unmount on interrupt/terminate
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
-	go UnmountHandler(sigChan, server)
+	go UnmountHandler(sigChan, server, fs)
 
 	// mount fs in background thread
 	go server.Serve()
@@ -2,23 +2,115 @@ package fs
 
 import (
 	"os"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/rs/zerolog/log"
 )
 
+// Unmounter is the part of *fuse.Server that the handlers here need. It lets
+// the mount be swapped out from under them when it is re-established.
+type Unmounter interface {
+	Unmount() error
+}
+
 // UnmountHandler should be used as goroutine that will handle sigint then exit gracefully
-func UnmountHandler(signal <-chan os.Signal, server *fuse.Server) {
+func UnmountHandler(signal <-chan os.Signal, server Unmounter, filesystem *Filesystem) {
 	sig := <-signal // block until signal
 	log.Info().Str("signal", strings.ToUpper(sig.String())).
 		Msg("Signal received, unmounting filesystem.")
+	unmount(server, filesystem)
+	os.Exit(128)
+}
+
+// IdleHandler should be used as a goroutine that unmounts the filesystem and
+// exits once it has been idle for longer than timeout. It will not exit while
+// files are open or uploads are still pending.
+func IdleHandler(timeout time.Duration, server Unmounter, filesystem *Filesystem) {
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		if filesystem.IdleTime() < timeout ||
+			len(filesystem.OpenFiles()) > 0 ||
+			len(filesystem.uploads.Uploads()) > 0 {
+			continue
+		}
+		log.Info().Str("timeout", timeout.String()).
+			Msg("Filesystem has been idle, unmounting filesystem.")
+		unmount(server, filesystem)
+		os.Exit(0)
+	}
+}
 
+// unmount unmounts the filesystem and cleans up after it.
+func unmount(server Unmounter, filesystem *Filesystem) {
 	err := server.Unmount()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to unmount filesystem cleanly! " +
 			"Run \"fusermount3 -uz /MOUNTPOINT/GOES/HERE\" to unmount.")
 	}
+	filesystem.warnNotUploaded()
+	filesystem.Cleanup()
+}
 
-	os.Exit(128)
+// warnNotUploaded lists the files whose changes have not made it to OneDrive
+// yet, so that exiting does not look like everything was saved. Their changes
+// stay in the cache and are uploaded the next time onedriver starts.
+func (f *Filesystem) warnNotUploaded() {
+	f.SerializeAll()
+	paths := make([]string, 0)
+	for _, upload := range f.uploads.Uploads() {
+		if inode := f.GetID(upload.ID); inode != nil {
+			paths = append(paths, inode.Path())
+		}
+	}
+	for _, failure := range f.uploads.FailedUploads() {
+		paths = append(paths, failure.Path)
+	}
+	if len(paths) == 0 {
+		return
+	}
+	sort.Strings(paths)
+	log.Error().Strs("paths", paths).
+		Msg("Exiting before changes to these files were uploaded. They are kept in " +
+			"the cache, and will be uploaded the next time OneDrive is mounted.")
+}
+
+// StatusHandler should be used as a goroutine that handles SIGUSR1 and SIGUSR2.
+// SIGUSR1 writes the status file, SIGUSR2 runs the commands in the control file.
+func StatusHandler(signal <-chan os.Signal, filesystem *Filesystem) {
+	for sig := range signal {
+		var err error
+		switch sig {
+		case syscall.SIGUSR1:
+			metrics := filesystem.Metrics()
+			log.Info().
+				Bool("offline", filesystem.IsOffline()).
+				Int("cachedFiles", metrics.CachedFiles).
+				Uint64("cacheBytes", metrics.CacheBytes).
+				Int("inodes", metrics.Inodes).
+				Int("uploadQueue", metrics.UploadQueue).
+				Uint64("uploadRate", metrics.UploadRate).
+				Uint64("downloadRate", metrics.DownloadRate).
+				Uint64("requests", metrics.Graph.Requests).
+				Uint64("requestErrors", metrics.Graph.Errors).
+				Uint64("throttled", metrics.Graph.Throttled).
+				Uint64("queued", metrics.Graph.Queued).
+				Dur("queuedTime", metrics.Graph.QueuedTime).
+				Msg("Metrics snapshot.")
+			err = filesystem.WriteStatus()
+		case syscall.SIGUSR2:
+			if err = filesystem.RunControlFile(); err == nil {
+				err = filesystem.WriteStatus()
+			}
+		}
+		if err != nil {
+			log.Error().Err(err).Str("signal", strings.ToUpper(sig.String())).
+				Msg("Could not handle signal.")
+		}
+	}
 }
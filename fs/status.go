@@ -0,0 +1,246 @@
+package fs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ops of the same type arriving closer together than this are considered
+	// part of the same bulk operation (like the Unlink() calls from "rm -r")
+	opBatchGap = 2 * time.Second
+
+	// number of finished bulk operation summaries to keep around
+	maxOpSummaries = 20
+
+	// at most this many failed paths are recorded per summary
+	maxOpFailures = 50
+)
+
+// OpSummary summarizes the outcome of a burst of similar operations. The kernel
+// sends us one op at a time, so this is the only way to tell a user that
+// something like a recursive delete only partially succeeded.
+type OpSummary struct {
+	Op        string    `json:"op"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Succeeded int       `json:"succeeded"`
+	NFailed   int       `json:"nFailed"`
+	Failed    []string  `json:"failed,omitempty"`
+}
+
+// Total is the number of items the operation was attempted on.
+func (o OpSummary) Total() int {
+	return o.Succeeded + o.NFailed
+}
+
+// opTracker groups individual ops into bulk operation summaries.
+type opTracker struct {
+	sync.Mutex
+	active   map[string]*OpSummary
+	timers   map[string]*time.Timer
+	finished []OpSummary
+	onFinish func()
+}
+
+func newOpTracker(onFinish func()) *opTracker {
+	return &opTracker{
+		active:   make(map[string]*OpSummary),
+		timers:   make(map[string]*time.Timer),
+		onFinish: onFinish,
+	}
+}
+
+// record adds the outcome of a single op on an item to the current summary for
+// that type of op.
+func (t *opTracker) record(op string, path string, err error) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	summary, exists := t.active[op]
+	if !exists {
+		summary = &OpSummary{Op: op, Started: now}
+		t.active[op] = summary
+	}
+	summary.Finished = now
+	if err != nil {
+		summary.NFailed++
+		if len(summary.Failed) < maxOpFailures {
+			summary.Failed = append(summary.Failed, path)
+		}
+	} else {
+		summary.Succeeded++
+	}
+
+	if timer, exists := t.timers[op]; exists {
+		timer.Reset(opBatchGap)
+	} else {
+		t.timers[op] = time.AfterFunc(opBatchGap, func() { t.finish(op) })
+	}
+}
+
+// finish closes out the summary for an op once it has been idle long enough.
+func (t *opTracker) finish(op string) {
+	t.Lock()
+	summary, exists := t.active[op]
+	if !exists {
+		t.Unlock()
+		return
+	}
+	delete(t.active, op)
+	delete(t.timers, op)
+
+	// single item ops are already covered by the logs for the op itself
+	if summary.Total() > 1 {
+		event := log.Info()
+		if summary.NFailed > 0 {
+			event = log.Warn().Str("failed", strings.Join(summary.Failed, ", "))
+		}
+		event.Str("op", op).
+			Int("succeeded", summary.Succeeded).
+			Int("total", summary.Total()).
+			Msgf("Bulk operation finished: %s %d/%d items, %d failed.",
+				op, summary.Succeeded, summary.Total(), summary.NFailed)
+
+		t.finished = append(t.finished, *summary)
+		if len(t.finished) > maxOpSummaries {
+			t.finished = t.finished[len(t.finished)-maxOpSummaries:]
+		}
+	}
+	t.Unlock()
+
+	if t.onFinish != nil && summary.Total() > 1 {
+		t.onFinish()
+	}
+}
+
+// summaries returns the most recently finished bulk operation summaries.
+func (t *opTracker) summaries() []OpSummary {
+	t.Lock()
+	defer t.Unlock()
+	out := make([]OpSummary, len(t.finished))
+	copy(out, t.finished)
+	return out
+}
+
+// Status is a snapshot of what the filesystem is currently doing. It is
+// periodically written to the status file in the cache directory.
+type Status struct {
+	Updated   time.Time `json:"updated"`
+	Account   string    `json:"account"`
+	Offline   bool      `json:"offline"`
+	Paused    bool      `json:"paused"`
+	OverQuota bool      `json:"overQuota"`
+	// the upload queue has stopped, see UploadManager.Stalled()
+	UploadsStalled bool            `json:"uploadsStalled"`
+	DiskFull       bool            `json:"diskFull"` // see IsDiskFull()
+	OpenFiles      []OpenFile      `json:"openFiles"`
+	Uploads        []UploadStatus  `json:"uploads"`
+	FailedUploads  []FailedUpload  `json:"failedUploads"`
+	Operations     []OpSummary     `json:"operations"`
+	Conflicts      []ConflictItem  `json:"conflicts"`
+	Metrics        Metrics         `json:"metrics"`
+	Prefetch       *PrefetchStatus `json:"prefetch,omitempty"`
+}
+
+// Metrics are counters and sizes that are useful for seeing at a glance what
+// the filesystem has been up to.
+type Metrics struct {
+	CachedFiles int                `json:"cachedFiles"`
+	CacheBytes  uint64             `json:"cacheBytes"`
+	Inodes      int                `json:"inodes"`
+	UploadQueue int                `json:"uploadQueue"`
+	Graph       graph.RequestStats `json:"graph"`
+	// bytes per second over the last few seconds
+	UploadRate   uint64 `json:"uploadRate"`
+	DownloadRate uint64 `json:"downloadRate"`
+}
+
+// Metrics returns a snapshot of the filesystem's metrics.
+func (f *Filesystem) Metrics() Metrics {
+	files, size := f.content.Size()
+	f.RLock()
+	inodes := len(f.inodes)
+	f.RUnlock()
+	metrics := Metrics{
+		CachedFiles: files,
+		CacheBytes:  size,
+		Inodes:      inodes,
+		Graph:       graph.GetRequestStats(),
+	}
+	metrics.UploadRate, metrics.DownloadRate = graph.GetTransferRates()
+	if !f.uploads.Stalled() {
+		metrics.UploadQueue = len(f.uploads.Uploads())
+	}
+	return metrics
+}
+
+// OpenFile is a file that currently has an open file descriptor in the cache.
+type OpenFile struct {
+	ID         string `json:"id"`
+	Path       string `json:"path"`
+	HasChanges bool   `json:"hasChanges"`
+}
+
+// Status returns the current status of the filesystem.
+func (f *Filesystem) Status() Status {
+	status := Status{
+		Updated:        time.Now(),
+		Account:        f.auth.Account,
+		Offline:        f.IsOffline(),
+		Paused:         f.IsPaused(),
+		OverQuota:      f.IsQuotaExceeded(),
+		UploadsStalled: f.uploads.Stalled(),
+		DiskFull:       f.IsDiskFull(),
+		OpenFiles:      f.OpenFiles(),
+		Operations:     f.ops.summaries(),
+		Conflicts:      f.Conflicts(),
+		Metrics:        f.Metrics(),
+		Prefetch:       f.prefetch.snapshot(),
+	}
+	// a stalled upload queue would block the status from being written at all
+	if !status.UploadsStalled {
+		status.Uploads = f.uploads.Uploads()
+		status.FailedUploads = f.uploads.FailedUploads()
+	}
+	return status
+}
+
+// OpenFiles lists the files that are currently open.
+func (f *Filesystem) OpenFiles() []OpenFile {
+	open := make([]OpenFile, 0)
+	for _, id := range f.content.OpenIDs() {
+		if inode := f.GetID(id); inode != nil {
+			open = append(open, OpenFile{
+				ID:         id,
+				Path:       inode.Path(),
+				HasChanges: inode.HasChanges(),
+			})
+		}
+	}
+	return open
+}
+
+// StatusPath is the location of the status file.
+func (f *Filesystem) StatusPath() string {
+	return filepath.Join(f.cacheDir, "status.json")
+}
+
+// WriteStatus writes the current status of the filesystem to the status file.
+func (f *Filesystem) WriteStatus() error {
+	if err := f.history.save(); err != nil {
+		log.Error().Err(err).Msg("Could not write history file.")
+	}
+	contents, err := json.MarshalIndent(f.Status(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.StatusPath(), contents, 0600)
+}
@@ -0,0 +1,126 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Individual ops should get rolled up into a single summary, and partial
+// failures should be reported.
+func TestOpTrackerSummary(t *testing.T) {
+	t.Parallel()
+	tracker := newOpTracker(nil)
+	tracker.record("delete", "/a", nil)
+	tracker.record("delete", "/b", errors.New("nope"))
+	tracker.record("delete", "/c", nil)
+	tracker.finish("delete")
+
+	summaries := tracker.summaries()
+	require.Equal(t, 1, len(summaries))
+	assert.Equal(t, 3, summaries[0].Total())
+	assert.Equal(t, 2, summaries[0].Succeeded)
+	assert.Equal(t, []string{"/b"}, summaries[0].Failed)
+}
+
+// Single item ops are not bulk operations and should not show up.
+func TestOpTrackerSingleOp(t *testing.T) {
+	t.Parallel()
+	tracker := newOpTracker(nil)
+	tracker.record("mkdir", "/a", nil)
+	tracker.finish("mkdir")
+	assert.Equal(t, 0, len(tracker.summaries()))
+}
+
+// Only loopback names and the address being listened on are allowed to reach
+// the web UI.
+func TestWebHostAllowed(t *testing.T) {
+	t.Parallel()
+	assert.True(t, webHostAllowed("localhost:8080", "127.0.0.1"))
+	assert.True(t, webHostAllowed("127.0.0.1:8080", "127.0.0.1"))
+	assert.True(t, webHostAllowed("[::1]:8080", "127.0.0.1"))
+	assert.True(t, webHostAllowed("192.168.1.5:8080", "192.168.1.5"))
+	assert.False(t, webHostAllowed("evil.example.com:8080", "127.0.0.1"))
+	assert.False(t, webHostAllowed("192.168.1.6:8080", "192.168.1.5"))
+}
+
+// Without a login, actions should only be possible when the web UI only listens
+// on loopback.
+func TestWebActionsLoopbackOnly(t *testing.T) {
+	t.Parallel()
+	assert.True(t, webLoopback("127.0.0.1"))
+	assert.True(t, webLoopback("::1"))
+	assert.True(t, webLoopback("localhost"))
+	assert.False(t, webLoopback("192.168.1.5"))
+	assert.False(t, webLoopback("0.0.0.0"))
+
+	var f *Filesystem // never used, none of its actions should be reachable
+	handler := f.WebHandler("192.168.1.5")
+	for _, action := range []string{"sync", "pause", "resume", "flush", "close", "reauth"} {
+		request := httptest.NewRequest(http.MethodPost, "http://192.168.1.5:8080/api/"+action, nil)
+		request.Header.Set(webActionHeader, "1")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusNotFound, response.Code, action)
+	}
+}
+
+// Web UI actions should only run for POSTs that set the action header.
+func TestWebActionHeader(t *testing.T) {
+	t.Parallel()
+	ran := 0
+	handler := webAction(func(r *http.Request) error {
+		ran++
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/sync", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/api/sync", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, 0, ran)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/sync", nil)
+	req.Header.Set(webActionHeader, "1")
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, ran)
+}
+
+// The history should only keep the newest events, and survive being saved and
+// loaded again.
+func TestHistory(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(testDBLoc, "test_history.json")
+	os.Remove(path)
+	h := newHistory(path)
+	start := time.Now()
+	for i := 0; i < maxHistory+10; i++ {
+		h.record(historyUploaded, fmt.Sprint(i), fmt.Sprintf("/file%d", i), false)
+	}
+	h.record(historyDeleted, "gone", "/gone", true)
+	require.NoError(t, h.save())
+
+	loaded, err := ReadHistory(path)
+	require.NoError(t, err)
+	require.Len(t, loaded, maxHistory)
+	assert.Equal(t, "11", loaded[0].ID, "Oldest events should be dropped first.")
+	last := loaded[len(loaded)-1]
+	assert.Equal(t, historyDeleted, last.Action)
+	assert.True(t, last.Remote)
+
+	assert.Len(t, newHistory(path).since(start.Add(-time.Second)), maxHistory)
+	assert.Empty(t, h.since(time.Now()))
+}
@@ -0,0 +1,40 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// if the wall clock gets this far ahead of the monotonic clock between two
+// checks, the machine was asleep
+const suspendThreshold = 30 * time.Second
+
+// suspendedFor returns how long the machine was suspended between two readings
+// of time.Now(). The monotonic clock stops while suspended, but the wall clock
+// keeps going.
+func suspendedFor(last time.Time, now time.Time) time.Duration {
+	return now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+}
+
+// WatchSuspend checks every interval whether the machine has just woken up from
+// suspend, and should be called as a goroutine. After a resume, connections to
+// the server are reset and the delta loop polls right away, so that the
+// filesystem finds out whether it is online again without waiting for requests
+// on dead connections to time out.
+func (f *Filesystem) WatchSuspend(interval time.Duration) {
+	last := time.Now()
+	for {
+		time.Sleep(interval)
+		now := time.Now()
+		if asleep := suspendedFor(last, now); asleep > suspendThreshold {
+			log.Info().
+				Dur("suspended", asleep).
+				Msg("Resumed from suspend, resetting connections to the server.")
+			graph.ResetConnections()
+			f.RequestSync()
+		}
+		last = now
+	}
+}
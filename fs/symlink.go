@@ -0,0 +1,27 @@
+package fs
+
+import (
+	"path"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rs/zerolog/log"
+)
+
+// Symlink is called when creating a symlink, like when running "cp -a" on a
+// tree that has some. OneDrive has no such thing, so they are refused with
+// EPERM, which cp reports and then moves on from. Saving a copy of the target
+// instead is not an option: the kernel only accepts a symlink in reply, and
+// fails the whole call with EIO otherwise.
+func (f *Filesystem) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	parentPath := ""
+	if parent := f.GetNodeID(header.NodeId); parent != nil {
+		parentPath = parent.Path()
+	}
+	log.Info().
+		Str("op", "Symlink").
+		Uint64("nodeID", header.NodeId).
+		Str("path", path.Join(parentPath, linkName)).
+		Str("target", pointedTo).
+		Msg("OneDrive does not support symlinks, refusing to create one.")
+	return fuse.EPERM
+}
@@ -2,6 +2,9 @@ package fs
 
 import (
 	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/jstaf/onedriver/fs/graph"
@@ -9,19 +12,45 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
-const maxUploadsInFlight = 5
+// default number of uploads that can run at the same time
+const defaultUploadWorkers = 5
 
 var bucketUploads = []byte("uploads")
 
+// uploads that were given up on, kept so they can be tried again after a restart
+var bucketFailedUploads = []byte("failed_uploads")
+
+var errUploadTimeout = errors.New("timed out waiting for upload to finish")
+
+// uploadWait asks to be told when the upload of an item is done, through done.
+type uploadWait struct {
+	id   string
+	done chan error
+}
+
 // UploadManager is used to manage and retry uploads.
 type UploadManager struct {
+	// atomics go first so they stay 64-bit aligned on 32-bit platforms
+	heartbeat int64 // last time uploadLoop ran, see watchdog()
+	stalled   int32
+
 	queue         chan *UploadSession
 	deletionQueue chan string
-	sessions      map[string]*UploadSession
-	inFlight      uint8 // number of sessions in flight
-	auth          *graph.Auth
-	fs            *Filesystem
-	db            *bolt.DB
+	waitQueue     chan uploadWait
+
+	// sessions and inFlight are only modified by uploadLoop, the lock is
+	// there so that other threads can safely inspect them
+	sync.RWMutex
+	sessions map[string]*UploadSession
+	failed   map[string]FailedUpload // uploads that ran out of retries, by ID
+	inFlight int                     // number of sessions in flight
+	workers  int                     // max number of sessions in flight
+	waiters  map[string][]chan error // WaitUpload() calls, by ID
+	restored []string                // failed uploads from a previous run, by ID
+
+	auth *graph.Auth
+	fs   *Filesystem
+	db   *bolt.DB
 }
 
 // NewUploadManager creates a new queue/thread for uploads
@@ -29,11 +58,18 @@ func NewUploadManager(duration time.Duration, db *bolt.DB, fs *Filesystem, auth
 	manager := UploadManager{
 		queue:         make(chan *UploadSession),
 		deletionQueue: make(chan string, 1000), // FIXME - why does this chan need to be buffered now???
+		waitQueue:     make(chan uploadWait),
 		sessions:      make(map[string]*UploadSession),
+		failed:        make(map[string]FailedUpload),
+		waiters:       make(map[string][]chan error),
+		workers:       defaultUploadWorkers,
 		auth:          auth,
 		db:            db,
 		fs:            fs,
 	}
+	if fs != nil && fs.opts.UploadWorkers > 0 {
+		manager.workers = fs.opts.UploadWorkers
+	}
 	db.View(func(tx *bolt.Tx) error {
 		// Add any incomplete sessions from disk - any sessions here were never
 		// finished. The most likely cause of this is that the user shut off
@@ -53,12 +89,41 @@ func NewUploadManager(duration time.Duration, db *bolt.DB, fs *Filesystem, auth
 			if session.getState() != uploadNotStarted {
 				manager.inFlight++
 			}
-			session.cancel(auth) // uploads are currently non-resumable
+			// uploads are currently non-resumable, so whatever made it to the
+			// server last time is thrown away and the upload starts over
+			if session.orphaned() {
+				log.Info().
+					Str("id", session.ID).
+					Str("name", session.Name).
+					Msg("Cancelling upload session left on the server by a previous run.")
+				go graph.CancelUploadSession(session.UploadURL)
+				session.UploadURL = ""
+			}
 			manager.sessions[session.ID] = session
 			return nil
 		})
 	})
+	db.View(func(tx *bolt.Tx) error {
+		// changes that could not be uploaded last time are still in the cache,
+		// and are tried again once we are online
+		b := tx.Bucket(bucketFailedUploads)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(key []byte, val []byte) error {
+			failure := FailedUpload{}
+			if err := json.Unmarshal(val, &failure); err != nil {
+				log.Error().Err(err).Msg("Failure restoring failed uploads from disk.")
+				return nil
+			}
+			manager.failed[failure.ID] = failure
+			manager.restored = append(manager.restored, failure.ID)
+			return nil
+		})
+	})
+	manager.beat()
 	go manager.uploadLoop(duration)
+	go manager.watchdog(uploadStallTimeout)
 	return &manager
 }
 
@@ -69,34 +134,80 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 		select {
 		case session := <-u.queue: // new sessions
 			// deduplicate sessions for the same item
+			u.Lock()
 			if old, exists := u.sessions[session.ID]; exists {
 				old.cancel(u.auth)
 			}
-			contents, _ := json.Marshal(session)
-			u.db.Batch(func(tx *bolt.Tx) error {
-				// persist to disk in case the user shuts off their computer or
-				// kills onedriver prematurely
-				b, _ := tx.CreateBucketIfNotExists(bucketUploads)
-				return b.Put([]byte(session.ID), contents)
-			})
+			session.onCreate = u.persist
+			u.persist(session)
 			u.sessions[session.ID] = session
+			u.clearFailed(session.ID)
+			u.Unlock()
 
 		case cancelID := <-u.deletionQueue: // remove uploads for deleted items
+			u.Lock()
+			u.clearFailed(cancelID)
 			u.finishUpload(cancelID)
+			u.Unlock()
+
+		case wait := <-u.waitQueue:
+			// handled here so that a session queued right before is already
+			// in u.sessions
+			u.Lock()
+			if _, exists := u.sessions[wait.id]; exists {
+				u.waiters[wait.id] = append(u.waiters[wait.id], wait.done)
+			} else {
+				wait.done <- u.uploadResult(wait.id)
+			}
+			u.Unlock()
 
 		case <-ticker.C: // periodically start uploads, or remove them if done/failed
+			u.Lock()
 			for _, session := range u.sessions {
 				switch session.getState() {
 				case uploadNotStarted:
 					// max active upload sessions are capped at this limit for faster
 					// uploads of individual files and also to prevent possible server-
 					// side throttling that can cause errors.
-					if u.inFlight < maxUploadsInFlight {
+					if u.inFlight < u.workers && u.canStart(session) && !graph.IsPaused() {
 						u.inFlight++
-						go session.Upload(u.auth)
+						go u.runUpload(session)
 					}
 
 				case uploadErrored:
+					if graph.IsPaused() {
+						// failed because of the pause, not worth a retry
+						u.requeue(session)
+						continue
+					}
+					if graph.IsQuotaExceeded(session) {
+						// retrying won't help until space is freed up, at which
+						// point checkQuota() tries again
+						log.Error().
+							Str("id", session.ID).
+							Str("name", session.Name).
+							Err(session).
+							Msg("Drive is out of space, giving up on upload until space is freed.")
+						u.fs.ops.record("upload", session.Name, session)
+						u.markFailed(session)
+						u.finishUpload(session.ID)
+						u.fs.markQuotaExceeded()
+						continue
+					}
+					if session.gaveUp() {
+						// it already spent all the time it had waiting on the
+						// server, starting over would only wait some more
+						log.Error().
+							Str("id", session.ID).
+							Str("name", session.Name).
+							Err(session).
+							Msg("Server kept failing, cancelling upload session.")
+						session.cancel(u.auth)
+						u.fs.ops.record("upload", session.Name, session)
+						u.markFailed(session)
+						u.finishUpload(session.ID)
+						continue
+					}
 					session.retries++
 					if session.retries > 5 {
 						log.Error().
@@ -105,7 +216,10 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 							Err(session).
 							Int("retries", session.retries).
 							Msg("Upload session failed too many times, cancelling session.")
+						u.fs.ops.record("upload", session.Name, session)
+						u.markFailed(session)
 						u.finishUpload(session.ID)
+						continue
 					}
 
 					log.Warn().
@@ -114,7 +228,7 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 						Err(session).
 						Msg("Upload session failed, will retry from beginning.")
 					session.cancel(u.auth) // cancel large sessions
-					session.setState(uploadNotStarted, nil)
+					u.requeue(session)
 
 				case uploadComplete:
 					log.Info().
@@ -141,16 +255,59 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 					if inode := u.fs.GetID(session.ID); inode != nil {
 						inode.Lock()
 						inode.DriveItem.ETag = session.ETag
+						inode.DriveItem.CTag = session.CTag
+						inode.contentCTag = session.CTag
 						inode.Unlock()
+						u.fs.history.record(historyUploaded, session.ID, inode.Path(), false)
 					}
 
 					// the old ID is the one that was used to add it to the queue.
 					// cleanup the session.
+					u.fs.ops.record("upload", session.Name, nil)
 					u.finishUpload(session.OldID)
 				}
 			}
+			u.Unlock()
+			u.beat()
+		}
+	}
+}
+
+// canStart checks whether a session has to wait for other uploads in the same
+// directory to finish first, either because OrderedUploads is set and they were
+// queued earlier, or because the session is for an UploadBarrier file. The
+// caller must hold the UploadManager lock.
+func (u *UploadManager) canStart(session *UploadSession) bool {
+	if u.fs == nil {
+		return true
+	}
+	ordered := u.fs.opts.OrderedUploads
+	barrier := isUploadBarrier(u.fs.opts.UploadBarrier, session.Name)
+	if !ordered && !barrier {
+		return true
+	}
+	for _, other := range u.sessions {
+		if other == session || other.ParentID != session.ParentID ||
+			other.getState() == uploadComplete {
+			continue
+		}
+		if barrier && !isUploadBarrier(u.fs.opts.UploadBarrier, other.Name) {
+			return false
 		}
+		if ordered && other.Queued.Before(session.Queued) {
+			return false
+		}
+	}
+	return true
+}
+
+// isUploadBarrier checks if a file name matches the UploadBarrier pattern.
+func isUploadBarrier(pattern string, name string) bool {
+	if pattern == "" {
+		return false
 	}
+	match, _ := filepath.Match(pattern, name)
+	return match
 }
 
 // QueueUpload queues an item for upload.
@@ -158,6 +315,7 @@ func (u *UploadManager) QueueUpload(inode *Inode) error {
 	data := u.fs.getInodeContent(inode)
 	session, err := NewUploadSession(inode, data)
 	if err == nil {
+		session.ModTime = session.ModTime.Truncate(u.fs.mtimePrecision())
 		u.queue <- session
 	}
 	return err
@@ -168,9 +326,228 @@ func (u *UploadManager) CancelUpload(id string) {
 	u.deletionQueue <- id
 }
 
+// WaitUpload blocks until the upload of an item that was just queued is done,
+// or the timeout runs out. If the item is queued again in the meantime, it
+// waits for the newer upload instead. Returns nil if there was nothing to
+// upload, or why the upload failed.
+func (u *UploadManager) WaitUpload(id string, timeout time.Duration) error {
+	// buffered so that finishUpload() never blocks on a waiter that gave up
+	done := make(chan error, 1)
+	u.waitQueue <- uploadWait{id: id, done: done}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errUploadTimeout
+	}
+}
+
+// uploadResult is what waiters on an upload that is done get told. The caller
+// must hold the UploadManager lock.
+func (u *UploadManager) uploadResult(id string) error {
+	if failure, exists := u.failed[id]; exists {
+		return errors.New(failure.Error)
+	}
+	return nil
+}
+
+// markFailed remembers that an upload ran out of retries, so that the user can
+// find out about it. The inode is marked as changed again, so the upload is
+// retried the next time the file is closed. The caller must hold the
+// UploadManager lock.
+func (u *UploadManager) markFailed(session *UploadSession) {
+	session.Lock()
+	failure := FailedUpload{
+		ID:     session.ID,
+		Name:   session.Name,
+		Error:  "unknown error",
+		Failed: time.Now(),
+	}
+	if session.error != nil {
+		failure.Error = session.error.Error()
+		failure.Quota = graph.IsQuotaExceeded(session.error)
+	}
+	session.Unlock()
+
+	if inode := u.fs.GetID(session.ID); inode != nil {
+		failure.Path = inode.Path()
+		inode.Lock()
+		inode.hasChanges = true
+		inode.Unlock()
+	}
+	u.failed[session.ID] = failure
+	u.persistFailed(failure)
+}
+
+// markQuotaFailed records that an item's changes could not be uploaded at all
+// because the drive is out of space, so that they are uploaded once there is
+// space again.
+func (u *UploadManager) markQuotaFailed(inode *Inode) {
+	id := inode.ID()
+	u.Lock()
+	defer u.Unlock()
+	failure := FailedUpload{
+		ID:     id,
+		Name:   inode.Name(),
+		Path:   inode.Path(),
+		Error:  "drive is out of space",
+		Failed: time.Now(),
+		Quota:  true,
+	}
+	u.failed[id] = failure
+	u.persistFailed(failure)
+}
+
+// persistFailed saves a failed upload to disk, so that it is not forgotten if
+// onedriver is restarted before the changes are uploaded. The caller must hold
+// the UploadManager lock.
+func (u *UploadManager) persistFailed(failure FailedUpload) {
+	contents, _ := json.Marshal(failure)
+	u.db.Batch(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists(bucketFailedUploads)
+		return b.Put([]byte(failure.ID), contents)
+	})
+}
+
+// clearFailed forgets that an upload failed, once it is tried again or the
+// item is gone. The caller must hold the UploadManager lock.
+func (u *UploadManager) clearFailed(id string) {
+	if _, exists := u.failed[id]; !exists {
+		return
+	}
+	delete(u.failed, id)
+	u.db.Batch(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketFailedUploads); b != nil {
+			b.Delete([]byte(id))
+		}
+		return nil
+	})
+}
+
+// takeRestored returns the IDs of uploads that failed before onedriver was last
+// restarted, the first time it is called.
+func (u *UploadManager) takeRestored() []string {
+	u.Lock()
+	defer u.Unlock()
+	restored := u.restored
+	u.restored = nil
+	return restored
+}
+
+// quotaFailures returns the IDs of the uploads that failed because the drive
+// was out of space.
+func (u *UploadManager) quotaFailures() []string {
+	u.RLock()
+	defer u.RUnlock()
+	ids := make([]string, 0)
+	for id, failure := range u.failed {
+		if failure.Quota {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// FailedUpload is an upload that failed too many times and was given up on.
+// The changes are still in the local cache. Uploads that failed because the
+// drive was out of space (Quota) are tried again once there is space.
+type FailedUpload struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Path   string    `json:"path"`
+	Error  string    `json:"error"`
+	Failed time.Time `json:"failed"`
+	Quota  bool      `json:"quota,omitempty"`
+}
+
+// FailedUploads returns the uploads that were given up on and have not been
+// retried since.
+func (u *UploadManager) FailedUploads() []FailedUpload {
+	u.RLock()
+	defer u.RUnlock()
+	failed := make([]FailedUpload, 0, len(u.failed))
+	for _, failure := range u.failed {
+		failed = append(failed, failure)
+	}
+	return failed
+}
+
+// UploadState describes where an item is in the upload process: "queued",
+// "uploading", "errored" (will be retried), or "failed: <last error>".
+// It is empty if the item has nothing waiting to be uploaded.
+func (u *UploadManager) UploadState(id string) string {
+	u.RLock()
+	defer u.RUnlock()
+	if failure, exists := u.failed[id]; exists {
+		return "failed: " + failure.Error
+	}
+	if session, exists := u.sessions[id]; exists {
+		return uploadStateNames[session.getState()]
+	}
+	return ""
+}
+
+// UploadStatus describes an upload that has not finished yet.
+type UploadStatus struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	State   string `json:"state"`
+	Retries int    `json:"retries"`
+	Size    uint64 `json:"size"`
+}
+
+var uploadStateNames = map[int]string{
+	uploadNotStarted: "queued",
+	uploadStarted:    "uploading",
+	uploadComplete:   "complete",
+	uploadErrored:    "errored",
+}
+
+// Uploads returns the status of all uploads the manager knows about.
+func (u *UploadManager) Uploads() []UploadStatus {
+	u.RLock()
+	defer u.RUnlock()
+	uploads := make([]UploadStatus, 0, len(u.sessions))
+	for _, session := range u.sessions {
+		session.Lock()
+		uploads = append(uploads, UploadStatus{
+			ID:      session.ID,
+			Name:    session.Name,
+			State:   uploadStateNames[session.state],
+			Retries: session.retries,
+			Size:    session.Size,
+		})
+		session.Unlock()
+	}
+	return uploads
+}
+
+// persist saves a session to disk in case the user shuts off their computer or
+// kills onedriver prematurely. It is saved again once a session has been created
+// on the server, so that the server side can be cleaned up on the next start.
+func (u *UploadManager) persist(session *UploadSession) {
+	contents, _ := json.Marshal(session)
+	u.db.Batch(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists(bucketUploads)
+		return b.Put([]byte(session.ID), contents)
+	})
+}
+
+// requeue puts a session that is no longer running back in line to be
+// started. The caller must hold the UploadManager lock.
+func (u *UploadManager) requeue(session *UploadSession) {
+	session.setState(uploadNotStarted, nil)
+	if u.inFlight > 0 {
+		u.inFlight--
+	}
+}
+
 // finishUpload is an internal method that gets called when a session is
 // completed. It cancels the session if one was in progress, and then deletes
-// it from both memory and disk.
+// it from both memory and disk. Anyone waiting on the upload is told how it
+// went. The caller must hold the UploadManager lock.
 func (u *UploadManager) finishUpload(id string) {
 	if session, exists := u.sessions[id]; exists {
 		session.cancel(u.auth)
@@ -185,4 +562,11 @@ func (u *UploadManager) finishUpload(id string) {
 		u.inFlight--
 	}
 	delete(u.sessions, id)
+	if waiters, exists := u.waiters[id]; exists {
+		result := u.uploadResult(id)
+		for _, done := range waiters {
+			done <- result
+		}
+		delete(u.waiters, id)
+	}
 }
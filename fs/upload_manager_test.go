@@ -79,6 +79,57 @@ func TestUploadDiskSerialization(t *testing.T) {
 	)
 }
 
+// WaitUpload should return once an upload is done, and right away if there is
+// nothing to wait for.
+func TestWaitUpload(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open(filepath.Join(testDBLoc, "test_wait_upload.db"), 0644, nil)
+	require.NoError(t, err)
+	manager := NewUploadManager(time.Second, db, fs, auth)
+	assert.NoError(t, manager.WaitUpload("nothing-queued", time.Second))
+
+	fname := filepath.Join(TestDir, "wait_upload.txt")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("wait for me"), 0644))
+	var inode *Inode
+	require.Eventually(t, func() bool {
+		inode, _ = fs.GetPath("/onedriver_tests/wait_upload.txt", auth)
+		return inode != nil && !isLocalID(inode.ID())
+	}, retrySeconds, 2*time.Second, "ID was local after upload.")
+
+	require.NoError(t, manager.QueueUpload(inode))
+	require.NoError(t, manager.WaitUpload(inode.ID(), retrySeconds))
+	assert.Equal(t, "", manager.UploadState(inode.ID()),
+		"Upload should be finished once WaitUpload returns.")
+}
+
+// Uploads that were given up on should be remembered across restarts, so that
+// they can be retried.
+func TestFailedUploadsRestored(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open(filepath.Join(testDBLoc, "test_failed_uploads_restored.db"), 0644, nil)
+	require.NoError(t, err)
+	inode := NewInodeDriveItem(&graph.DriveItem{ID: "failed-upload-restored", Name: "restored.txt"})
+	NewUploadManager(time.Second, db, fs, auth).markQuotaFailed(inode)
+
+	restarted := NewUploadManager(time.Second, db, fs, auth)
+	require.Len(t, restarted.FailedUploads(), 1)
+	assert.Equal(t, inode.ID(), restarted.FailedUploads()[0].ID)
+	assert.Equal(t, []string{inode.ID()}, restarted.takeRestored())
+	assert.Empty(t, restarted.takeRestored(), "Should only be retried once.")
+
+	restarted.CancelUpload(inode.ID())
+	assert.Eventually(t, func() bool {
+		var failed []byte
+		db.View(func(tx *bolt.Tx) error {
+			if b := tx.Bucket(bucketFailedUploads); b != nil {
+				failed = b.Get([]byte(inode.ID()))
+			}
+			return nil
+		})
+		return failed == nil
+	}, 5*time.Second, 100*time.Millisecond, "Failure should be forgotten once cancelled.")
+}
+
 // Make sure that uploading the same file multiple times works exactly as it should.
 func TestRepeatedUploads(t *testing.T) {
 	t.Parallel()
@@ -115,3 +166,85 @@ func TestRepeatedUploads(t *testing.T) {
 		}
 	}
 }
+
+// Uploads that ran out of retries should say why until they are retried.
+func TestUploadFailedState(t *testing.T) {
+	t.Parallel()
+	manager := &UploadManager{
+		sessions: make(map[string]*UploadSession),
+		failed:   make(map[string]FailedUpload),
+		fs:       fs,
+	}
+	session := &UploadSession{ID: "failed-upload-id", Name: "failed_upload.txt"}
+	session.setState(uploadErrored, errors.New("HTTP 507 - quotaLimitReached"))
+	manager.markFailed(session)
+
+	assert.Equal(t, "failed: HTTP 507 - quotaLimitReached", manager.UploadState(session.ID))
+	assert.Equal(t, "", manager.UploadState("not-uploading-id"))
+	failed := manager.FailedUploads()
+	require.Len(t, failed, 1)
+	assert.Equal(t, "failed_upload.txt", failed[0].Name)
+	assert.True(t, failed[0].Quota, "Upload should be marked as failed for lack of space.")
+	assert.Equal(t, []string{session.ID}, manager.quotaFailures())
+}
+
+// The watchdog should start over uploads that are stuck, fix the count of
+// running uploads, and notice when the upload loop stops.
+func TestUploadWatchdog(t *testing.T) {
+	t.Parallel()
+	stuck := &UploadSession{ID: "watchdog-stuck", Name: "stuck.txt"}
+	stuck.setState(uploadStarted, nil)
+	stuck.active = time.Now().Add(-time.Hour)
+	running := &UploadSession{ID: "watchdog-running", Name: "running.txt"}
+	running.setState(uploadStarted, nil)
+	db, err := bolt.Open(filepath.Join(testDBLoc, "test_upload_watchdog.db"), 0644, nil)
+	require.NoError(t, err)
+	manager := &UploadManager{
+		sessions: map[string]*UploadSession{stuck.ID: stuck, running.ID: running},
+		inFlight: 5,
+		fs:       fs,
+		db:       db,
+	}
+	manager.beat()
+	manager.checkStalled(time.Minute)
+
+	restarted := manager.sessions[stuck.ID]
+	assert.NotSame(t, stuck, restarted, "Stuck session should have been replaced.")
+	assert.Equal(t, uploadNotStarted, restarted.getState())
+	assert.Equal(t, 1, restarted.retries)
+	assert.Same(t, running, manager.sessions[running.ID])
+	assert.Equal(t, 1, manager.inFlight)
+	assert.False(t, manager.Stalled())
+
+	manager.heartbeat = time.Now().Add(-time.Hour).UnixNano()
+	manager.checkStalled(time.Minute)
+	assert.True(t, manager.Stalled())
+}
+
+// With ordered uploads, a session must wait for earlier ones in the same
+// directory. Barrier files wait for everything else in their directory.
+func TestUploadCanStart(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	first := &UploadSession{ID: "1", ParentID: "dir", Name: "a.txt", Queued: now}
+	second := &UploadSession{ID: "2", ParentID: "dir", Name: "b.txt", Queued: now.Add(time.Second)}
+	elsewhere := &UploadSession{ID: "3", ParentID: "other", Name: "c.txt", Queued: now.Add(-time.Second)}
+	marker := &UploadSession{ID: "4", ParentID: "dir", Name: "build.done", Queued: now.Add(-time.Minute)}
+	manager := &UploadManager{
+		sessions: map[string]*UploadSession{"1": first, "2": second, "3": elsewhere, "4": marker},
+		fs:       &Filesystem{},
+	}
+	assert.True(t, manager.canStart(second), "Uploads should not be ordered by default.")
+
+	manager.fs.opts.OrderedUploads = true
+	assert.True(t, manager.canStart(first))
+	assert.False(t, manager.canStart(second))
+	assert.True(t, manager.canStart(elsewhere))
+
+	manager.fs.opts.OrderedUploads = false
+	manager.fs.opts.UploadBarrier = "*.done"
+	assert.False(t, manager.canStart(marker))
+	first.setState(uploadComplete, nil)
+	second.setState(uploadComplete, nil)
+	assert.True(t, manager.canStart(marker))
+}
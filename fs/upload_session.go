@@ -24,8 +24,28 @@ const (
 
 	// uploads larget than 4MB must use a formal upload session
 	uploadLargeSize uint64 = 4 * 1024 * 1024
+
+	// upload sessions that will expire sooner than this are replaced with a
+	// fresh one before uploading the next chunk
+	uploadExpiryMargin = 2 * time.Minute
+
+	// a session is only replaced this many times before giving up, in case the
+	// server keeps handing out sessions that are about to expire
+	maxUploadRenewals = 3
+
+	// how long to keep retrying a chunk the server won't take, unless
+	// Options.UploadRetryTimeout says otherwise
+	defaultUploadRetryTimeout = time.Hour
+
+	// the longest wait between retries of a chunk. This has to stay well under
+	// uploadStallTimeout.
+	maxUploadBackoff = 2 * time.Minute
 )
 
+// errUploadGaveUp means the server kept failing for longer than the upload was
+// allowed to keep retrying.
+var errUploadGaveUp = errors.New("server kept failing, gave up retrying")
+
 // upload states
 const (
 	uploadNotStarted = iota
@@ -50,11 +70,18 @@ type UploadSession struct {
 	Data               []byte    `json:"data,omitempty"`
 	QuickXORHash       string    `json:"quickxorhash,omitempty"`
 	ModTime            time.Time `json:"modTime,omitempty"`
+	Queued             time.Time `json:"queued"` // used to keep uploads in order
 	retries            int
+	retryTimeout       time.Duration // see Options.UploadRetryTimeout
+	active             time.Time     // last time the upload got anywhere
+	// called whenever a new session is created on the server, so that its URL
+	// can be saved and the session cleaned up if we crash
+	onCreate func(*UploadSession)
 
 	sync.Mutex
 	UploadURL string `json:"uploadUrl"`
 	ETag      string `json:"eTag,omitempty"`
+	CTag      string `json:"cTag,omitempty"`
 	state     int
 	error     // embedded error tracks errors that killed an upload
 }
@@ -91,10 +118,52 @@ func (u *UploadSession) setState(state int, err error) error {
 	u.Lock()
 	u.state = state
 	u.error = err
+	u.active = time.Now()
 	u.Unlock()
 	return err
 }
 
+// activity returns the state of the session and the last time it changed or
+// the upload made progress.
+func (u *UploadSession) activity() (int, time.Time) {
+	u.Lock()
+	defer u.Unlock()
+	return u.state, u.active
+}
+
+// gaveUp is true if the upload failed because the server kept failing for too
+// long, in which case starting over would only mean more waiting.
+func (u *UploadSession) gaveUp() bool {
+	u.Lock()
+	defer u.Unlock()
+	return errors.Is(u.error, errUploadGaveUp)
+}
+
+// restart returns a copy of the session that can be started over from the
+// beginning. The original is left to whatever got stuck running it, and no
+// longer saves anything to disk.
+func (u *UploadSession) restart() *UploadSession {
+	u.Lock()
+	defer u.Unlock()
+	fresh := &UploadSession{
+		ID:           u.ID,
+		OldID:        u.OldID,
+		ParentID:     u.ParentID,
+		NodeID:       u.NodeID,
+		Name:         u.Name,
+		Size:         u.Size,
+		Data:         u.Data,
+		QuickXORHash: u.QuickXORHash,
+		ModTime:      u.ModTime,
+		Queued:       u.Queued,
+		retries:      u.retries + 1,
+		onCreate:     u.onCreate,
+		active:       time.Now(),
+	}
+	u.onCreate = nil
+	return fresh
+}
+
 // NewUploadSession wraps an upload of a file into an UploadSession struct
 // responsible for performing uploads for a file.
 func NewUploadSession(inode *Inode, data *[]byte) (*UploadSession, error) {
@@ -112,6 +181,7 @@ func NewUploadSession(inode *Inode, data *[]byte) (*UploadSession, error) {
 		Name:     inode.DriveItem.Name,
 		Data:     *data,
 		ModTime:  *inode.DriveItem.ModTime,
+		Queued:   time.Now(),
 	}
 	inode.RUnlock()
 
@@ -120,6 +190,64 @@ func NewUploadSession(inode *Inode, data *[]byte) (*UploadSession, error) {
 	return &session, nil
 }
 
+// TimeUntilExpiry returns how long is left before the server throws away the
+// upload session. Sessions that have not been created on the server yet (and
+// small uploads, which never use one) do not expire.
+func (u *UploadSession) TimeUntilExpiry() time.Duration {
+	u.Lock()
+	defer u.Unlock()
+	if u.ExpirationDateTime.IsZero() {
+		return math.MaxInt64
+	}
+	return time.Until(u.ExpirationDateTime)
+}
+
+// createSession creates an upload session on the server for a large upload.
+func (u *UploadSession) createSession(auth *graph.Auth, uploadPath string) error {
+	sessionPostData, _ := json.Marshal(UploadSessionPost{
+		ConflictBehavior: "replace",
+		FileSystemInfo: FileSystemInfo{
+			LastModifiedDateTime: u.ModTime,
+		},
+	})
+	resp, err := graph.Post(uploadPath, auth, bytes.NewReader(sessionPostData))
+	if err != nil {
+		return fmt.Errorf("failed to create upload session: %w", err)
+	}
+
+	// populate UploadURL/expiration - we unmarshal into a fresh session here
+	// just in case the API does something silly at a later date and overwrites
+	// a field it shouldn't.
+	tmp := UploadSession{}
+	if err = json.Unmarshal(resp, &tmp); err != nil {
+		return fmt.Errorf("could not unmarshal upload session post response: %w", err)
+	}
+	u.Lock()
+	u.UploadURL = tmp.UploadURL
+	u.ExpirationDateTime = tmp.ExpirationDateTime
+	onCreate := u.onCreate
+	u.Unlock()
+	if onCreate != nil {
+		onCreate(u)
+	}
+	return nil
+}
+
+// updateExpiry picks up the new expiration time the server sends back after
+// each chunk, since uploading to a session keeps it alive. It also marks the
+// upload as still making progress for the watchdog.
+func (u *UploadSession) updateExpiry(resp []byte) {
+	tmp := struct {
+		ExpirationDateTime time.Time `json:"expirationDateTime"`
+	}{}
+	u.Lock()
+	defer u.Unlock()
+	u.active = time.Now()
+	if json.Unmarshal(resp, &tmp) == nil && !tmp.ExpirationDateTime.IsZero() {
+		u.ExpirationDateTime = tmp.ExpirationDateTime
+	}
+}
+
 // cancel the upload session by deleting the temp file at the endpoint.
 func (u *UploadSession) cancel(auth *graph.Auth) {
 	u.Lock()
@@ -131,11 +259,33 @@ func (u *UploadSession) cancel(auth *graph.Auth) {
 		state := u.getState()
 		if state == uploadStarted || state == uploadErrored {
 			// dont care about result, this is purely us being polite to the server
-			go graph.Delete(u.UploadURL, auth)
+			go graph.CancelUploadSession(u.UploadURL)
 		}
 	}
 }
 
+// verify checks the uploaded item against what we meant to upload. If the
+// server did not send back a QuickXorHash, whichever hash it did send is
+// computed from our copy of the data instead.
+func (u *UploadSession) verify(remote *graph.DriveItem) bool {
+	if remote.File == nil {
+		return false
+	}
+	if equal, ok := remote.File.Hashes.Compare(graph.Hashes{QuickXorHash: u.QuickXORHash}); ok {
+		return equal
+	}
+	return remote.VerifyStream(bytes.NewReader(u.Data))
+}
+
+// orphaned is true for a session restored from disk that still has a live
+// session on the server. Those are left behind when onedriver is killed or
+// crashes mid-upload, and take up space on the server until they expire.
+func (u *UploadSession) orphaned() bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.UploadURL != "" && time.Now().Before(u.ExpirationDateTime)
+}
+
 // Internal method used for uploading individual chunks of a DriveItem. We have
 // to make things this way because the internal Put func doesn't work all that
 // well when we need to add custom headers. Will return without an error if
@@ -160,22 +310,27 @@ func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64) ([]byte, in
 	if offset > u.Size {
 		return nil, -1, errors.New("offset cannot be larger than DriveItem size")
 	}
+	if graph.IsPaused() {
+		return nil, -1, graph.ErrPaused
+	}
 
 	auth.Refresh()
 
-	client := &http.Client{}
 	request, _ := http.NewRequest(
 		"PUT",
 		url,
 		bytes.NewReader((u.Data)[offset:end]),
 	)
+	graph.LimitUpload(request)
 	// no Authorization header - it will throw a 401 if present
 	request.Header.Add("Content-Length", strconv.Itoa(int(reqChunkSize)))
 	frags := fmt.Sprintf("bytes %d-%d/%d", offset, end-1, u.Size)
 	log.Info().Str("id", u.ID).Msg("Uploading " + frags)
 	request.Header.Add("Content-Range", frags)
 
-	resp, err := client.Do(request)
+	release := graph.AcquireUploadSlot()
+	defer release()
+	resp, err := graph.HTTPClient.Do(request)
 	if err != nil {
 		// this is a serious error, not simply one with a non-200 return code
 		return nil, -1, err
@@ -185,6 +340,46 @@ func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64) ([]byte, in
 	return response, resp.StatusCode, nil
 }
 
+// retryChunk retries a chunk the server failed with a 5xx error, with an
+// exponential back-off strategy capped at maxUploadBackoff between attempts.
+// It returns once the server responds with anything other than a 5xx error,
+// or with errUploadGaveUp once the server has been failing for longer than
+// the session's retryTimeout.
+func (u *UploadSession) retryChunk(auth *graph.Auth, offset uint64, status int) ([]byte, int, error) {
+	timeout := u.retryTimeout
+	if timeout <= 0 {
+		timeout = defaultUploadRetryTimeout
+	}
+	start := time.Now()
+	var resp []byte
+	var err error
+	for backoff := time.Second; status >= 500; backoff *= 2 {
+		if backoff > maxUploadBackoff {
+			backoff = maxUploadBackoff
+		}
+		if time.Since(start)+backoff > timeout {
+			return resp, status, fmt.Errorf("%w: HTTP %d for %s",
+				errUploadGaveUp, status, time.Since(start).Round(time.Second))
+		}
+		log.Error().
+			Str("id", u.ID).
+			Str("name", u.Name).
+			Uint64("offset", offset).
+			Int("status", status).
+			Msgf("The OneDrive server is having issues, retrying chunk upload in %s.", backoff)
+		time.Sleep(backoff)
+		// waiting on the server is not the same as being stuck
+		u.Lock()
+		u.active = time.Now()
+		u.Unlock()
+		resp, status, err = u.uploadChunk(auth, offset)
+		if err != nil { // a serious, non 4xx/5xx error
+			return resp, status, fmt.Errorf("failed to perform chunk upload: %w", err)
+		}
+	}
+	return resp, status, nil
+}
+
 // Upload copies the file's contents to the server. Should only be called as a
 // goroutine, or it can potentially block for a very long time. The uploadSession.error
 // field contains errors to be handled if called as a goroutine.
@@ -235,53 +430,44 @@ func (u *UploadSession) Upload(auth *graph.Auth) error {
 				url.PathEscape(u.ID),
 			)
 		}
-		sessionPostData, _ := json.Marshal(UploadSessionPost{
-			ConflictBehavior: "replace",
-			FileSystemInfo: FileSystemInfo{
-				LastModifiedDateTime: u.ModTime,
-			},
-		})
-		resp, err := graph.Post(uploadPath, auth, bytes.NewReader(sessionPostData))
-		if err != nil {
-			return u.setState(uploadErrored, fmt.Errorf("failed to create upload session: %w", err))
+		if err := u.createSession(auth, uploadPath); err != nil {
+			return u.setState(uploadErrored, err)
 		}
 
-		// populate UploadURL/expiration - we unmarshal into a fresh session here
-		// just in case the API does something silly at a later date and overwrites
-		// a field it shouldn't.
-		tmp := UploadSession{}
-		if err = json.Unmarshal(resp, &tmp); err != nil {
-			return u.setState(uploadErrored,
-				fmt.Errorf("could not unmarshal upload session post response: %w", err))
-		}
-		u.Lock()
-		u.UploadURL = tmp.UploadURL
-		u.ExpirationDateTime = tmp.ExpirationDateTime
-		u.Unlock()
-
 		// api upload session created successfully, now do actual content upload
 		var status int
+		var err error
+		renewals := 0
 		nchunks := int(math.Ceil(float64(u.Size) / float64(uploadChunkSize)))
 		for i := 0; i < nchunks; i++ {
+			if left := u.TimeUntilExpiry(); left < uploadExpiryMargin {
+				if renewals >= maxUploadRenewals {
+					return u.setState(uploadErrored, errors.New("upload session keeps expiring"))
+				}
+				renewals++
+				log.Warn().
+					Str("id", u.ID).
+					Str("name", u.Name).
+					Dur("timeLeft", left).
+					Int("chunk", i).
+					Msg("Upload session is about to expire, starting over with a new one.")
+				u.cancel(auth)
+				if err = u.createSession(auth, uploadPath); err != nil {
+					return u.setState(uploadErrored, err)
+				}
+				// chunks uploaded to the old session are gone with it
+				i = 0
+			}
+
 			resp, status, err = u.uploadChunk(auth, uint64(i)*uploadChunkSize)
 			if err != nil {
 				return u.setState(uploadErrored, fmt.Errorf("failed to perform chunk upload: %w", err))
 			}
 
-			// retry server-side failures with an exponential back-off strategy. Will not
-			// exit this loop unless it receives a non 5xx error or serious failure
-			for backoff := 1; status >= 500; backoff *= 2 {
-				log.Error().
-					Str("id", u.ID).
-					Str("name", u.Name).
-					Int("chunk", i).
-					Int("nchunks", nchunks).
-					Int("status", status).
-					Msgf("The OneDrive server is having issues, retrying chunk upload in %ds.", backoff)
-				time.Sleep(time.Duration(backoff) * time.Second)
-				resp, status, err = u.uploadChunk(auth, uint64(i)*uploadChunkSize)
-				if err != nil { // a serious, non 4xx/5xx error
-					return u.setState(uploadErrored, fmt.Errorf("failed to perform chunk upload: %w", err))
+			if status >= 500 {
+				resp, status, err = u.retryChunk(auth, uint64(i)*uploadChunkSize, status)
+				if err != nil {
+					return u.setState(uploadErrored, err)
 				}
 			}
 
@@ -289,6 +475,7 @@ func (u *UploadSession) Upload(auth *graph.Auth) error {
 			if status >= 400 {
 				return u.setState(uploadErrored, fmt.Errorf("error uploading chunk - HTTP %d: %s", status, string(resp)))
 			}
+			u.updateExpiry(resp)
 		}
 	}
 
@@ -321,13 +508,14 @@ func (u *UploadSession) Upload(auth *graph.Auth) error {
 		// if we are absolutely pounding the microsoft API, a remote item may sometimes
 		// come back without checksums, so we check the size of the uploaded item instead.
 		return u.setState(uploadErrored, errors.New("size mismatch when remote checksums did not exist"))
-	} else if !remote.VerifyChecksum(u.QuickXORHash) {
+	} else if !u.verify(&remote) {
 		return u.setState(uploadErrored, errors.New("remote checksum did not match"))
 	}
 	// update the UploadSession's ID in the event that we exchange a local for a remote ID
 	u.Lock()
 	u.ID = remote.ID
 	u.ETag = remote.ETag
+	u.CTag = remote.CTag
 	u.Unlock()
 	return u.setState(uploadComplete, nil)
 }
@@ -2,10 +2,15 @@ package fs
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -145,3 +150,83 @@ func TestUploadSessionLargeFS(t *testing.T) {
 	assert.Equal(t, graph.QuickXORHash(&contents), graph.QuickXORHash(&downloaded),
 		"Downloaded content did not match original content.")
 }
+
+// Sessions should report how long they have left, and pick up the extended
+// expiration the server sends back after each chunk.
+func TestUploadSessionExpiry(t *testing.T) {
+	t.Parallel()
+	session := UploadSession{}
+	assert.True(t, session.TimeUntilExpiry() > 24*time.Hour,
+		"Sessions not created on the server yet should not expire.")
+
+	session.ExpirationDateTime = time.Now().Add(time.Minute)
+	assert.True(t, session.TimeUntilExpiry() < uploadExpiryMargin)
+
+	session.updateExpiry([]byte(`{
+		"expirationDateTime": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `",
+		"nextExpectedRanges": ["10485760-"]
+	}`))
+	assert.True(t, session.TimeUntilExpiry() > 50*time.Minute)
+
+	// the final chunk returns the uploaded item instead
+	session.updateExpiry([]byte(`{"id": "abc", "name": "file.bin"}`))
+	assert.True(t, session.TimeUntilExpiry() > 50*time.Minute)
+}
+
+// A server that keeps failing should make an upload give up once it has been
+// retrying for long enough, rather than retry forever.
+func TestUploadRetryTimeout(t *testing.T) {
+	t.Parallel()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	data := []byte("never going to make it")
+	session := UploadSession{
+		UploadURL:    server.URL,
+		Size:         uint64(len(data)),
+		Data:         data,
+		retryTimeout: 2 * time.Second,
+	}
+	// far from expiring, so nothing tries to renew it
+	notExpired := &graph.Auth{ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	start := time.Now()
+	_, status, err := session.retryChunk(notExpired, 0, http.StatusServiceUnavailable)
+	assert.True(t, errors.Is(err, errUploadGaveUp), "Upload should have given up.")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.True(t, time.Since(start) < 5*time.Second, "Retried for too long.")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	session.setState(uploadErrored, err)
+	assert.True(t, session.gaveUp())
+}
+
+// Sessions created on the server should be reported so their URLs can be saved,
+// and cancelling one should delete it on the server.
+func TestCancelUploadSession(t *testing.T) {
+	t.Parallel()
+	testDir, err := fs.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+
+	session := UploadSession{Name: "cancelled_upload.bin", ModTime: time.Now()}
+	var created *UploadSession
+	session.onCreate = func(s *UploadSession) { created = s }
+	require.NoError(t, session.createSession(auth, fmt.Sprintf(
+		"/me/drive/items/%s:/%s:/createUploadSession", testDir.ID(), session.Name,
+	)))
+	assert.True(t, created == &session, "onCreate was not called.")
+	assert.True(t, session.orphaned())
+
+	require.NoError(t, graph.CancelUploadSession(session.UploadURL))
+	resp, err := http.Get(session.UploadURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, graph.CancelUploadSession(session.UploadURL),
+		"Cancelling a session that is already gone should not be an error.")
+
+	assert.False(t, (&UploadSession{}).orphaned())
+}
@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// uploads that have not gotten anywhere in this long are considered stuck
+const uploadStallTimeout = 10 * time.Minute
+
+// runUpload runs an upload, turning a panic into an upload error so that a bug
+// hit by one upload does not take every other one down with it.
+func (u *UploadManager) runUpload(session *UploadSession) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().
+				Str("id", session.ID).
+				Str("name", session.Name).
+				Str("stack", string(debug.Stack())).
+				Msgf("Upload panicked: %v", r)
+			session.setState(uploadErrored, fmt.Errorf("upload panicked: %v", r))
+		}
+	}()
+	if u.fs != nil {
+		session.retryTimeout = u.fs.opts.UploadRetryTimeout
+	}
+	session.Upload(u.auth)
+}
+
+// beat lets the watchdog know that uploadLoop is still running.
+func (u *UploadManager) beat() {
+	atomic.StoreInt64(&u.heartbeat, time.Now().UnixNano())
+}
+
+// Stalled is true when uploadLoop has stopped running, which means no uploads
+// will happen until onedriver is restarted. Nothing else about uploads should
+// be asked for while this is true, since the loop is likely stuck holding the
+// UploadManager lock.
+func (u *UploadManager) Stalled() bool {
+	return atomic.LoadInt32(&u.stalled) == 1
+}
+
+// watchdog periodically checks that uploads are still making progress, and
+// should be called as a goroutine.
+func (u *UploadManager) watchdog(timeout time.Duration) {
+	for {
+		time.Sleep(timeout / 10)
+		u.checkStalled(timeout)
+	}
+}
+
+// checkStalled looks for uploads that have not made any progress within
+// timeout, and starts them over. Anything that would stop uploads from being
+// started, like losing track of how many are running, is fixed as well.
+func (u *UploadManager) checkStalled(timeout time.Duration) {
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&u.heartbeat)))
+	if since > timeout {
+		// there's no getting the loop going again from here, all we can do is
+		// make sure someone finds out
+		if atomic.SwapInt32(&u.stalled, 1) == 0 {
+			log.Error().Dur("since", since).
+				Msg("Upload queue has stopped, uploads will not resume until onedriver is restarted.")
+		}
+		return
+	}
+	if atomic.SwapInt32(&u.stalled, 0) == 1 {
+		log.Warn().Msg("Upload queue is running again.")
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	running := 0
+	for id, session := range u.sessions {
+		state, active := session.activity()
+		if state == uploadNotStarted {
+			continue
+		}
+		if state == uploadStarted && time.Since(active) > timeout {
+			log.Error().
+				Str("id", session.ID).
+				Str("name", session.Name).
+				Dur("since", time.Since(active)).
+				Msg("Upload has stopped making progress, starting it over.")
+			session.cancel(u.auth)
+			fresh := session.restart()
+			u.persist(fresh)
+			u.sessions[id] = fresh
+			continue
+		}
+		running++
+	}
+	if u.inFlight != running {
+		log.Error().
+			Int("inFlight", u.inFlight).
+			Int("running", running).
+			Msg("Lost track of how many uploads are running, correcting it.")
+		u.inFlight = running
+	}
+}
@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// file managers read the name and icon of a mount from .xdg-volume-info in its
+// root. onedriver makes one up there, it is never uploaded.
+const (
+	volumeInfoName = ".xdg-volume-info"
+	volumeInfoID   = "local-xdg-volume-info"
+)
+
+// isVolumeInfo is true for the .xdg-volume-info file added by AddVolumeInfo.
+func isVolumeInfo(id string) bool {
+	return id == volumeInfoID
+}
+
+// AddVolumeInfo puts a read-only .xdg-volume-info file with contents in the
+// root of the mount. It only exists locally, and a real .xdg-volume-info on
+// OneDrive (like the ones older versions of onedriver uploaded) is left alone
+// and used instead.
+func (f *Filesystem) AddVolumeInfo(contents string) error {
+	root := f.GetID(f.root)
+	if root == nil {
+		return errors.New("root item is not cached")
+	}
+	children, err := f.GetChildrenID(f.root, f.auth)
+	if err != nil {
+		return err
+	}
+	root.RLock()
+	known := root.children != nil
+	root.RUnlock()
+	if !known {
+		// adding it now would hide everything else in the root until restarted
+		return errors.New("children of the root are not known yet")
+	}
+	if child, exists := children[volumeInfoName]; exists && !isVolumeInfo(child.ID()) {
+		log.Info().Str("id", child.ID()).
+			Msg("Using the .xdg-volume-info that is already on OneDrive.")
+		return nil
+	}
+
+	if err := f.content.Insert(volumeInfoID, []byte(contents)); err != nil {
+		return err
+	}
+	inode := f.GetID(volumeInfoID)
+	if inode == nil {
+		inode = NewInodeDriveItem(&graph.DriveItem{
+			ID:     volumeInfoID,
+			Name:   volumeInfoName,
+			Parent: &graph.DriveItemParent{ID: f.root},
+		})
+		inode.mode = fuse.S_IFREG | 0444
+		f.InsertChild(f.root, inode)
+	}
+	now := time.Now()
+	inode.Lock()
+	inode.DriveItem.Size = uint64(len(contents))
+	inode.DriveItem.ModTime = &now
+	inode.Unlock()
+	return nil
+}
+
+// replaceVolumeInfo swaps out the made up .xdg-volume-info for a real one that
+// showed up on OneDrive.
+func (f *Filesystem) replaceVolumeInfo(parentID string, item *graph.DriveItem) {
+	f.DeleteID(volumeInfoID)
+	f.content.Delete(volumeInfoID)
+	f.InsertChild(parentID, NewInodeDriveItem(item))
+	f.invalidateEntry(parentID, volumeInfoName)
+}
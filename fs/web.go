@@ -0,0 +1,311 @@
+package fs
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// requests that change something must set this header, which a form on
+// another site cannot do without the browser asking us first
+const webActionHeader = "X-Onedriver-Action"
+
+// ServeWeb serves the web UI on addr and should be called as a goroutine. If
+// addr does not specify a host, only connections from this machine are
+// accepted.
+func (f *Filesystem) ServeWeb(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// allow just a port number to be given
+		host, port = "", strings.TrimPrefix(addr, ":")
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	addr = net.JoinHostPort(host, port)
+	log.Info().Str("addr", addr).Msg("Serving web UI.")
+	return http.ListenAndServe(addr, f.WebHandler(host))
+}
+
+// WebHandler is the web UI: a single status page and the small JSON API behind
+// it. Requests with a Host header other than host or a loopback name are
+// refused, so that other sites cannot get at the API via DNS rebinding. There
+// is no login, so the POST actions only exist when host is a loopback address,
+// and anyone who can reach a web UI on any other address can only look.
+//
+//	GET  /             the status page
+//	GET  /api/status   the same thing that is written to the status file
+//	GET  /api/auth     the URL to visit to log in again
+//	GET  /api/history  what happened to files in the last hour
+//	POST /api/sync     check the server for changes right away
+//	POST /api/pause    stop all network activity until resumed
+//	POST /api/resume   undo a pause
+//	POST /api/flush    upload the changes to the file with the given "id" now
+//	POST /api/close    same as the "close" control command for "id"
+//	POST /api/reauth   finish logging in with the redirect "url"
+func (f *Filesystem) WebHandler(host string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(webIndex))
+	})
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, f.Status())
+	})
+	mux.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, f.History(time.Now().Add(-time.Hour)))
+	})
+	mux.HandleFunc("/api/auth", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"account": f.auth.Account,
+			"url":     graph.AuthURL(f.auth.AuthConfig),
+		})
+	})
+	if !webLoopback(host) {
+		log.Warn().Str("host", host).
+			Msg("Web UI is not on a loopback address, its actions are disabled.")
+		return webHostCheck(mux, host)
+	}
+	mux.HandleFunc("/api/sync", webAction(func(r *http.Request) error {
+		f.RequestSync()
+		return nil
+	}))
+	mux.HandleFunc("/api/pause", webAction(func(r *http.Request) error {
+		f.Pause()
+		return nil
+	}))
+	mux.HandleFunc("/api/resume", webAction(func(r *http.Request) error {
+		f.Resume()
+		return nil
+	}))
+	mux.HandleFunc("/api/flush", webAction(func(r *http.Request) error {
+		return f.ForceFlush(r.FormValue("id"))
+	}))
+	mux.HandleFunc("/api/close", webAction(func(r *http.Request) error {
+		return f.ForceClose(r.FormValue("id"))
+	}))
+	mux.HandleFunc("/api/reauth", webAction(func(r *http.Request) error {
+		if err := f.auth.ReauthenticateWithURL(r.FormValue("url")); err != nil {
+			return err
+		}
+		log.Info().Str("account", f.auth.Account).Msg("Reauthenticated from web UI.")
+		f.RequestSync()
+		return nil
+	}))
+	return webHostCheck(mux, host)
+}
+
+// webHostCheck refuses requests that webHostAllowed() does not like before
+// handing them to handler.
+func webHostCheck(handler http.Handler, host string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !webHostAllowed(r.Host, host) {
+			http.Error(w, "host not allowed", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// webLoopback is true if host only accepts connections from this machine.
+func webLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// webAction wraps an API endpoint that changes something.
+func webAction(action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get(webActionHeader) == "" {
+			writeJSON(w, http.StatusMethodNotAllowed,
+				map[string]string{"error": "must be a POST with " + webActionHeader + " set"})
+			return
+		}
+		if err := action(r); err != nil {
+			log.Error().Err(err).Str("path", r.URL.Path).Msg("Web UI action failed.")
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// webHostAllowed checks the Host header of a request against the host the web
+// UI is listening on.
+func webHostAllowed(requestHost string, listenHost string) bool {
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = h
+	}
+	requestHost = strings.Trim(requestHost, "[]")
+	if requestHost == "localhost" || requestHost == listenHost {
+		return true
+	}
+	ip := net.ParseIP(requestHost)
+	return ip != nil && (ip.IsLoopback() || ip.Equal(net.ParseIP(listenHost)))
+}
+
+// webIndex is the entire web UI. It only talks to the JSON API.
+const webIndex = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>onedriver</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 60em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.2em 0.5em; border-bottom: 1px solid #ddd; }
+.bad { color: #b00; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>onedriver</h1>
+<p>
+  <span id="state"></span> &middot; <span id="account"></span>
+  &middot; updated <span id="updated"></span>
+</p>
+<p>
+  <button onclick="act('sync')">Sync now</button>
+  <button id="pause" onclick="act(this.dataset.action)"></button>
+  <button onclick="reauth()">Log in again</button>
+</p>
+<p id="error"></p>
+<div id="login" hidden>
+  <p>Visit <a id="authURL" target="_blank">this page</a> to log in, then paste
+  the URL of the blank page you end up on here:</p>
+  <input id="redirect" size="60"> <button onclick="finishReauth()">Submit</button>
+</div>
+
+<h2>Cache</h2>
+<table id="cache"></table>
+<h2>Uploads</h2>
+<table id="uploads"></table>
+<h2>Failed uploads</h2>
+<table id="failed"></table>
+<h2>Conflicts</h2>
+<table id="conflicts"></table>
+<h2>Open files</h2>
+<table id="open"></table>
+<h2>Recent operations</h2>
+<table id="operations"></table>
+<h2>Activity in the last hour</h2>
+<table id="history"></table>
+
+<script>
+function esc(s) {
+  return String(s).replace(/[&<>"']/g, c => "&#" + c.charCodeAt(0) + ";");
+}
+
+function bytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function table(id, head, rows) {
+  document.getElementById(id).innerHTML = rows.length
+    ? "<tr>" + head.map(h => "<th>" + h + "</th>").join("") + "</tr>" +
+      rows.map(r => "<tr>" + r.map(c => "<td>" + c + "</td>").join("") + "</tr>").join("")
+    : "<tr><td>None</td></tr>";
+}
+
+function post(path, params) {
+  return fetch(path, {
+    method: "POST",
+    headers: {"` + webActionHeader + `": "1"},
+    body: new URLSearchParams(params || {}),
+  }).then(r => r.json()).then(j => {
+    document.getElementById("error").textContent = j.error || "";
+    refresh();
+  });
+}
+
+function act(action, id) {
+  return post("api/" + action, id ? {id: id} : {});
+}
+
+document.getElementById("open").addEventListener("click", e => {
+  if (e.target.dataset.action) act(e.target.dataset.action, e.target.dataset.id);
+});
+
+function reauth() {
+  fetch("api/auth").then(r => r.json()).then(j => {
+    document.getElementById("authURL").href = j.url;
+    document.getElementById("login").hidden = false;
+  });
+}
+
+function finishReauth() {
+  post("api/reauth", {url: document.getElementById("redirect").value}).then(() => {
+    document.getElementById("login").hidden = true;
+  });
+}
+
+function refresh() {
+  fetch("api/status").then(r => r.json()).then(s => {
+    let state = s.paused ? "<span class=bad>Paused</span>"
+      : s.offline ? "<span class=bad>Offline</span>" : "Online";
+    if (s.overQuota) state += ", <span class=bad>over quota</span>";
+    document.getElementById("state").innerHTML = state;
+    const pause = document.getElementById("pause");
+    pause.dataset.action = s.paused ? "resume" : "pause";
+    pause.textContent = s.paused ? "Resume sync" : "Pause sync";
+    document.getElementById("account").textContent = s.account;
+    document.getElementById("updated").textContent = new Date(s.updated).toLocaleTimeString();
+
+    const m = s.metrics;
+    table("cache", ["Cached files", "Cache size", "Inodes", "Requests", "Errors", "Throttled",
+      "Queued", "Upload", "Download"],
+      [[m.cachedFiles, bytes(m.cacheBytes), m.inodes,
+        m.graph.requests, m.graph.errors, m.graph.throttled,
+        m.graph.queued + " (" + (m.graph.queuedTime / 1e9).toFixed(1) + "s)",
+        bytes(m.uploadRate) + "/s", bytes(m.downloadRate) + "/s"]]);
+    table("uploads", ["Name", "State", "Size", "Retries"],
+      s.uploads.map(u => [esc(u.name), esc(u.state), bytes(u.size), u.retries]));
+    table("failed", ["Path", "Error", "Failed"],
+      s.failedUploads.map(u => [esc(u.path || u.name), esc(u.error),
+        new Date(u.failed).toLocaleString()]));
+    table("conflicts", ["Path", "Copy of"],
+      s.conflicts.map(c => [esc(c.path), esc(c.original)]));
+    table("open", ["Path", "Changed", ""],
+      s.openFiles.map(f => [esc(f.path), f.hasChanges ? "yes" : "no",
+        "<button data-action=flush data-id=\"" + esc(f.id) + "\">Flush</button> " +
+        "<button data-action=close data-id=\"" + esc(f.id) + "\">Close</button>"]));
+    table("operations", ["Operation", "Finished", "Succeeded", "Failed"],
+      s.operations.slice().reverse().map(o => [esc(o.op),
+        new Date(o.finished).toLocaleString(), o.succeeded, o.nFailed]));
+  }).catch(() => {
+    document.getElementById("state").innerHTML = "<span class=bad>Not running</span>";
+  });
+  fetch("api/history").then(r => r.json()).then(h => {
+    table("history", ["Time", "What", "Path"],
+      h.reverse().map(e => [new Date(e.time).toLocaleTimeString(),
+        esc(e.action) + (e.remote ? " (on server)" : ""), esc(e.path)]));
+  });
+}
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
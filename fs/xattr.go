@@ -0,0 +1,263 @@
+package fs
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// the description of an item on OneDrive is exposed as this extended attribute
+	xattrDescription = "user.onedriver.description"
+	// read-only, where a file is in the upload process (see UploadState())
+	xattrUploadStatus = "user.onedriver.uploadstatus"
+	// read-only, the name of the file that this one is a conflict copy of
+	xattrConflict = "user.onedriver.conflict"
+	// read-only, a short-lived URL the file can be downloaded from directly
+	xattrDownloadURL = "user.onedriver.downloadurl"
+	// read-only, what OneDrive knows about images and photos without having to
+	// download them
+	xattrImageWidth  = "user.onedriver.image.width"
+	xattrImageHeight = "user.onedriver.image.height"
+	xattrPhotoTaken  = "user.onedriver.photo.taken"
+	xattrPhotoCamera = "user.onedriver.photo.camera"
+	// read-only, how SharePoint identifies an item in business drives and
+	// document libraries
+	xattrSharepointSite     = "user.onedriver.sharepoint.siteid"
+	xattrSharepointWeb      = "user.onedriver.sharepoint.webid"
+	xattrSharepointList     = "user.onedriver.sharepoint.listid"
+	xattrSharepointListItem = "user.onedriver.sharepoint.listitemid"
+	// write-only, setting it to anything removes the file's cached content
+	xattrEvict = "user.onedriver.evict"
+
+	// getxattr is usually called twice in a row, once to get the size of the
+	// value and then to read it, so URLs are kept around for a moment to make
+	// sure both calls see the same one
+	downloadURLReuse = 30 * time.Second
+)
+
+// downloadURL is a download URL and when it was fetched.
+type downloadURL struct {
+	url     string
+	fetched time.Time
+}
+
+// hasDownloadURL is true for items downloadURL() can get a URL for: files that
+// have been uploaded, as long as we are online.
+func (f *Filesystem) hasDownloadURL(inode *Inode) bool {
+	return !inode.IsDir() && !isLocalID(inode.ID()) && !f.IsOffline()
+}
+
+// downloadURL fetches a URL that a file can be downloaded from without going
+// through onedriver. It is empty for folders, files that have not been
+// uploaded yet, and while offline.
+func (f *Filesystem) downloadURL(inode *Inode) string {
+	if !f.hasDownloadURL(inode) {
+		return ""
+	}
+	id := inode.ID()
+	if cached, ok := f.downloadURLs.Load(id); ok {
+		if entry := cached.(downloadURL); time.Since(entry.fetched) < downloadURLReuse {
+			return entry.url
+		}
+	}
+	url, err := graph.GetItemDownloadURL(id, f.auth)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Str("path", inode.Path()).
+			Msg("Could not fetch download URL.")
+		return ""
+	}
+	f.expireDownloadURLs()
+	f.downloadURLs.Store(id, downloadURL{url: url, fetched: time.Now()})
+	return url
+}
+
+// expireDownloadURLs forgets the download URLs that are too old to be reused,
+// so that only the ones from the last few moments are kept around.
+func (f *Filesystem) expireDownloadURLs() {
+	f.downloadURLs.Range(func(key interface{}, value interface{}) bool {
+		if time.Since(value.(downloadURL).fetched) >= downloadURLReuse {
+			f.downloadURLs.Delete(key)
+		}
+		return true
+	})
+}
+
+// xattrValue returns the value of an extended attribute, which is empty if an
+// item does not have it.
+func (f *Filesystem) xattrValue(inode *Inode, attr string) string {
+	switch attr {
+	case xattrDescription:
+		inode.RLock()
+		defer inode.RUnlock()
+		return inode.DriveItem.Description
+	case xattrUploadStatus:
+		return f.uploads.UploadState(inode.ID())
+	case xattrConflict:
+		return f.conflictOf(inode)
+	case xattrDownloadURL:
+		return f.downloadURL(inode)
+	case xattrImageWidth, xattrImageHeight, xattrPhotoTaken, xattrPhotoCamera:
+		inode.RLock()
+		defer inode.RUnlock()
+		return mediaXAttr(inode.DriveItem, attr)
+	case xattrSharepointSite, xattrSharepointWeb, xattrSharepointList, xattrSharepointListItem:
+		inode.RLock()
+		defer inode.RUnlock()
+		return sharepointXAttr(inode.DriveItem, attr)
+	}
+	return ""
+}
+
+// mediaXAttr returns the image and photo attributes of an item.
+func mediaXAttr(item graph.DriveItem, attr string) string {
+	image, photo := item.Image, item.Photo
+	switch {
+	case attr == xattrImageWidth && image != nil && image.Width > 0:
+		return strconv.Itoa(image.Width)
+	case attr == xattrImageHeight && image != nil && image.Height > 0:
+		return strconv.Itoa(image.Height)
+	case attr == xattrPhotoTaken && photo != nil && photo.TakenDateTime != nil:
+		return photo.TakenDateTime.UTC().Format(time.RFC3339)
+	case attr == xattrPhotoCamera && photo != nil:
+		// models usually already start with the make, like "Canon EOS 5D"
+		if strings.HasPrefix(photo.CameraModel, photo.CameraMake) {
+			return photo.CameraModel
+		}
+		return strings.TrimSpace(photo.CameraMake + " " + photo.CameraModel)
+	}
+	return ""
+}
+
+// sharepointXAttr returns the SharePoint IDs of an item.
+func sharepointXAttr(item graph.DriveItem, attr string) string {
+	ids := item.SharepointIDs
+	if ids == nil {
+		return ""
+	}
+	switch attr {
+	case xattrSharepointSite:
+		return ids.SiteID
+	case xattrSharepointWeb:
+		return ids.WebID
+	case xattrSharepointList:
+		return ids.ListID
+	case xattrSharepointListItem:
+		return ids.ListItemID
+	}
+	return ""
+}
+
+// GetXAttr reads an extended attribute. The supported attributes are an item's
+// description, its upload status, what it is a conflict copy of, a URL its
+// content can be downloaded from, image and photo metadata, and SharePoint IDs.
+func (f *Filesystem) GetXAttr(cancel <-chan struct{}, in *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	inode := f.GetNodeID(in.NodeId)
+	if inode == nil {
+		return 0, fuse.ENOENT
+	}
+	value := f.xattrValue(inode, attr)
+	if value == "" {
+		return 0, fuse.ENOATTR
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), fuse.ERANGE
+	}
+	return uint32(copy(dest, value)), fuse.OK
+}
+
+// ListXAttr lists the extended attributes an item has.
+func (f *Filesystem) ListXAttr(cancel <-chan struct{}, in *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	inode := f.GetNodeID(in.NodeId)
+	if inode == nil {
+		return 0, fuse.ENOENT
+	}
+	list := ""
+	for _, attr := range []string{
+		xattrDescription, xattrUploadStatus, xattrConflict,
+		xattrImageWidth, xattrImageHeight, xattrPhotoTaken, xattrPhotoCamera,
+		xattrSharepointSite, xattrSharepointWeb, xattrSharepointList, xattrSharepointListItem,
+	} {
+		if f.xattrValue(inode, attr) != "" {
+			list += attr + "\x00"
+		}
+	}
+	// listing attributes should not need the server, so this one is listed for
+	// anything that can have it
+	if f.hasDownloadURL(inode) {
+		list += xattrDownloadURL + "\x00"
+	}
+	if len(dest) < len(list) {
+		return uint32(len(list)), fuse.ERANGE
+	}
+	return uint32(copy(dest, list)), fuse.OK
+}
+
+// SetXAttr sets an extended attribute, which is immediately synced to the
+// server.
+func (f *Filesystem) SetXAttr(cancel <-chan struct{}, in *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if attr == xattrEvict {
+		return f.evictXAttr(in.NodeId)
+	}
+	return f.setDescription(in.NodeId, attr, string(data))
+}
+
+// evictXAttr removes a file's cached content when xattrEvict is set on it.
+func (f *Filesystem) evictXAttr(nodeID uint64) fuse.Status {
+	inode := f.GetNodeID(nodeID)
+	if inode == nil {
+		return fuse.ENOENT
+	}
+	if inode.IsDir() {
+		return fuse.Status(syscall.EISDIR)
+	}
+	if err := f.ForceEvict(inode.ID()); err != nil {
+		log.Warn().Err(err).Str("path", inode.Path()).Msg("Refusing to evict cached content.")
+		return fuse.EBUSY
+	}
+	return fuse.OK
+}
+
+// RemoveXAttr removes an extended attribute.
+func (f *Filesystem) RemoveXAttr(cancel <-chan struct{}, in *fuse.InHeader, attr string) fuse.Status {
+	return f.setDescription(in.NodeId, attr, "")
+}
+
+// setDescription does the work for SetXAttr and RemoveXAttr.
+func (f *Filesystem) setDescription(nodeID uint64, attr string, description string) fuse.Status {
+	inode := f.GetNodeID(nodeID)
+	if inode == nil {
+		return fuse.ENOENT
+	}
+	if attr != xattrDescription {
+		return fuse.Status(syscall.ENOTSUP)
+	}
+	if f.IsOffline() {
+		return fuse.EROFS
+	}
+
+	ctx := log.With().
+		Str("op", "SetXAttr").
+		Uint64("nodeID", nodeID).
+		Str("path", inode.Path()).
+		Logger()
+	id, err := f.remoteID(inode)
+	if err != nil || isLocalID(id) {
+		ctx.Error().Err(err).Msg("Could not obtain a remote ID to set description.")
+		return fuse.EREMOTEIO
+	}
+	if err = graph.SetDescription(id, description, f.auth); err != nil {
+		ctx.Error().Err(err).Msg("Could not set description.")
+		return fuse.EREMOTEIO
+	}
+	inode.Lock()
+	inode.DriveItem.Description = description
+	inode.Unlock()
+	ctx.Info().Str("description", description).Msg("Set item description.")
+	return fuse.OK
+}
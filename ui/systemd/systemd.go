@@ -117,3 +117,15 @@ func UnitSetEnabled(unit string, enabled bool) error {
 		"org.freedesktop.systemd1.Manager.DisableUnitFiles", 0, units, false,
 	).Err
 }
+
+// DaemonReload makes systemd pick up unit files that were added or changed.
+func DaemonReload() error {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	obj := conn.Object(SystemdBusName, SystemdObjectPath)
+	return obj.Call("org.freedesktop.systemd1.Manager.Reload", 0).Err
+}
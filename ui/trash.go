@@ -0,0 +1,77 @@
+package ui
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// removed mounts are moved here, inside of the cache directory
+	trashDir = ".trash"
+
+	// TrashRetention is how long the cache of a removed mount is kept around in
+	// case it gets added again.
+	TrashRetention = 7 * 24 * time.Hour
+)
+
+// TrashMount moves the cache of a mount to the trash instead of deleting it, so
+// that adding the same mountpoint again does not have to download everything
+// again. instance is the escaped mountpoint.
+func TrashMount(cacheDir, instance string) error {
+	dest := filepath.Join(cacheDir, trashDir, instance)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	// only the most recently removed copy is kept
+	os.RemoveAll(dest)
+	if err := os.Rename(filepath.Join(cacheDir, instance), dest); err != nil {
+		return err
+	}
+	// the retention period counts from when the mount was removed
+	now := time.Now()
+	return os.Chtimes(dest, now, now)
+}
+
+// RestoreMount moves the cache of a removed mount back out of the trash. It
+// returns false if there was nothing to restore, or if the mount already has a
+// cache again.
+func RestoreMount(cacheDir, instance string) (bool, error) {
+	src := filepath.Join(cacheDir, trashDir, instance)
+	if _, err := os.Stat(src); err != nil {
+		return false, nil
+	}
+	dest := filepath.Join(cacheDir, instance)
+	if _, err := os.Stat(filepath.Join(dest, "auth_tokens.json")); err == nil {
+		return false, nil
+	}
+	// an empty directory may have been created for the mount in the meantime
+	os.RemoveAll(dest)
+	if err := os.Rename(src, dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// EmptyTrash deletes the caches of removed mounts that have been in the trash
+// for longer than retention.
+func EmptyTrash(cacheDir string, retention time.Duration) {
+	dir := filepath.Join(cacheDir, trashDir)
+	dirents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, dirent := range dirents {
+		if time.Since(dirent.ModTime()) < retention {
+			continue
+		}
+		log.Info().Str("instance", dirent.Name()).Msg("Deleting cache of removed mount.")
+		if err := os.RemoveAll(filepath.Join(dir, dirent.Name())); err != nil {
+			log.Error().Err(err).Str("instance", dirent.Name()).
+				Msg("Could not delete cache of removed mount.")
+		}
+	}
+}
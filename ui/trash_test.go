@@ -0,0 +1,42 @@
+package ui
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Removed mounts should be restorable until they have been in the trash for too
+// long.
+func TestTrashRestoreMount(t *testing.T) {
+	t.Parallel()
+	cacheDir := "_test_trash"
+	defer os.RemoveAll(cacheDir)
+	tokens := filepath.Join(cacheDir, "-home-user-OneDrive", "auth_tokens.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(tokens), 0700))
+	require.NoError(t, ioutil.WriteFile(tokens, []byte("{}"), 0600))
+
+	require.NoError(t, TrashMount(cacheDir, "-home-user-OneDrive"))
+	assert.NotContains(t, GetKnownMounts(cacheDir), "-home-user-OneDrive")
+
+	restored, err := RestoreMount(cacheDir, "-home-user-OneDrive")
+	require.NoError(t, err)
+	assert.True(t, restored)
+	assert.FileExists(t, tokens)
+
+	restored, err = RestoreMount(cacheDir, "-home-user-OneDrive")
+	require.NoError(t, err)
+	assert.False(t, restored, "There should be nothing left to restore.")
+
+	require.NoError(t, TrashMount(cacheDir, "-home-user-OneDrive"))
+	EmptyTrash(cacheDir, time.Hour)
+	assert.DirExists(t, filepath.Join(cacheDir, trashDir, "-home-user-OneDrive"))
+	EmptyTrash(cacheDir, 0)
+	restored, _ = RestoreMount(cacheDir, "-home-user-OneDrive")
+	assert.False(t, restored, "Old mounts should be deleted from the trash.")
+}